@@ -11,15 +11,26 @@ import (
 // Different applications can have very different error code requirements so
 // these should be expanded as needed (or introduce subcodes).
 const (
-	ECONFLICT       = "conflict"        // conflict with current state
-	EINTERNAL       = "internal"        // internal error
-	EINVALID        = "invalid"         // invalid input
-	ENOTFOUND       = "not_found"       // resource not found
-	ENOTIMPLEMENTED = "not_implemented" // feature not implemented
-	EUNAUTHORIZED   = "unauthorized"    // access denied
-	EUNKNOWN        = "unknown"         // unknown error
-	EFORBIDDEN      = "forbidden"       // access forbidden
-	EEXISTS         = "exists"          // resource already exists
+	ECONFLICT        = "conflict"          // conflict with current state
+	EINTERNAL        = "internal"          // internal error
+	EINVALID         = "invalid"           // invalid input
+	ENOTFOUND        = "not_found"         // resource not found
+	ENOTIMPLEMENTED  = "not_implemented"   // feature not implemented
+	EUNAUTHORIZED    = "unauthorized"      // access denied
+	EUNKNOWN         = "unknown"           // unknown error
+	EFORBIDDEN       = "forbidden"         // access forbidden
+	EEXISTS          = "exists"            // resource already exists
+	ELOCKED          = "locked"            // resource temporarily locked
+	ETOOMANYREQUESTS = "too_many_requests" // rate limit exceeded
+)
+
+// Token error codes, they are all reported as unauthorized but let the
+// client tell why its token has been rejected.
+const (
+	ETOKENEXPIRED     = "token_expired"           // token expired
+	ETOKENNOTYETVALID = "token_not_yet_valid"     // token used before its nbf/iat
+	ETOKENSIGNATURE   = "token_invalid_signature" // token signature or key not valid
+	ETOKENMALFORMED   = "token_malformed"         // token can't be decoded
 )
 
 // Error represents an application-specific error. Application errors can be
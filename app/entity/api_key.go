@@ -0,0 +1,67 @@
+package entity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// APIKeyPrefix is the prefix of every API key, it makes them easy to spot in logs and secret scanners.
+const APIKeyPrefix = "gsk_"
+
+// APIKey is a key used by a client to call the API without an interactive login.
+// Only the hash of the key is stored, the key itself is shown once at creation.
+type APIKey struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+
+	// Prefix is the first part of the key, it identifies the key without revealing it.
+	Prefix  string `json:"prefix"`
+	KeyHash string `json:"-"`
+
+	// Scopes are the permissions granted to the key.
+	Scopes []Permission `json:"scopes"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type APIKeys []*APIKey
+
+// HasScope returns true if the key grants the permission.
+func (k *APIKey) HasScope(permission Permission) bool {
+	for _, p := range k.Scopes {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Revoked returns true if the key has been revoked.
+func (k *APIKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// NewAPIKeySecret returns a new random API key and its prefix.
+func NewAPIKeySecret() (key string, prefix string, err error) {
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	key = APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	return key, key[:len(APIKeyPrefix)+8], nil
+}
+
+// HashAPIKey returns the hash of an API key as it is stored.
+// API keys are random with 256 bits of entropy, so a fast hash is enough.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
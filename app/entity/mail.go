@@ -0,0 +1,8 @@
+package entity
+
+// Mail is a plain text email message.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
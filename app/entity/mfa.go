@@ -0,0 +1,61 @@
+package entity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// MFAChallengeExpiration is the time a user has to enter the second factor
+// after the password has been verified.
+const MFAChallengeExpiration = 5 * time.Minute
+
+// RecoveryCodeCount is the number of recovery codes given to a user.
+const RecoveryCodeCount = 10
+
+// TOTP is the secret a user has enrolled in an authenticator app.
+// A secret is used as a second factor only once it has been confirmed with a code.
+type TOTP struct {
+	UserID int64 `json:"user_id"`
+
+	// Secret is the base32 encoded secret, it must be kept in clear to compute the codes.
+	Secret string `json:"-"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	ConfirmedAt *time.Time `json:"confirmed_at"`
+
+	// LastCounter is the time step of the last accepted code.
+	LastCounter int64 `json:"-"`
+}
+
+// Confirmed reports whether the secret is enabled as a second factor.
+func (t *TOTP) Confirmed() bool {
+	return t.ConfirmedAt != nil
+}
+
+// recoveryCodeEncoding avoids padding and is case insensitive once normalized.
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewRecoveryCode returns a new random recovery code such as "k4x2m-q7zpa".
+func NewRecoveryCode() (string, error) {
+
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))[:10]
+
+	return code[:5] + "-" + code[5:], nil
+}
+
+// HashRecoveryCode returns the hash of a recovery code as it is stored.
+// The code is normalized first, so that case and separators don't matter.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,56 @@
+package entity
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+)
+
+// OIDCLoginExpiration is the time a user has to complete the login at the identity provider.
+const OIDCLoginExpiration = 10 * time.Minute
+
+// OIDCLogin is a login started at the identity provider, identified by the state
+// parameter of the authorization request and completed by its callback.
+type OIDCLogin struct {
+	State string
+
+	// Nonce is echoed by the identity provider in the ID token, binding the token to the login.
+	Nonce string
+
+	// CodeVerifier is the PKCE secret whose hash is sent in the authorization request.
+	CodeVerifier string
+
+	ExpiresAt time.Time
+}
+
+// NewOIDCLogin returns a new login with random state, nonce and code verifier.
+func NewOIDCLogin() (*OIDCLogin, error) {
+
+	login := &OIDCLogin{ExpiresAt: time.Now().Add(OIDCLoginExpiration)}
+
+	for _, v := range []*string{&login.State, &login.Nonce, &login.CodeVerifier} {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		*v = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	return login, nil
+}
+
+// Identity is a user of an identity provider, as described by a verified ID token.
+// Identities are linked to the users they log in as.
+type Identity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	UserID  int64  `json:"user_id"`
+
+	// Claims of the ID token, they are not stored.
+	Email             string `json:"-"`
+	EmailVerified     bool   `json:"-"`
+	Name              string `json:"-"`
+	PreferredUsername string `json:"-"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
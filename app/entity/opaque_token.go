@@ -0,0 +1,35 @@
+package entity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// OpaqueToken is the server side record of an opaque reference token: the token
+// is a random string meaningless to its holder, its claims are kept here.
+// Only the hash of the token is stored.
+type OpaqueToken struct {
+	TokenHash string
+	Claims    *AppClaims
+	ExpiresAt time.Time
+}
+
+// NewOpaqueToken returns a new random opaque token.
+func NewOpaqueToken() (string, error) {
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashOpaqueToken returns the hash of an opaque token as it is stored.
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
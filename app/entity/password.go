@@ -0,0 +1,19 @@
+package entity
+
+// Codes of the rules of the password policy.
+const (
+	PasswordTooShort         = "too_short"
+	PasswordTooLong          = "too_long"
+	PasswordMissingLowercase = "missing_lowercase"
+	PasswordMissingUppercase = "missing_uppercase"
+	PasswordMissingDigit     = "missing_digit"
+	PasswordMissingSymbol    = "missing_symbol"
+	PasswordBannedSubstring  = "banned_substring"
+	PasswordBreached         = "breached"
+)
+
+// PasswordViolation is a rule of the password policy that a password does not satisfy.
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
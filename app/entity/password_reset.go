@@ -0,0 +1,38 @@
+package entity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// PasswordResetExpiration is the time a password reset token can be used for.
+const PasswordResetExpiration = 30 * time.Minute
+
+// PasswordReset is a single-use token allowing a user to set a new password.
+// Only the hash of the token is stored, the token itself is mailed to the user.
+type PasswordReset struct {
+	TokenHash string
+	UserID    int64
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// NewPasswordResetToken returns a new random password reset token.
+func NewPasswordResetToken() (string, error) {
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashPasswordResetToken returns the hash of a password reset token as it is stored.
+func HashPasswordResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
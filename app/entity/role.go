@@ -0,0 +1,151 @@
+package entity
+
+import (
+	"mysql/app/apperr"
+	"strings"
+)
+
+// Role is the role of a user, it determines the permissions granted to the user.
+type Role string
+
+const (
+	RoleAdmin  Role = "admin"  // full access, including users management
+	RoleEditor Role = "editor" // can read and modify cities
+	RoleViewer Role = "viewer" // can only read cities
+)
+
+// Permission is an action a user can be allowed to perform.
+type Permission string
+
+const (
+	PermissionCitiesRead    Permission = "cities:read"
+	PermissionCitiesWrite   Permission = "cities:write"
+	PermissionCitiesDelete  Permission = "cities:delete"
+	PermissionUsersManage   Permission = "users:manage"
+	PermissionAPIKeysManage Permission = "apikeys:manage"
+
+	// PermissionAccountManage allows managing the own sessions, password and second
+	// factor; every role grants it, a token whose scope omits it cannot.
+	PermissionAccountManage Permission = "account:manage"
+)
+
+// rolePermissions maps each role to the permissions it grants.
+var rolePermissions = map[Role][]Permission{
+	RoleAdmin: {
+		PermissionCitiesRead,
+		PermissionCitiesWrite,
+		PermissionCitiesDelete,
+		PermissionUsersManage,
+		PermissionAPIKeysManage,
+		PermissionAccountManage,
+	},
+	RoleEditor: {
+		PermissionCitiesRead,
+		PermissionCitiesWrite,
+		PermissionAccountManage,
+	},
+	RoleViewer: {
+		PermissionCitiesRead,
+		PermissionAccountManage,
+	},
+}
+
+// permissions are all the known permissions.
+var permissions = []Permission{
+	PermissionCitiesRead,
+	PermissionCitiesWrite,
+	PermissionCitiesDelete,
+	PermissionUsersManage,
+	PermissionAPIKeysManage,
+	PermissionAccountManage,
+}
+
+// Valid returns true if the permission is known.
+func (p Permission) Valid() bool {
+	for _, v := range permissions {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid returns true if the role is known.
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// Permissions returns the permissions granted by the role.
+func (r Role) Permissions() []Permission {
+	return rolePermissions[r]
+}
+
+// HasPermission returns true if any of the roles grants the permission.
+func HasPermission(roles []Role, permission Permission) bool {
+	for _, r := range roles {
+		for _, p := range r.Permissions() {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Permissions returns the permissions granted by any of the roles, in a stable order.
+func Permissions(roles []Role) []Permission {
+	granted := make([]Permission, 0, len(permissions))
+	for _, p := range permissions {
+		if HasPermission(roles, p) {
+			granted = append(granted, p)
+		}
+	}
+	return granted
+}
+
+// FormatScope returns the permissions as an OAuth2 scope, a space separated list.
+func FormatScope(permissions []Permission) string {
+	a := make([]string, len(permissions))
+	for i, p := range permissions {
+		a[i] = string(p)
+	}
+	return strings.Join(a, " ")
+}
+
+// ParseScope returns the permissions of an OAuth2 scope, nil if the scope is empty.
+// Returns EINVALID if the scope contains an unknown permission.
+func ParseScope(scope string) ([]Permission, error) {
+
+	var parsed []Permission
+	for _, v := range strings.Fields(scope) {
+		p := Permission(v)
+		if !p.Valid() {
+			return nil, apperr.Errorf(apperr.EINVALID, "scope %q sconosciuto", v)
+		}
+		parsed = append(parsed, p)
+	}
+
+	return parsed, nil
+}
+
+// ReduceScope returns the granted permissions that have been requested, in the order of granted.
+// All the granted permissions are returned if requested is nil.
+func ReduceScope(granted []Permission, requested []Permission) []Permission {
+
+	if requested == nil {
+		return granted
+	}
+
+	reduced := make([]Permission, 0, len(requested))
+	for _, g := range granted {
+		for _, r := range requested {
+			if g == r {
+				reduced = append(reduced, g)
+				break
+			}
+		}
+	}
+
+	return reduced
+}
@@ -0,0 +1,50 @@
+package entity
+
+import (
+	"context"
+	"time"
+)
+
+// Session is a login of a user on a device. The tokens issued by the login and
+// by the refreshes that follow it share the sid claim, the id of the session,
+// so that revoking the session revokes all of them.
+type Session struct {
+	ID     string `json:"id"`
+	UserID int64  `json:"user_id"`
+
+	// TokenID is the jti of the last access token issued to the session.
+	TokenID string `json:"-"`
+
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+
+	IssuedAt    time.Time `json:"issued_at"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+
+	// ExpiresAt is the expiration of the last refresh token, after which the
+	// session can't be used anymore.
+	ExpiresAt time.Time `json:"expires_at"`
+
+	RevokedAt *time.Time `json:"-"`
+}
+
+type Sessions []*Session
+
+// Client describes the device a request comes from.
+type Client struct {
+	UserAgent string
+	IP        string
+}
+
+type clientContextKey struct{}
+
+// NewContextWithClient returns a copy of ctx carrying the client of the request.
+func NewContextWithClient(ctx context.Context, client *Client) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, client)
+}
+
+// ClientFromContext returns the client of the request carried by ctx, if any.
+func ClientFromContext(ctx context.Context) *Client {
+	client, _ := ctx.Value(clientContextKey{}).(*Client)
+	return client
+}
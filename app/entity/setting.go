@@ -0,0 +1,7 @@
+package entity
+
+// Names of the settings stored by the SettingService.
+const (
+	// SettingRegistrationEnabled is "true" if new users can register through the API.
+	SettingRegistrationEnabled = "registration_enabled"
+)
@@ -2,6 +2,7 @@ package entity
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -9,19 +10,69 @@ import (
 )
 
 const (
-	AccessTokenExpiration  = 60 * time.Minute           // 1 hour
-	RefreshTokenExpiration = 60 * 24 * 15 * time.Minute // 15 days
+	AccessTokenExpiration   = 60 * time.Minute           // 1 hour
+	RefreshTokenExpiration  = 60 * 24 * 15 * time.Minute // 15 days
+	ImpersonationExpiration = 15 * time.Minute           // tokens of an admin acting as another user
 )
 
+// Token uses, they prevent a refresh token from being accepted as an access token and vice versa.
+// A MFA token only proves that the password has been verified and must be
+// exchanged, together with the second factor, for a token pair.
+const (
+	AccessTokenUse  = "access"
+	RefreshTokenUse = "refresh"
+	MFATokenUse     = "mfa"
+)
+
+// Default issuer and audience of the tokens.
+const (
+	TokenIssuer   = "go-2022-stage"
+	TokenAudience = "go-2022-stage-api"
+)
+
+// TokenTypeBearer is the OAuth2 token type returned with every token pair.
+const TokenTypeBearer = "Bearer"
+
 // AppClaims is a custom claims type for JWT
-// It contains the information about the user and the standard claims
+// It contains the information about the user and the standard claims.
+// Tokens issued to a client with the client_credentials grant carry the
+// client id instead of a user.
 type AppClaims struct {
 	jwt.StandardClaims
-	User *User `json:"user"`
+	TokenUse string       `json:"token_use"`
+	User     *UserProfile `json:"user,omitempty"`
+	ClientID string       `json:"client_id,omitempty"`
+
+	// SessionID is the id of the session the token belongs to, see Session.
+	SessionID string `json:"sid,omitempty"`
+
+	// Scope is the space separated list of the permissions the token can be used for,
+	// a subset of the ones granted to the user or to the client.
+	Scope string `json:"scope,omitempty"`
+
+	// Actor is the admin acting as the user, set only on impersonation tokens.
+	Actor *Actor `json:"act,omitempty"`
+}
+
+// Actor identifies who is acting on behalf of the subject of a token,
+// as the act claim described by RFC 8693 section 4.1.
+type Actor struct {
+	Subject  string `json:"sub"`
+	Username string `json:"username,omitempty"`
+}
+
+// HasScope returns true if the scope of the token includes the permission.
+func (c *AppClaims) HasScope(permission Permission) bool {
+	for _, p := range strings.Fields(c.Scope) {
+		if Permission(p) == permission {
+			return true
+		}
+	}
+	return false
 }
 
 // NewAppClaims creates a new AppClaims
-func NewAppClaims(user *User, expiresAfterMinutes time.Duration) *AppClaims {
+func NewAppClaims(user *User, tokenUse string, expiresAfterMinutes time.Duration) *AppClaims {
 	return &AppClaims{
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: time.Now().Add(expiresAfterMinutes).UTC().Unix(),
@@ -29,16 +80,47 @@ func NewAppClaims(user *User, expiresAfterMinutes time.Duration) *AppClaims {
 			Subject:   fmt.Sprint(user.ID),
 			Id:        uuid.NewString(),
 			IssuedAt:  time.Now().UTC().Unix(),
-			Issuer:    "go-2022-stage",
-			Audience:  "go-2022-stage-api",
+			Issuer:    TokenIssuer,
+			Audience:  TokenAudience,
 		},
-		User: user,
+		TokenUse: tokenUse,
+		User:     user.Profile(),
 	}
 }
 
-// TokenPair is a struct that contains the tokens and the expiration time
+// NewClientClaims creates the claims of an access token issued to the client authenticated by the API key.
+func NewClientClaims(client *APIKey, expiresAfterMinutes time.Duration) *AppClaims {
+	return &AppClaims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(expiresAfterMinutes).UTC().Unix(),
+			NotBefore: time.Now().UTC().Unix(),
+			Subject:   fmt.Sprint(client.ID),
+			Id:        uuid.NewString(),
+			IssuedAt:  time.Now().UTC().Unix(),
+			Issuer:    TokenIssuer,
+			Audience:  TokenAudience,
+		},
+		TokenUse: AccessTokenUse,
+		ClientID: fmt.Sprint(client.ID),
+	}
+}
+
+// Token is a struct that contains the tokens and the expiration time
+// Tokens issued to clients have no refresh token.
 type Token struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	Expiry      int64  `json:"expires_in"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	Expiry       int64  `json:"expires_in"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// RefreshToken is the server side record of an issued refresh token.
+// A refresh token can be rotated only once, any further use is rejected.
+type RefreshToken struct {
+	// ID is the jti of the refresh token.
+	ID        string
+	UserID    int64
+	ExpiresAt time.Time
+	RotatedAt *time.Time
 }
@@ -1,8 +1,101 @@
 package entity
 
+import (
+	"mysql/app/apperr"
+	"net/mail"
+)
+
 type User struct {
-	ID       int64
-	Username string
-	Name     string
-	Password string
-}
\ No newline at end of file
+	ID           int64  `json:"id"`
+	Username     string `json:"username"`
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	PasswordHash string `json:"-"`
+	Roles        []Role `json:"roles"`
+
+	// EmailVerified reports whether the user has proven to own the email, only the
+	// users provisioned from an identity with an email verified by the provider have.
+	EmailVerified bool `json:"email_verified"`
+}
+
+func (u User) Validate() error {
+	if u.Username == "" || len(u.Username) > 255 {
+		return apperr.Errorf(apperr.EINVALID, "Username invalido")
+	}
+
+	if u.Name == "" || len(u.Name) > 255 {
+		return apperr.Errorf(apperr.EINVALID, "Nome invalido")
+	}
+
+	if err := ValidateEmail(u.Email); err != nil {
+		return err
+	}
+
+	if u.PasswordHash == "" {
+		return apperr.Errorf(apperr.EINVALID, "Password invalida")
+	}
+
+	for _, r := range u.Roles {
+		if !r.Valid() {
+			return apperr.Errorf(apperr.EINVALID, "Ruolo %q invalido", r)
+		}
+	}
+
+	return nil
+}
+
+// ValidateEmail validates the email of a user.
+// The email is optional, but without one the password can't be reset.
+func ValidateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+
+	if a, err := mail.ParseAddress(email); err != nil || a.Address != email || len(email) > 255 {
+		return apperr.Errorf(apperr.EINVALID, "Email invalida")
+	}
+
+	return nil
+}
+
+// HasPermission returns true if any of the user roles grants the permission.
+func (u *User) HasPermission(permission Permission) bool {
+	return HasPermission(u.Roles, permission)
+}
+
+// Privileged returns true if the user can manage the users or the API keys,
+// the permissions that give control over the other accounts.
+func (u *User) Privileged() bool {
+	return u.HasPermission(PermissionUsersManage) || u.HasPermission(PermissionAPIKeysManage)
+}
+
+// Profile returns the public projection of the user.
+func (u *User) Profile() *UserProfile {
+	return &UserProfile{
+		ID:       u.ID,
+		Username: u.Username,
+		Name:     u.Name,
+		Roles:    u.Roles,
+	}
+}
+
+type Users []*User
+
+// UserProfile is the public projection of a User, it is what the tokens carry
+// and it never contains credentials.
+type UserProfile struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Roles    []Role `json:"roles"`
+}
+
+// User returns a User with the fields of the profile.
+func (p *UserProfile) User() *User {
+	return &User{
+		ID:       p.ID,
+		Username: p.Username,
+		Name:     p.Name,
+		Roles:    p.Roles,
+	}
+}
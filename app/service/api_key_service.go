@@ -0,0 +1,36 @@
+package service
+
+import (
+	"context"
+	"mysql/app/entity"
+)
+
+// APIKeyService represents a service for managing the API keys of the clients.
+type APIKeyService interface {
+	// CreateAPIKey generates a new key, stores its hash and returns the key.
+	// The key can't be retrieved afterwards.
+	CreateAPIKey(ctx context.Context, key *entity.APIKey) (string, error)
+
+	// RevokeAPIKey revokes a key, it can't be used anymore.
+	// Returns ENOTFOUND if the key does not exist.
+	RevokeAPIKey(ctx context.Context, id int64) error
+
+	// FindAPIKeyByID returns the key with the given id.
+	// Returns ENOTFOUND if the key does not exist.
+	FindAPIKeyByID(ctx context.Context, id int64) (*entity.APIKey, error)
+
+	// FindAPIKeys returns the keys matching the filter.
+	FindAPIKeys(ctx context.Context, filter APIKeyFilter) (entity.APIKeys, error)
+
+	// AuthenticateAPIKey returns the key matching the given one and records its use.
+	// Returns EUNAUTHORIZED if the key is unknown or revoked.
+	AuthenticateAPIKey(ctx context.Context, key string) (*entity.APIKey, error)
+}
+
+type APIKeyFilter struct {
+	ID      *int64
+	KeyHash *string
+
+	Offset int
+	Limit  int
+}
@@ -11,19 +11,78 @@ import (
 // It is used to generate and validate JWT tokens.
 type JWTService interface {
 	// Exchange a auth entity for a JWT token pair.
-	Exchange(ctx context.Context, auth *entity.User) (*entity.Token, error)
+	// The tokens are limited to the requested scope, among the permissions granted
+	// by the roles of the user, or carry all of them if scope is nil.
+	// Returns EFORBIDDEN if none of the requested permissions is granted.
+	Exchange(ctx context.Context, auth *entity.User, scope []entity.Permission) (*entity.Token, error)
+
+	// ExchangeClient issues an access token to the client authenticated with
+	// the API key, acting on its own behalf. No refresh token is issued.
+	// The scope is reduced among the scopes of the key as in Exchange.
+	ExchangeClient(ctx context.Context, client *entity.APIKey, scope []entity.Permission) (*entity.Token, error)
+
+	// Impersonate issues a short-lived access token for the user on behalf of the admin,
+	// who is identified by the act claim. No refresh token is issued.
+	Impersonate(ctx context.Context, admin *entity.User, user *entity.User) (*entity.Token, error)
+
+	// Refresh rotates a refresh token, returning a new JWT token pair.
+	// The new pair keeps the scope of the refresh token.
+	// Returns EUNAUTHORIZED if the refresh token is invalid or has already been used.
+	Refresh(ctx context.Context, refreshToken string) (*entity.Token, error)
 
 	// Parse a JWT token and return the associated claims.
 	Parse(ctx context.Context, token string) (*entity.AppClaims, error)
+
+	// IssueMFAChallenge returns a short-lived token proving that the user has
+	// passed the first factor, to be exchanged along with the second one.
+	// The token carries the scope requested at login, see Exchange.
+	IssueMFAChallenge(ctx context.Context, auth *entity.User, scope []entity.Permission) (string, error)
+
+	// ParseMFAChallenge validates a token returned by IssueMFAChallenge and
+	// returns the associated claims.
+	ParseMFAChallenge(ctx context.Context, token string) (*entity.AppClaims, error)
+
+	// RevocationTTL returns how long a token expiring at expiresAt must be blacklisted:
+	// until it would be rejected anyway, which is after the leeway tolerated on exp.
+	RevocationTTL(expiresAt time.Time) time.Duration
 }
 
 // JWTBlacklistService is an interface for JWT blacklist service.
+// Tokens are identified by their jti claim, the sid claim of a blacklisted
+// session revokes all of its tokens.
 type JWTBlacklistService interface {
 
-	// Invalidate a JWT token.
+	// Invalidate a JWT token until expiration has elapsed, when the token
+	// would be rejected anyway.
 	// Returns EUNAUTHORIZED if the user is not allowed to invalidate the token.
-	Invalidate(ctx context.Context, token string, expiration time.Duration) error
+	Invalidate(ctx context.Context, id string, expiration time.Duration) error
 
 	// IsBlacklisted checks if a token is blacklisted.
-	IsBlacklisted(ctx context.Context, token string) (bool, error)
-}
\ No newline at end of file
+	IsBlacklisted(ctx context.Context, id string) (bool, error)
+}
+
+// RefreshTokenService is an interface for the storage of issued refresh tokens.
+type RefreshTokenService interface {
+
+	// CreateRefreshToken records a newly issued refresh token.
+	CreateRefreshToken(ctx context.Context, token *entity.RefreshToken) error
+
+	// RotateRefreshToken marks a refresh token as used and returns it.
+	// Returns EUNAUTHORIZED if the token is unknown, expired or already rotated.
+	RotateRefreshToken(ctx context.Context, id string) (*entity.RefreshToken, error)
+
+	// RevokeRefreshTokens marks all the refresh tokens of the user as used,
+	// so that none of them can be refreshed anymore.
+	RevokeRefreshTokens(ctx context.Context, userID int64) error
+}
+
+// OpaqueTokenService is an interface for the storage of the claims of opaque tokens.
+type OpaqueTokenService interface {
+
+	// CreateOpaqueToken records a newly issued opaque token.
+	CreateOpaqueToken(ctx context.Context, token *entity.OpaqueToken) error
+
+	// FindOpaqueToken returns the opaque token with the given hash.
+	// Returns ENOTFOUND if the token is unknown or expired.
+	FindOpaqueToken(ctx context.Context, tokenHash string) (*entity.OpaqueToken, error)
+}
@@ -0,0 +1,21 @@
+package service
+
+import "context"
+
+// LoginThrottleService is an interface for the protection of the login from brute-force attacks.
+// Failed logins are tracked per username and per client IP.
+type LoginThrottleService interface {
+	// Check returns ELOCKED if the username is temporarily locked out, or
+	// ETOOMANYREQUESTS if the client IP must wait before trying again.
+	Check(ctx context.Context, username string, ip string) error
+
+	// RecordFailure records a failed login.
+	RecordFailure(ctx context.Context, username string, ip string) error
+
+	// RecordSuccess clears the failed logins of the username.
+	// The failed logins of the client IP are kept, they only expire.
+	RecordSuccess(ctx context.Context, username string, ip string) error
+
+	// Unlock clears the failed logins of the username, lifting its lockout.
+	Unlock(ctx context.Context, username string) error
+}
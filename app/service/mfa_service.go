@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"mysql/app/entity"
+)
+
+// TOTPService is an interface for time-based one-time passwords, the codes
+// generated by authenticator apps.
+type TOTPService interface {
+	// GenerateSecret returns a new random secret, base32 encoded.
+	GenerateSecret(ctx context.Context) (string, error)
+
+	// ProvisioningURI returns the otpauth:// URI that enrolls the secret in an
+	// authenticator app, usually shown as a QR code.
+	ProvisioningURI(ctx context.Context, account string, secret string) string
+
+	// Validate reports whether the code is valid for the secret now.
+	// counter is the time step the code belongs to, it allows callers to reject
+	// a code that has already been used.
+	Validate(ctx context.Context, secret string, code string) (counter int64, ok bool, err error)
+}
+
+// MFAService represents a service for managing the second factors of the users.
+type MFAService interface {
+	// CreateTOTP stores a new unconfirmed TOTP secret for the user, replacing
+	// the previous unconfirmed one.
+	// Returns EEXISTS if the user has already confirmed a secret.
+	CreateTOTP(ctx context.Context, totp *entity.TOTP) error
+
+	// FindTOTPByUserID returns the TOTP secret of the user.
+	// Returns ENOTFOUND if the user has no secret.
+	FindTOTPByUserID(ctx context.Context, userID int64) (*entity.TOTP, error)
+
+	// ConfirmTOTP enables the TOTP secret of the user, once it has proven
+	// to have enrolled it.
+	ConfirmTOTP(ctx context.Context, userID int64) error
+
+	// UseTOTPCounter records the time step of a code accepted for the user.
+	// Returns EUNAUTHORIZED if a code of the same or a later step has already
+	// been accepted, so that a code can't be used twice.
+	UseTOTPCounter(ctx context.Context, userID int64, counter int64) error
+
+	// DeleteTOTP removes the TOTP secret and the recovery codes of the user.
+	DeleteTOTP(ctx context.Context, userID int64) error
+
+	// ReplaceRecoveryCodes creates new recovery codes for the user, invalidating
+	// the previous ones, and returns them.
+	ReplaceRecoveryCodes(ctx context.Context, userID int64) ([]string, error)
+
+	// ConsumeRecoveryCode marks the recovery code of the user as used.
+	// Returns EUNAUTHORIZED if the code is unknown or already used.
+	ConsumeRecoveryCode(ctx context.Context, userID int64, code string) error
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"mysql/app/entity"
+)
+
+// OIDCProvider is an interface for an OpenID Connect identity provider,
+// used with the authorization code flow.
+type OIDCProvider interface {
+	// AuthCodeURL returns the URL of the identity provider the user is redirected to for the login.
+	AuthCodeURL(ctx context.Context, login *entity.OIDCLogin) (string, error)
+
+	// ExchangeCode redeems the authorization code returned to the callback of the login and
+	// returns the identity described by the verified ID token.
+	// Returns EUNAUTHORIZED if the code or the ID token are not valid.
+	ExchangeCode(ctx context.Context, login *entity.OIDCLogin, code string) (*entity.Identity, error)
+}
+
+// OIDCLoginService represents a service for managing the pending logins at the identity provider.
+type OIDCLoginService interface {
+	// CreateOIDCLogin records a login sent to the identity provider.
+	CreateOIDCLogin(ctx context.Context, login *entity.OIDCLogin) error
+
+	// ConsumeOIDCLogin removes the login with the given state and returns it.
+	// Returns EUNAUTHORIZED if the login is unknown or expired.
+	ConsumeOIDCLogin(ctx context.Context, state string) (*entity.OIDCLogin, error)
+}
+
+// IdentityService represents a service for managing the identities linked to the users.
+type IdentityService interface {
+	// FindIdentity returns the identity of the issuer with the given subject.
+	// Returns ENOTFOUND if the identity is not linked to any user.
+	FindIdentity(ctx context.Context, issuer string, subject string) (*entity.Identity, error)
+
+	// CreateIdentity links the identity to its user.
+	// Returns EEXISTS if the identity is already linked.
+	CreateIdentity(ctx context.Context, identity *entity.Identity) error
+}
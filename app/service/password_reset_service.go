@@ -0,0 +1,29 @@
+package service
+
+import (
+	"context"
+	"mysql/app/entity"
+	"time"
+)
+
+// PasswordResetService represents a service for managing password reset tokens.
+type PasswordResetService interface {
+	// CreatePasswordReset creates a token allowing the user to reset its password
+	// within expiration.
+	CreatePasswordReset(ctx context.Context, userID int64, expiration time.Duration) (string, error)
+
+	// FindPasswordReset returns the pending password reset with the given token, without consuming it.
+	// Returns EUNAUTHORIZED if the token is unknown, expired or already used.
+	FindPasswordReset(ctx context.Context, token string) (*entity.PasswordReset, error)
+
+	// ConsumePasswordReset marks the token as used, together with every other
+	// pending token of the same user, and returns it.
+	// Returns EUNAUTHORIZED if the token is unknown, expired or already used.
+	ConsumePasswordReset(ctx context.Context, token string) (*entity.PasswordReset, error)
+}
+
+// Mailer is an interface for sending emails.
+type Mailer interface {
+	// Send sends the message.
+	Send(ctx context.Context, mail *entity.Mail) error
+}
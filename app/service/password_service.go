@@ -0,0 +1,27 @@
+package service
+
+import (
+	"context"
+	"mysql/app/entity"
+)
+
+// PasswordService is an interface for password hashing service.
+// It is used to hash passwords before they are stored and to verify them at login.
+type PasswordService interface {
+	// Hash returns the encoded hash of a password.
+	// The encoding carries the algorithm, its version and its parameters.
+	Hash(ctx context.Context, password string) (string, error)
+
+	// Compare reports whether the password matches the encoded hash.
+	// rehash is true when the hash was created with an algorithm or parameters
+	// different from the current ones and should be replaced.
+	Compare(ctx context.Context, password string, hash string) (match bool, rehash bool, err error)
+}
+
+// PasswordPolicyService checks that the passwords chosen by the users are strong enough.
+type PasswordPolicyService interface {
+	// Validate returns the rules of the policy that the password of the user does not satisfy,
+	// none if the password can be used. The user is used to ban passwords containing its
+	// username, email or name, its ID may not be set yet.
+	Validate(ctx context.Context, password string, user *entity.User) ([]entity.PasswordViolation, error)
+}
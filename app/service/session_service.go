@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"mysql/app/entity"
+	"time"
+)
+
+// SessionService represents a service for managing the sessions of the users.
+type SessionService interface {
+	// CreateSession records a new session.
+	CreateSession(ctx context.Context, session *entity.Session) error
+
+	// RefreshSession records the tokens issued by a refresh of the session.
+	// Returns EUNAUTHORIZED if the session does not exist or has been revoked.
+	RefreshSession(ctx context.Context, id string, tokenID string, expiresAt time.Time) error
+
+	// FindSessionByID returns the session with the given id.
+	// Returns ENOTFOUND if the session does not exist.
+	FindSessionByID(ctx context.Context, id string) (*entity.Session, error)
+
+	// FindSessions returns the sessions matching the filter.
+	FindSessions(ctx context.Context, filter SessionFilter) (entity.Sessions, error)
+
+	// RevokeSession marks the session as revoked.
+	// The tokens of the session must be blacklisted by the caller.
+	RevokeSession(ctx context.Context, id string) error
+}
+
+type SessionFilter struct {
+	ID     *string
+	UserID *int64
+
+	// Active restricts the result to the sessions not revoked nor expired.
+	Active bool
+
+	Offset int
+	Limit  int
+}
@@ -0,0 +1,16 @@
+package service
+
+import (
+	"context"
+)
+
+// SettingService represents a service for managing the settings changed at runtime,
+// which are shared by all the nodes and survive restarts.
+type SettingService interface {
+	// FindSetting returns the value of the setting with the given name.
+	// Returns ENOTFOUND if the setting has never been set.
+	FindSetting(ctx context.Context, name string) (string, error)
+
+	// SetSetting stores the value of the setting with the given name.
+	SetSetting(ctx context.Context, name string, value string) error
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"mysql/app/entity"
+)
+
+// UserService represents a service for managing users.
+type UserService interface {
+	// CreateUser creates a new user.
+	CreateUser(ctx context.Context, user *entity.User) error
+
+	// DeleteUser permanently deletes a user.
+	// Returns ENOTFOUND if the user does not exist.
+	DeleteUser(ctx context.Context, id int64) error
+
+	// UpdateUser updates the fields of a user that are set in upd.
+	// Returns ENOTFOUND if the user does not exist.
+	UpdateUser(ctx context.Context, id int64, upd UserUpdate) error
+
+	// FindUserByID returns the user with the given id.
+	// Returns ENOTFOUND if the user does not exist.
+	FindUserByID(ctx context.Context, id int64) (*entity.User, error)
+
+	// FindUserByUsername returns the user with the given username.
+	// Returns ENOTFOUND if the user does not exist.
+	FindUserByUsername(ctx context.Context, username string) (*entity.User, error)
+
+	// FindUsers returns the users matching the filter.
+	FindUsers(ctx context.Context, filter UserFilter) (entity.Users, error)
+}
+
+type UserUpdate struct {
+	Username     *string
+	Name         *string
+	Email        *string
+	PasswordHash *string
+	// EmailVerified marks the email as verified or not, changing the email
+	// without setting it marks the new email as not verified.
+	EmailVerified *bool
+	// Roles replaces the user roles, nil leaves them unchanged.
+	Roles []entity.Role
+}
+
+type UserFilter struct {
+	ID       *int64
+	Username *string
+	Email    *string
+	// EmailVerified restricts the users to the ones who have verified their email.
+	EmailVerified bool
+
+	Offset int
+	Limit  int
+}
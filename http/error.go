@@ -13,14 +13,22 @@ const (
 
 // codes represents an HTTP status code.
 var codes = map[string]int{
-	apperr.ECONFLICT:       http.StatusConflict,
-	apperr.EFORBIDDEN:      http.StatusForbidden,
-	apperr.EINVALID:        http.StatusBadRequest,
-	apperr.ENOTFOUND:       http.StatusNotFound,
-	apperr.ENOTIMPLEMENTED: http.StatusNotImplemented,
-	apperr.EUNAUTHORIZED:   http.StatusUnauthorized,
-	apperr.EINTERNAL:       http.StatusInternalServerError,
-	apperr.EUNKNOWN:        http.StatusInternalServerError,
+	apperr.ECONFLICT:        http.StatusConflict,
+	apperr.EEXISTS:          http.StatusConflict,
+	apperr.EFORBIDDEN:       http.StatusForbidden,
+	apperr.EINVALID:         http.StatusBadRequest,
+	apperr.ENOTFOUND:        http.StatusNotFound,
+	apperr.ENOTIMPLEMENTED:  http.StatusNotImplemented,
+	apperr.EUNAUTHORIZED:    http.StatusUnauthorized,
+	apperr.ELOCKED:          http.StatusLocked,
+	apperr.ETOOMANYREQUESTS: http.StatusTooManyRequests,
+	apperr.EINTERNAL:        http.StatusInternalServerError,
+	apperr.EUNKNOWN:         http.StatusInternalServerError,
+
+	apperr.ETOKENEXPIRED:     http.StatusUnauthorized,
+	apperr.ETOKENNOTYETVALID: http.StatusUnauthorized,
+	apperr.ETOKENSIGNATURE:   http.StatusUnauthorized,
+	apperr.ETOKENMALFORMED:   http.StatusUnauthorized,
 }
 
 // MessageFromErr returns the message for the given app error.
@@ -69,4 +77,4 @@ func NewErrorAPI(err error, details interface{}) *ErrorAPI {
 // ErrorResponseJSON returns an HTTP error response with JSON content.
 func ErrorResponseJSON(c echo.Context, err error, details interface{}) error {
 	return c.JSON(StatusCodeFromErr(err), NewErrorAPI(err, details))
-}
\ No newline at end of file
+}
@@ -1,16 +1,23 @@
 package http
 
 import (
+	"context"
+	"fmt"
 	"mysql/app/apperr"
 	"mysql/app/entity"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
 )
 
 const (
 	claimsContextParam = "claims"
+	apiKeyContextParam = "api_key"
 )
 
+// APIKeyHeader is the header carrying the API key of a client, alternative to a bearer JWT.
+const APIKeyHeader = "X-API-Key"
+
 // RecoverPanicMiddleware is the middleware for handling panics.
 func (s *ServerAPI) RecoverPanicMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -26,12 +33,272 @@ func (s *ServerAPI) RecoverPanicMiddleware(next echo.HandlerFunc) echo.HandlerFu
 	}
 }
 
-func AuthUser(c echo.Context) (*entity.User, error) {
+// ClientMiddleware stores the user agent and the IP of the client in the context of the request,
+// where they are picked up to record the sessions.
+func (s *ServerAPI) ClientMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		ctx := entity.NewContextWithClient(c.Request().Context(), &entity.Client{
+			UserAgent: c.Request().UserAgent(),
+			IP:        c.RealIP(),
+		})
+		c.SetRequest(c.Request().WithContext(ctx))
+
+		return next(c)
+	}
+}
+
+// AuthMiddleware authenticates the request with the bearer JWT and stores its claims in the context.
+// Clients can authenticate with an API key in the X-API-Key header instead, or with a token
+// obtained from it at /oauth/token, the key is then stored in the context.
+// Requests without a token are let through only for the routes listed in ServerAPI.PublicRoutes,
+// a token is always validated when present.
+func (s *ServerAPI) AuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		if key := c.Request().Header.Get(APIKeyHeader); key != "" {
+			apiKey, err := s.APIKeyService.AuthenticateAPIKey(c.Request().Context(), key)
+			if err != nil {
+				return ErrorResponseJSON(c, err, nil)
+			}
+
+			c.Set(apiKeyContextParam, apiKey)
+
+			return next(c)
+		}
+
+		token := ExtractJWT(c.Request())
+		if token == "" {
+			if s.PublicRoutes[routeKey(c.Request().Method, c.Path())] {
+				return next(c)
+			}
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EUNAUTHORIZED, "token mancante"), nil)
+		}
+
+		claims, err := s.JWTService.Parse(c.Request().Context(), token)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		c.Set(claimsContextParam, claims)
+
+		// every request made on behalf of a user is logged, whatever its outcome.
+		if claims.Actor != nil {
+			c.Logger().Printf("impersonation: user %s (%s) acting as user %s: %s %s",
+				claims.Actor.Subject, claims.Actor.Username, claims.Subject, c.Request().Method, c.Request().URL.Path)
+		}
+
+		// a token issued to a client acts as its API key, which is loaded again
+		// so that revoking the key also revokes its tokens.
+		if claims.ClientID != "" {
+			apiKey, err := s.clientAPIKey(c.Request().Context(), claims.ClientID)
+			if err != nil {
+				return ErrorResponseJSON(c, err, nil)
+			}
+
+			c.Set(apiKeyContextParam, apiKey)
+		}
+
+		return next(c)
+	}
+}
+
+// ClientAuthMiddleware allows only requests of authenticated clients, with an API key in the
+// X-API-Key header or as OAuth2 client credentials, and stores the key in the context.
+func (s *ServerAPI) ClientAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		var apiKey *entity.APIKey
+		var err error
+
+		if key := c.Request().Header.Get(APIKeyHeader); key != "" {
+			apiKey, err = s.APIKeyService.AuthenticateAPIKey(c.Request().Context(), key)
+		} else {
+			apiKey, err = s.oauthClient(c)
+		}
+
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		} else if apiKey == nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EUNAUTHORIZED, "autenticazione del client mancante"), nil)
+		}
+
+		c.Set(apiKeyContextParam, apiKey)
+
+		return next(c)
+	}
+}
+
+// RequirePermission returns a middleware allowing the request only if the roles of the
+// authenticated user, or the scopes of the API key, grant the permissions and if the
+// scope of the token includes them. The missing scopes are listed in the details of
+// the EFORBIDDEN response.
+// It must follow AuthMiddleware. Anonymous requests to public routes are let through.
+func (s *ServerAPI) RequirePermission(permissions ...entity.Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+
+			claims, _ := AuthClaims(c)
+
+			if apiKey, err := AuthAPIKey(c); err == nil {
+				for _, permission := range permissions {
+					if !apiKey.HasScope(permission) {
+						return ErrorResponseJSON(c, apperr.Errorf(apperr.EFORBIDDEN, "permesso %s mancante", permission), nil)
+					}
+				}
+				return requireScope(c, next, claims, permissions)
+			}
+
+			user, err := AuthUser(c)
+			if err != nil {
+				if s.PublicRoutes[routeKey(c.Request().Method, c.Path())] {
+					return next(c)
+				}
+				return ErrorResponseJSON(c, err, nil)
+			}
+
+			for _, permission := range permissions {
+				if !user.HasPermission(permission) {
+					return ErrorResponseJSON(c, apperr.Errorf(apperr.EFORBIDDEN, "permesso %s mancante", permission), nil)
+				}
+			}
+
+			return requireScope(c, next, claims, permissions)
+		}
+	}
+}
+
+// requireScope calls next only if the scope of the token includes all the permissions,
+// otherwise it responds with EFORBIDDEN and the insufficient_scope error of RFC 6750.
+// Requests authenticated with an API key have no token and tokens issued before scopes
+// were introduced have none, they are limited only by the API key or by the roles.
+// Only the routes behind RequirePermission check the scope: the account routes require
+// entity.PermissionAccountManage so that a reduced token cannot manage the account.
+func requireScope(c echo.Context, next echo.HandlerFunc, claims *entity.AppClaims, permissions []entity.Permission) error {
+
+	if claims == nil || claims.Scope == "" {
+		return next(c)
+	}
+
+	var missing []entity.Permission
+	for _, permission := range permissions {
+		if !claims.HasScope(permission) {
+			missing = append(missing, permission)
+		}
+	}
+
+	if len(missing) == 0 {
+		return next(c)
+	}
+
+	scope := entity.FormatScope(missing)
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+
+	return ErrorResponseJSON(c, apperr.Errorf(apperr.EFORBIDDEN, "scope mancante: %s", scope), echo.Map{
+		"missing_scope": missing,
+	})
+}
+
+// grantsPermission returns true if the authenticated caller holds the permission: its API key
+// or its roles grant it, and the scope of its token, if any, includes it.
+func grantsPermission(c echo.Context, permission entity.Permission) bool {
+
+	if claims, err := AuthClaims(c); err == nil && claims.Scope != "" && !claims.HasScope(permission) {
+		return false
+	}
+
+	if apiKey, err := AuthAPIKey(c); err == nil {
+		return apiKey.HasScope(permission)
+	}
+
+	user, err := AuthUser(c)
+	return err == nil && user.HasPermission(permission)
+}
+
+// DenyImpersonation is the middleware rejecting the requests authenticated with an impersonation
+// token, for the routes that change the credentials or the sessions of the user and the
+// ones managing the API keys and the users, impersonation included.
+// It must follow AuthMiddleware.
+func (s *ServerAPI) DenyImpersonation(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		if actor, err := AuthActor(c); err == nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EFORBIDDEN, "operazione non consentita durante l'impersonificazione da parte di %s", actor.Username), nil)
+		}
+
+		return next(c)
+	}
+}
+
+// AuthClaims returns the claims of the authenticated request.
+func AuthClaims(c echo.Context) (*entity.AppClaims, error) {
 
 	if claims, ok := c.Get(claimsContextParam).(*entity.AppClaims); ok {
-		return claims.User, nil
+		return claims, nil
+	}
+
+	return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "no auth claims found in context")
+}
+
+// AuthUser returns the authenticated user, built from the profile carried by the token.
+func AuthUser(c echo.Context) (*entity.User, error) {
+
+	if claims, ok := c.Get(claimsContextParam).(*entity.AppClaims); ok && claims.User != nil {
+		return claims.User.User(), nil
 	}
 
 	// this should never happen
 	return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "no auth user found in context")
-}
\ No newline at end of file
+}
+
+// AuthActor returns the admin acting as the authenticated user, if the request has been
+// authenticated with an impersonation token.
+func AuthActor(c echo.Context) (*entity.Actor, error) {
+
+	if claims, ok := c.Get(claimsContextParam).(*entity.AppClaims); ok && claims.Actor != nil {
+		return claims.Actor, nil
+	}
+
+	return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "no actor found in context")
+}
+
+// IsImpersonated returns true if the request has been authenticated with an impersonation token.
+func IsImpersonated(c echo.Context) bool {
+	_, err := AuthActor(c)
+	return err == nil
+}
+
+// AuthAPIKey returns the API key the request has been authenticated with.
+func AuthAPIKey(c echo.Context) (*entity.APIKey, error) {
+
+	if apiKey, ok := c.Get(apiKeyContextParam).(*entity.APIKey); ok {
+		return apiKey, nil
+	}
+
+	return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "no api key found in context")
+}
+
+// clientAPIKey returns the API key of the client with the given id, as carried by the client_id claim.
+// Returns EUNAUTHORIZED if the key no longer exists or has been revoked.
+func (s *ServerAPI) clientAPIKey(ctx context.Context, clientID string) (*entity.APIKey, error) {
+
+	id, err := strconv.ParseInt(clientID, 10, 64)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "client non valido")
+	}
+
+	apiKey, err := s.APIKeyService.FindAPIKeyByID(ctx, id)
+	if apperr.ErrorCode(err) == apperr.ENOTFOUND || (err == nil && apiKey.Revoked()) {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "client non valido")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return apiKey, nil
+}
+
+// routeKey returns the key identifying a route in ServerAPI.PublicRoutes.
+func routeKey(method string, path string) string {
+	return method + " " + path
+}
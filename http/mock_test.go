@@ -0,0 +1,486 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The services below keep their data in memory, so that the handlers can be tested without a database.
+
+// apiKeyService is an APIKeyService storing the keys in memory, the secret of a key is its name.
+type apiKeyService struct {
+	mu   sync.Mutex
+	keys []*entity.APIKey
+}
+
+func (s *apiKeyService) CreateAPIKey(ctx context.Context, key *entity.APIKey) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key.ID = int64(len(s.keys) + 1)
+	s.keys = append(s.keys, key)
+	return key.Name, nil
+}
+
+func (s *apiKeyService) RevokeAPIKey(ctx context.Context, id int64) error {
+	key, err := s.FindAPIKeyByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key.RevokedAt == nil {
+		now := time.Now()
+		key.RevokedAt = &now
+	}
+	return nil
+}
+
+func (s *apiKeyService) FindAPIKeyByID(ctx context.Context, id int64) (*entity.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.keys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return nil, apperr.Errorf(apperr.ENOTFOUND, "not found")
+}
+
+func (s *apiKeyService) FindAPIKeys(ctx context.Context, filter service.APIKeyFilter) (entity.APIKeys, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.keys, nil
+}
+
+func (s *apiKeyService) AuthenticateAPIKey(ctx context.Context, key string) (*entity.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.keys {
+		if k.Name == key && !k.Revoked() {
+			return k, nil
+		}
+	}
+	return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unknown key")
+}
+
+// userService is a UserService storing the users in memory, the usernames are unique.
+type userService struct {
+	mu    sync.Mutex
+	users []*entity.User
+}
+
+func (s *userService) CreateUser(ctx context.Context, user *entity.User) error {
+	if err := user.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Username == user.Username {
+			return apperr.Errorf(apperr.EEXISTS, "username già in uso")
+		}
+	}
+
+	user.ID = int64(len(s.users) + 1)
+	s.users = append(s.users, user)
+	return nil
+}
+
+func (s *userService) DeleteUser(ctx context.Context, id int64) error {
+	return apperr.Errorf(apperr.ENOTIMPLEMENTED, "not implemented")
+}
+
+func (s *userService) UpdateUser(ctx context.Context, id int64, upd service.UserUpdate) error {
+	user, err := s.FindUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if upd.PasswordHash != nil {
+		user.PasswordHash = *upd.PasswordHash
+	}
+	if upd.Email != nil {
+		user.Email = *upd.Email
+		user.EmailVerified = false
+	}
+	if upd.EmailVerified != nil {
+		user.EmailVerified = *upd.EmailVerified
+	}
+	if upd.Roles != nil {
+		user.Roles = upd.Roles
+	}
+	return nil
+}
+
+func (s *userService) FindUserByID(ctx context.Context, id int64) (*entity.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return nil, apperr.Errorf(apperr.ENOTFOUND, "user not found")
+}
+
+func (s *userService) FindUserByUsername(ctx context.Context, username string) (*entity.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return nil, apperr.Errorf(apperr.ENOTFOUND, "user not found")
+}
+
+func (s *userService) FindUsers(ctx context.Context, filter service.UserFilter) (entity.Users, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users entity.Users
+	for _, user := range s.users {
+		if filter.Email != nil && user.Email != *filter.Email {
+			continue
+		} else if filter.EmailVerified && !user.EmailVerified {
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// sessionService is a SessionService storing the sessions in memory.
+type sessionService struct {
+	mu       sync.Mutex
+	sessions []*entity.Session
+	revoked  map[string]bool
+}
+
+func (s *sessionService) CreateSession(ctx context.Context, session *entity.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions = append(s.sessions, session)
+	return nil
+}
+
+func (s *sessionService) RefreshSession(ctx context.Context, id string, tokenID string, expiresAt time.Time) error {
+	return nil
+}
+
+func (s *sessionService) FindSessionByID(ctx context.Context, id string) (*entity.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, session := range s.sessions {
+		if session.ID == id {
+			return session, nil
+		}
+	}
+	return nil, apperr.Errorf(apperr.ENOTFOUND, "session not found")
+}
+
+func (s *sessionService) FindSessions(ctx context.Context, filter service.SessionFilter) (entity.Sessions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sessions entity.Sessions
+	for _, session := range s.sessions {
+		if filter.UserID != nil && session.UserID != *filter.UserID {
+			continue
+		} else if filter.Active && s.revoked[session.ID] {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (s *sessionService) RevokeSession(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.revoked == nil {
+		s.revoked = make(map[string]bool)
+	}
+	s.revoked[id] = true
+	return nil
+}
+
+// refreshTokenService is a RefreshTokenService storing the refresh tokens in memory,
+// it records the users whose refresh tokens have been revoked.
+type refreshTokenService struct {
+	mu      sync.Mutex
+	tokens  map[string]*entity.RefreshToken
+	revoked []int64
+}
+
+func (s *refreshTokenService) CreateRefreshToken(ctx context.Context, token *entity.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tokens == nil {
+		s.tokens = make(map[string]*entity.RefreshToken)
+	}
+	s.tokens[token.ID] = token
+	return nil
+}
+
+func (s *refreshTokenService) RotateRefreshToken(ctx context.Context, id string) (*entity.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unknown refresh token")
+	} else if token.RotatedAt != nil {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "refresh token already used")
+	}
+
+	now := time.Now()
+	token.RotatedAt = &now
+	return token, nil
+}
+
+func (s *refreshTokenService) RevokeRefreshTokens(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, token := range s.tokens {
+		if token.UserID == userID && token.RotatedAt == nil {
+			token.RotatedAt = &now
+		}
+	}
+	s.revoked = append(s.revoked, userID)
+	return nil
+}
+
+// passwordResetService is a PasswordResetService whose tokens are the ids of the users.
+type passwordResetService struct{}
+
+func (s *passwordResetService) CreatePasswordReset(ctx context.Context, userID int64, expiration time.Duration) (string, error) {
+	return fmt.Sprint(userID), nil
+}
+
+func (s *passwordResetService) FindPasswordReset(ctx context.Context, token string) (*entity.PasswordReset, error) {
+	id, err := strconv.ParseInt(token, 10, 64)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unknown token")
+	}
+	return &entity.PasswordReset{UserID: id}, nil
+}
+
+func (s *passwordResetService) ConsumePasswordReset(ctx context.Context, token string) (*entity.PasswordReset, error) {
+	return s.FindPasswordReset(ctx, token)
+}
+
+// mailer is a Mailer sending the mails to a channel.
+type mailer chan *entity.Mail
+
+func (m mailer) Send(ctx context.Context, mail *entity.Mail) error {
+	m <- mail
+	return nil
+}
+
+// mfaService is a MFAService storing the TOTP secrets in memory.
+type mfaService struct {
+	mu    sync.Mutex
+	totps map[int64]*entity.TOTP
+}
+
+func (s *mfaService) CreateTOTP(ctx context.Context, totp *entity.TOTP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.totps == nil {
+		s.totps = make(map[int64]*entity.TOTP)
+	}
+	s.totps[totp.UserID] = totp
+	return nil
+}
+
+func (s *mfaService) FindTOTPByUserID(ctx context.Context, userID int64) (*entity.TOTP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if totp, ok := s.totps[userID]; ok {
+		return totp, nil
+	}
+	return nil, apperr.Errorf(apperr.ENOTFOUND, "totp not found")
+}
+
+func (s *mfaService) ConfirmTOTP(ctx context.Context, userID int64) error {
+	totp, err := s.FindTOTPByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	totp.ConfirmedAt = &now
+	return nil
+}
+
+func (s *mfaService) UseTOTPCounter(ctx context.Context, userID int64, counter int64) error {
+	return nil
+}
+
+func (s *mfaService) DeleteTOTP(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.totps, userID)
+	return nil
+}
+
+func (s *mfaService) ReplaceRecoveryCodes(ctx context.Context, userID int64) ([]string, error) {
+	return nil, nil
+}
+
+func (s *mfaService) ConsumeRecoveryCode(ctx context.Context, userID int64, code string) error {
+	return apperr.Errorf(apperr.EUNAUTHORIZED, "unknown recovery code")
+}
+
+// identityService is an IdentityService storing the identities in memory.
+type identityService struct {
+	mu         sync.Mutex
+	identities []*entity.Identity
+}
+
+func (s *identityService) FindIdentity(ctx context.Context, issuer string, subject string) (*entity.Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, identity := range s.identities {
+		if identity.Issuer == issuer && identity.Subject == subject {
+			return identity, nil
+		}
+	}
+	return nil, apperr.Errorf(apperr.ENOTFOUND, "identity not found")
+}
+
+func (s *identityService) CreateIdentity(ctx context.Context, identity *entity.Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.identities = append(s.identities, identity)
+	return nil
+}
+
+// cityService is a CityService storing the cities in memory, FindCities filters them by id and name only.
+type cityService struct {
+	mu     sync.Mutex
+	cities entity.Cities
+}
+
+func (s *cityService) CreateCity(ctx context.Context, city *entity.City) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	city.Id = int64(len(s.cities) + 1)
+	s.cities = append(s.cities, city)
+	return nil
+}
+
+func (s *cityService) DeleteCity(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, city := range s.cities {
+		if city.Id == id {
+			s.cities = append(s.cities[:i], s.cities[i+1:]...)
+			return nil
+		}
+	}
+	return apperr.Errorf(apperr.ENOTFOUND, "city not found")
+}
+
+func (s *cityService) UpdateCity(ctx context.Context, id int64, upd service.CityUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, city := range s.cities {
+		if city.Id == id {
+			if upd.Population != nil {
+				city.Population = *upd.Population
+			}
+			return nil
+		}
+	}
+	return apperr.Errorf(apperr.ENOTFOUND, "city not found")
+}
+
+func (s *cityService) FindCities(ctx context.Context, filter service.CityFilter) (entity.Cities, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cities entity.Cities
+	for _, city := range s.cities {
+		if filter.Id != nil && city.Id != *filter.Id {
+			continue
+		} else if filter.Name != nil && city.Name != *filter.Name {
+			continue
+		}
+		cities = append(cities, city)
+	}
+	return cities, nil
+}
+
+func (s *cityService) FindIdByName(ctx context.Context, name string) (*int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, city := range s.cities {
+		if city.Name == name {
+			return &city.Id, nil
+		}
+	}
+	return nil, apperr.Errorf(apperr.ENOTFOUND, "city not found")
+}
+
+// settingService is a SettingService storing the settings in memory.
+type settingService struct {
+	mu       sync.Mutex
+	settings map[string]string
+}
+
+func (s *settingService) FindSetting(ctx context.Context, name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value, ok := s.settings[name]; ok {
+		return value, nil
+	}
+	return "", apperr.Errorf(apperr.ENOTFOUND, "setting not found")
+}
+
+func (s *settingService) SetSetting(ctx context.Context, name string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.settings == nil {
+		s.settings = make(map[string]string)
+	}
+	s.settings[name] = value
+	return nil
+}
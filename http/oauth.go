@@ -0,0 +1,190 @@
+package http
+
+import (
+	"fmt"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// OAuth2 grant types supported by the token endpoint.
+const (
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypePassword          = "password"
+	GrantTypeRefreshToken      = "refresh_token"
+)
+
+// OAuth2 error codes, see RFC 6749 section 5.2.
+const (
+	oauthInvalidRequest       = "invalid_request"
+	oauthInvalidClient        = "invalid_client"
+	oauthInvalidGrant         = "invalid_grant"
+	oauthUnsupportedGrantType = "unsupported_grant_type"
+	oauthInvalidScope         = "invalid_scope"
+	oauthServerError          = "server_error"
+)
+
+// OAuthError is the error response of the token endpoint, as described by RFC 6749.
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// registerOAuthRoutes registers the OAuth2 token endpoint, an alternative to the
+// /v1/auth routes for off-the-shelf OAuth2 clients.
+//
+// Clients are the API keys: the client_id is the id of the key and the
+// client_secret is the key itself.
+func (s *ServerAPI) registerOAuthRoutes(g *echo.Group) {
+	g.POST("/token", func(c echo.Context) error {
+
+		// token responses must never be cached, see RFC 6749 section 5.1.
+		c.Response().Header().Set("Cache-Control", "no-store")
+		c.Response().Header().Set("Pragma", "no-cache")
+
+		if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationForm) {
+			return oauthErrorJSON(c, oauthInvalidRequest, apperr.Errorf(apperr.EINVALID, "the request must be form encoded"))
+		}
+
+		ctx := c.Request().Context()
+
+		client, err := s.oauthClient(c)
+		if err != nil {
+			return oauthErrorJSON(c, oauthInvalidClient, err)
+		}
+
+		// the scope can be reduced with the client_credentials and password grants,
+		// the refresh_token grant keeps the scope of the refresh token.
+		scope, err := entity.ParseScope(c.FormValue("scope"))
+		if err != nil {
+			return oauthErrorJSON(c, oauthInvalidScope, err)
+		}
+
+		var token *entity.Token
+
+		switch grantType := c.FormValue("grant_type"); grantType {
+		case GrantTypeClientCredentials:
+			if client == nil {
+				return oauthErrorJSON(c, oauthInvalidClient, apperr.Errorf(apperr.EUNAUTHORIZED, "client authentication is required"))
+			}
+
+			if token, err = s.JWTService.ExchangeClient(ctx, client, scope); err != nil {
+				return oauthErrorJSON(c, exchangeErrorCode(err), err)
+			}
+
+		case GrantTypePassword:
+			username, password := c.FormValue("username"), c.FormValue("password")
+			if username == "" || password == "" {
+				return oauthErrorJSON(c, oauthInvalidRequest, apperr.Errorf(apperr.EINVALID, "username and password are required"))
+			}
+
+			user, err := s.authenticate(c, username, password)
+			if err != nil {
+				return oauthErrorJSON(c, oauthInvalidGrant, err)
+			}
+
+			// the password grant has no room for a second factor.
+			if required, err := s.mfaRequired(ctx, user.ID); err != nil {
+				return oauthErrorJSON(c, oauthServerError, err)
+			} else if required {
+				return oauthErrorJSON(c, oauthInvalidGrant, apperr.Errorf(apperr.EUNAUTHORIZED, "the user has a second factor, use /v1/auth/login"))
+			}
+
+			if scope, err = s.scopeWithoutMFA(user, scope); err != nil {
+				return oauthErrorJSON(c, exchangeErrorCode(err), err)
+			}
+
+			if token, err = s.JWTService.Exchange(ctx, user, scope); err != nil {
+				return oauthErrorJSON(c, exchangeErrorCode(err), err)
+			}
+
+		case GrantTypeRefreshToken:
+			refreshToken := c.FormValue("refresh_token")
+			if refreshToken == "" {
+				return oauthErrorJSON(c, oauthInvalidRequest, apperr.Errorf(apperr.EINVALID, "refresh_token is required"))
+			}
+
+			if token, err = s.JWTService.Refresh(ctx, refreshToken); err != nil {
+				return oauthErrorJSON(c, oauthInvalidGrant, err)
+			}
+
+		case "":
+			return oauthErrorJSON(c, oauthInvalidRequest, apperr.Errorf(apperr.EINVALID, "grant_type is required"))
+
+		default:
+			return oauthErrorJSON(c, oauthUnsupportedGrantType, apperr.Errorf(apperr.EINVALID, "unsupported grant type %q", grantType))
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, token)
+	})
+}
+
+// oauthClient returns the API key of the client authenticating the request with HTTP Basic,
+// or with the client_id and client_secret parameters.
+// Returns nil if the request carries no client credentials.
+func (s *ServerAPI) oauthClient(c echo.Context) (*entity.APIKey, error) {
+
+	clientID, clientSecret, ok := c.Request().BasicAuth()
+	if ok {
+		// credentials are form encoded before being encoded in the header, see RFC 6749 section 2.3.1.
+		var err error
+		if clientID, err = url.QueryUnescape(clientID); err != nil {
+			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "invalid client credentials")
+		}
+		if clientSecret, err = url.QueryUnescape(clientSecret); err != nil {
+			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "invalid client credentials")
+		}
+	} else {
+		clientID, clientSecret = c.FormValue("client_id"), c.FormValue("client_secret")
+	}
+
+	if clientID == "" && clientSecret == "" {
+		return nil, nil
+	}
+
+	client, err := s.APIKeyService.AuthenticateAPIKey(c.Request().Context(), clientSecret)
+	if err != nil {
+		return nil, err
+	} else if fmt.Sprint(client.ID) != clientID {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "invalid client credentials")
+	}
+
+	return client, nil
+}
+
+// exchangeErrorCode returns the OAuth2 error code of an error returned when issuing a token,
+// which is EFORBIDDEN when none of the requested scopes is granted.
+func exchangeErrorCode(err error) string {
+	if apperr.ErrorCode(err) == apperr.EFORBIDDEN {
+		return oauthInvalidScope
+	}
+	return oauthServerError
+}
+
+// oauthErrorJSON returns an error response of the token endpoint with the given OAuth2 error code,
+// the error is used as description. Internal errors are always reported as server_error.
+func oauthErrorJSON(c echo.Context, code string, err error) error {
+
+	status := http.StatusBadRequest
+
+	switch apperr.ErrorCode(err) {
+	case apperr.EINTERNAL, apperr.EUNKNOWN:
+		code, status = oauthServerError, http.StatusInternalServerError
+	default:
+		if code == oauthInvalidClient {
+			status = http.StatusUnauthorized
+			if _, _, ok := c.Request().BasicAuth(); ok {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+			}
+		}
+	}
+
+	return c.JSON(status, OAuthError{
+		Error:            code,
+		ErrorDescription: MessageFromErr(err),
+	})
+}
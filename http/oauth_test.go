@@ -0,0 +1,250 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// serveToken sends the form to the token endpoint.
+func serveToken(s *ServerAPI, form url.Values, header http.Header) *httptest.ResponseRecorder {
+	return serveForm(s, "/oauth/token", form, header)
+}
+
+// createClient stores an API key with the given scopes and returns its client_id and client_secret.
+func createClient(t *testing.T, s *ServerAPI, secret string, scopes ...entity.Permission) (string, string) {
+	t.Helper()
+
+	key := &entity.APIKey{Name: secret, Scopes: scopes}
+	if _, err := s.APIKeyService.CreateAPIKey(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(key.ID), secret
+}
+
+// basicAuth returns the header authenticating the client with HTTP Basic.
+func basicAuth(clientID string, clientSecret string) http.Header {
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	return http.Header{"Authorization": req.Header.Values("Authorization")}
+}
+
+// decodeToken decodes a successful response of the token endpoint.
+func decodeToken(t *testing.T, rec *httptest.ResponseRecorder) entity.Token {
+	t.Helper()
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	} else if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Cache-Control = %q, want no-store", rec.Header().Get("Cache-Control"))
+	}
+
+	var token entity.Token
+	if err := json.Unmarshal(rec.Body.Bytes(), &token); err != nil {
+		t.Fatal(err)
+	} else if token.AccessToken == "" || token.TokenType != entity.TokenTypeBearer {
+		t.Fatalf("unexpected token: %s", rec.Body)
+	}
+	return token
+}
+
+// expectOAuthError checks that the response is an OAuth2 error with the given status and code.
+func expectOAuthError(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+
+	var e OAuthError
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, status, rec.Body)
+	} else if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	} else if e.Error != code {
+		t.Fatalf("error = %q, want %q: %s", e.Error, code, rec.Body)
+	}
+}
+
+func TestOAuthToken_ClientCredentials(t *testing.T) {
+	s := newTestServer(t)
+
+	clientID, clientSecret := createClient(t, s, "segreto", entity.PermissionCitiesRead, entity.PermissionCitiesWrite)
+
+	// the client authenticates with HTTP Basic or with the form parameters.
+	for name, tt := range map[string]struct {
+		form   url.Values
+		header http.Header
+	}{
+		"basic": {
+			form:   url.Values{"grant_type": {GrantTypeClientCredentials}},
+			header: basicAuth(clientID, clientSecret),
+		},
+		"form": {
+			form: url.Values{"grant_type": {GrantTypeClientCredentials}, "client_id": {clientID}, "client_secret": {clientSecret}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			token := decodeToken(t, serveToken(s, tt.form, tt.header))
+			if token.RefreshToken != "" {
+				t.Fatal("unexpected refresh token for a client")
+			} else if want := entity.FormatScope([]entity.Permission{entity.PermissionCitiesRead, entity.PermissionCitiesWrite}); token.Scope != want {
+				t.Fatalf("scope = %q, want %q", token.Scope, want)
+			}
+		})
+	}
+
+	// the scope can be reduced.
+	token := decodeToken(t, serveToken(s, url.Values{
+		"grant_type": {GrantTypeClientCredentials},
+		"scope":      {string(entity.PermissionCitiesRead)},
+	}, basicAuth(clientID, clientSecret)))
+	if token.Scope != string(entity.PermissionCitiesRead) {
+		t.Fatalf("scope = %q, want %q", token.Scope, entity.PermissionCitiesRead)
+	}
+
+	// the grant requires a client.
+	rec := serveToken(s, url.Values{"grant_type": {GrantTypeClientCredentials}}, nil)
+	expectOAuthError(t, rec, http.StatusUnauthorized, oauthInvalidClient)
+}
+
+func TestOAuthToken_Password(t *testing.T) {
+	s := newTestServer(t)
+
+	createUser(t, s, "mario", "Password-segreta-1", entity.RoleEditor)
+
+	token := decodeToken(t, serveToken(s, url.Values{
+		"grant_type": {GrantTypePassword},
+		"username":   {"mario"},
+		"password":   {"Password-segreta-1"},
+		"scope":      {string(entity.PermissionCitiesRead)},
+	}, nil))
+	if token.RefreshToken == "" {
+		t.Fatal("expected a refresh token")
+	} else if token.Scope != string(entity.PermissionCitiesRead) {
+		t.Fatalf("scope = %q, want %q", token.Scope, entity.PermissionCitiesRead)
+	}
+
+	rec := serveToken(s, url.Values{"grant_type": {GrantTypePassword}, "username": {"mario"}, "password": {"sbagliata"}}, nil)
+	expectOAuthError(t, rec, http.StatusBadRequest, oauthInvalidGrant)
+
+	rec = serveToken(s, url.Values{"grant_type": {GrantTypePassword}, "username": {"mario"}}, nil)
+	expectOAuthError(t, rec, http.StatusBadRequest, oauthInvalidRequest)
+}
+
+func TestOAuthToken_Password_MFA(t *testing.T) {
+	s := newTestServer(t)
+
+	user := createUser(t, s, "mario", "Password-segreta-1", entity.RoleEditor)
+	enableTOTP(t, s, user)
+
+	// the password grant has no room for the second factor, so it's refused.
+	rec := serveToken(s, url.Values{
+		"grant_type": {GrantTypePassword},
+		"username":   {"mario"},
+		"password":   {"Password-segreta-1"},
+	}, nil)
+	expectOAuthError(t, rec, http.StatusBadRequest, oauthInvalidGrant)
+
+	if sessions, err := s.SessionService.FindSessions(context.Background(), service.SessionFilter{UserID: &user.ID}); err != nil {
+		t.Fatal(err)
+	} else if len(sessions) != 0 {
+		t.Fatalf("expected no session, got %d", len(sessions))
+	}
+}
+
+func TestOAuthToken_RefreshToken(t *testing.T) {
+	s := newTestServer(t)
+
+	createUser(t, s, "mario", "Password-segreta-1", entity.RoleEditor)
+	_, refreshToken := loginTokens(t, s, "mario", "Password-segreta-1", string(entity.PermissionCitiesRead))
+
+	// the scope of the refresh token is kept.
+	token := decodeToken(t, serveToken(s, url.Values{"grant_type": {GrantTypeRefreshToken}, "refresh_token": {refreshToken}}, nil))
+	if token.RefreshToken == "" || token.RefreshToken == refreshToken {
+		t.Fatal("expected a new refresh token")
+	} else if token.Scope != string(entity.PermissionCitiesRead) {
+		t.Fatalf("scope = %q, want %q", token.Scope, entity.PermissionCitiesRead)
+	}
+
+	// a refresh token is rotated only once.
+	rec := serveToken(s, url.Values{"grant_type": {GrantTypeRefreshToken}, "refresh_token": {refreshToken}}, nil)
+	expectOAuthError(t, rec, http.StatusBadRequest, oauthInvalidGrant)
+
+	rec = serveToken(s, url.Values{"grant_type": {GrantTypeRefreshToken}}, nil)
+	expectOAuthError(t, rec, http.StatusBadRequest, oauthInvalidRequest)
+}
+
+func TestOAuthToken_InvalidClient(t *testing.T) {
+	s := newTestServer(t)
+
+	clientID, _ := createClient(t, s, "segreto", entity.PermissionCitiesRead)
+	form := url.Values{"grant_type": {GrantTypeClientCredentials}}
+
+	// with HTTP Basic the client is told how to authenticate, see RFC 6749 section 5.2.
+	for name, header := range map[string]http.Header{
+		"wrong secret":    basicAuth(clientID, "sbagliato"),
+		"wrong client id": basicAuth("2", "segreto"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := serveToken(s, form, header)
+			expectOAuthError(t, rec, http.StatusUnauthorized, oauthInvalidClient)
+			if got := rec.Header().Get(echo.HeaderWWWAuthenticate); !strings.HasPrefix(got, "Basic ") {
+				t.Fatalf("WWW-Authenticate = %q, want a Basic challenge", got)
+			}
+		})
+	}
+
+	// the form credentials get no challenge.
+	rec := serveToken(s, url.Values{"grant_type": {GrantTypeClientCredentials}, "client_id": {clientID}, "client_secret": {"sbagliato"}}, nil)
+	expectOAuthError(t, rec, http.StatusUnauthorized, oauthInvalidClient)
+	if got := rec.Header().Get(echo.HeaderWWWAuthenticate); got != "" {
+		t.Fatalf("unexpected WWW-Authenticate %q", got)
+	}
+}
+
+func TestOAuthToken_InvalidRequest(t *testing.T) {
+	s := newTestServer(t)
+
+	clientID, clientSecret := createClient(t, s, "segreto", entity.PermissionCitiesRead)
+	client := basicAuth(clientID, clientSecret)
+
+	for name, tt := range map[string]struct {
+		form   url.Values
+		status int
+		code   string
+	}{
+		"no grant type":              {form: url.Values{}, status: http.StatusBadRequest, code: oauthInvalidRequest},
+		"unsupported grant":          {form: url.Values{"grant_type": {"authorization_code"}}, status: http.StatusBadRequest, code: oauthUnsupportedGrantType},
+		"malformed scope":            {form: url.Values{"grant_type": {GrantTypeClientCredentials}, "scope": {"cities:fly"}}, status: http.StatusBadRequest, code: oauthInvalidScope},
+		"scope not granted":          {form: url.Values{"grant_type": {GrantTypeClientCredentials}, "scope": {string(entity.PermissionCitiesDelete)}}, status: http.StatusBadRequest, code: oauthInvalidScope},
+		"malformed scope, any grant": {form: url.Values{"grant_type": {GrantTypeRefreshToken}, "refresh_token": {"x"}, "scope": {"bogus"}}, status: http.StatusBadRequest, code: oauthInvalidScope},
+	} {
+		t.Run(name, func(t *testing.T) {
+			expectOAuthError(t, serveToken(s, tt.form, client), tt.status, tt.code)
+		})
+	}
+}
+
+func TestOAuthToken_NotForm(t *testing.T) {
+	s := newTestServer(t)
+
+	clientID, clientSecret := createClient(t, s, "segreto", entity.PermissionCitiesRead)
+
+	// a JSON body with valid credentials is still rejected.
+	rec := serve(s, http.MethodPost, "/oauth/token", map[string]string{
+		"grant_type":    GrantTypeClientCredentials,
+		"client_id":     clientID,
+		"client_secret": clientSecret,
+	}, nil)
+	expectOAuthError(t, rec, http.StatusBadRequest, oauthInvalidRequest)
+
+	// query parameters are not a form body either.
+	rec = serve(s, http.MethodPost, "/oauth/token?grant_type=client_credentials", nil, basicAuth(clientID, clientSecret))
+	expectOAuthError(t, rec, http.StatusBadRequest, oauthInvalidRequest)
+}
@@ -0,0 +1,253 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"mysql/inmem"
+	"mysql/oidc"
+	"mysql/oidc/oidctest"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// newOIDCTestServer returns a test server whose users log in at a mock identity provider.
+func newOIDCTestServer(t *testing.T) (*ServerAPI, *oidctest.Server) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	provider := oidctest.NewServer("client", "secret")
+	t.Cleanup(provider.Close)
+
+	s := newTestServer(t)
+	s.OIDCProvider = oidc.NewProvider(provider.Issuer(), "client", "secret", "http://localhost/v1/auth/oidc/callback")
+	s.OIDCLoginService = inmem.NewOIDCLoginService(ctx, inmem.DefaultSweepInterval)
+	s.IdentityService = &identityService{}
+
+	return s, provider
+}
+
+// oidcLogin logs in at the mock provider and returns the response of the callback.
+func oidcLogin(t *testing.T, s *ServerAPI) (int, map[string]interface{}) {
+	t.Helper()
+
+	rec := serve(s, http.MethodGet, "/v1/auth/oidc/login", nil, nil)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login status = %d, want %d: %s", rec.Code, http.StatusFound, rec.Body)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	res, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec = serve(s, http.MethodGet, callback.RequestURI(), nil, nil)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, response
+}
+
+// loggedInAs returns the id of the user the tokens of the response belong to.
+func loggedInAs(t *testing.T, s *ServerAPI, response map[string]interface{}) string {
+	t.Helper()
+
+	token, ok := response["token"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("no token in the response: %v", response)
+	}
+
+	claims, err := s.JWTService.Parse(context.Background(), token["access_token"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.Subject
+}
+
+func TestOIDCCallback_Provisioning(t *testing.T) {
+	s, provider := newOIDCTestServer(t)
+
+	if status, _ := oidcLogin(t, s); status != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d without provisioning", status, http.StatusUnauthorized)
+	}
+
+	s.OIDCProvisioning = true
+
+	status, response := oidcLogin(t, s)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %v", status, http.StatusOK, response)
+	}
+
+	user, err := s.UserService.FindUserByUsername(context.Background(), provider.User.PreferredUsername)
+	if err != nil {
+		t.Fatal(err)
+	} else if user.Email != provider.User.Email || user.Name != provider.User.Name {
+		t.Fatalf("unexpected provisioned user: %+v", user)
+	} else if got := loggedInAs(t, s, response); got != fmt.Sprint(user.ID) {
+		t.Fatalf("logged in as %s, want %d", got, user.ID)
+	}
+
+	// the next login uses the linked identity, no other user is created.
+	if status, response := oidcLogin(t, s); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %v", status, http.StatusOK, response)
+	} else if got := loggedInAs(t, s, response); got != fmt.Sprint(user.ID) {
+		t.Fatalf("logged in as %s, want %d", got, user.ID)
+	}
+
+	if users, _ := s.UserService.FindUsers(context.Background(), service.UserFilter{}); len(users) != 1 {
+		t.Fatalf("len(users) = %d, want 1", len(users))
+	}
+}
+
+// verifyEmail marks the email of the user as verified.
+func verifyEmail(t *testing.T, s *ServerAPI, user *entity.User) {
+	t.Helper()
+
+	verified := true
+	if err := s.UserService.UpdateUser(context.Background(), user.ID, service.UserUpdate{EmailVerified: &verified}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCCallback_EmailLinking(t *testing.T) {
+	tests := []struct {
+		name              string
+		role              entity.Role
+		linking           bool
+		emailVerified     bool
+		userEmailVerified bool
+		linked            bool
+	}{
+		{name: "linking disabled", role: entity.RoleViewer, linking: false, emailVerified: true, userEmailVerified: true, linked: false},
+		{name: "linking enabled", role: entity.RoleViewer, linking: true, emailVerified: true, userEmailVerified: true, linked: true},
+		{name: "email not verified", role: entity.RoleViewer, linking: true, emailVerified: false, userEmailVerified: true, linked: false},
+		{name: "user email not verified", role: entity.RoleViewer, linking: true, emailVerified: true, userEmailVerified: false, linked: false},
+		{name: "privileged user", role: entity.RoleAdmin, linking: true, emailVerified: true, userEmailVerified: true, linked: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, provider := newOIDCTestServer(t)
+			s.OIDCEmailLinking = tt.linking
+			provider.User.EmailVerified = tt.emailVerified
+
+			user := createUser(t, s, "mario", "Password-segreta-1", tt.role)
+			provider.User.Email = user.Email
+			if tt.userEmailVerified {
+				verifyEmail(t, s, user)
+			}
+
+			status, response := oidcLogin(t, s)
+
+			if !tt.linked {
+				if status != http.StatusUnauthorized {
+					t.Fatalf("status = %d, want %d: %v", status, http.StatusUnauthorized, response)
+				}
+				return
+			}
+
+			if status != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %v", status, http.StatusOK, response)
+			} else if got := loggedInAs(t, s, response); got != fmt.Sprint(user.ID) {
+				t.Fatalf("logged in as %s, want %d", got, user.ID)
+			}
+		})
+	}
+}
+
+func TestOIDCCallback_EmailTakenWithProvisioning(t *testing.T) {
+	s, provider := newOIDCTestServer(t)
+	s.OIDCProvisioning = true
+
+	admin := createUser(t, s, "admin", "Password-segreta-1", entity.RoleAdmin)
+	verifyEmail(t, s, admin)
+	provider.User.Email = admin.Email
+
+	// the identity is neither linked to the admin nor given a second user with the same email.
+	if status, response := oidcLogin(t, s); status != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %v", status, http.StatusUnauthorized, response)
+	}
+
+	if users, _ := s.UserService.FindUsers(context.Background(), service.UserFilter{}); len(users) != 1 {
+		t.Fatalf("len(users) = %d, want 1", len(users))
+	}
+}
+
+func TestOIDCCallback_PreRegisteredEmail(t *testing.T) {
+	s, provider := newOIDCTestServer(t)
+	s.OIDCEmailLinking = true
+	s.SetRegistrationEnabled(true)
+
+	// anyone can register with the email of someone else, before its owner logs in with the provider.
+	if rec := serve(s, http.MethodPost, "/v1/auth/register", map[string]string{
+		"username": "impostore",
+		"name":     "Impostore",
+		"email":    provider.User.Email,
+		"password": "Password-segreta-1",
+	}, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+
+	squatter, err := s.UserService.FindUserByUsername(context.Background(), "impostore")
+	if err != nil {
+		t.Fatal(err)
+	} else if squatter.EmailVerified {
+		t.Fatal("expected the email of a registered user not to be verified")
+	}
+
+	// the identity is not linked to the user who registered the email.
+	if status, response := oidcLogin(t, s); status != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %v", status, http.StatusUnauthorized, response)
+	}
+
+	// nor does that user keep the owner of the email from getting its own user.
+	s.OIDCProvisioning = true
+
+	status, response := oidcLogin(t, s)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %v", status, http.StatusOK, response)
+	}
+
+	user, err := s.UserService.FindUserByUsername(context.Background(), provider.User.PreferredUsername)
+	if err != nil {
+		t.Fatal(err)
+	} else if !user.EmailVerified {
+		t.Fatal("expected the email of the provisioned user to be verified")
+	} else if got := loggedInAs(t, s, response); got != fmt.Sprint(user.ID) {
+		t.Fatalf("logged in as %s, want %d", got, user.ID)
+	}
+}
+
+func TestOIDCCallback_InvalidIDToken(t *testing.T) {
+	s, provider := newOIDCTestServer(t)
+	s.OIDCProvisioning = true
+	provider.Claims = map[string]interface{}{"aud": "another-client"}
+
+	if status, response := oidcLogin(t, s); status != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %v", status, http.StatusUnauthorized, response)
+	}
+}
+
+func TestOIDCCallback_UnknownState(t *testing.T) {
+	s, _ := newOIDCTestServer(t)
+
+	rec := serve(s, http.MethodGet, "/v1/auth/oidc/callback?state=unknown&code=code", nil, nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+}
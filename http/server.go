@@ -2,6 +2,8 @@ package http
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"mysql/app/apperr"
 	"mysql/app/entity"
@@ -9,6 +11,8 @@ import (
 	"mysql/jwt"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,37 +25,14 @@ import (
 // ShutdownTimeout is the time given for outstanding requests to finish before shutdown.
 const ShutdownTimeout = 1 * time.Second
 
-var usersMux sync.RWMutex
+// PasswordResetTimeout is the time given to create and mail a password reset, which
+// happens after the response has been sent.
+const PasswordResetTimeout = 30 * time.Second
 
-var users = map[int64]*entity.User{
-
-	1:{
-		ID: 1,
-		Username: "Pippoboss",
-		Name: "Pippo",
-		Password: "pippogamer89",
-	},
-
-	2:{
-		ID: 2,
-		Username: "Mangaka96",
-		Name: "Luca Molinari",
-		Password: "deathshield2018",
-	},
-
-	3:{
-		ID: 3,
-		Username: "Cydonia",
-		Name: "Francesco Cilurzo",
-		Password: "chiarafilm96",
-	},
-
-	4:{
-		ID: 4,
-		Username: "Sabaku no maiku",
-		Name: "Michele Poggi",
-		Password: "phenrirmailoki$$",
-	},
+// jwksService is implemented by the token services whose tokens can be verified
+// by third parties with the published public keys, see jwt.JWTService.
+type jwksService interface {
+	JWKS() jwt.JSONWebKeySet
 }
 
 // ServerAPI is the main server for the API
@@ -72,12 +53,70 @@ type ServerAPI struct {
 	// JWTSecret is the secret used to sign JWT tokens.
 	JWTSecret string
 
-	JWTService *jwt.JWTService
+	// JWTService issues and parses the tokens, in any of the supported formats.
+	JWTService          service.JWTService
+	JWTBlacklistService service.JWTBlacklistService
+	RefreshTokenService service.RefreshTokenService
+
+	// PublicRoutes are the authenticated routes that can also be called without a token,
+	// keyed by method and path, e.g. "GET /v1/city/:name".
+	PublicRoutes map[string]bool
+
+	// PasswordResetURL is the page where users set a new password, the reset
+	// token is added to it as the token query parameter.
+	// If empty, the mail only contains the token.
+	PasswordResetURL string
+
+	// dummyHash is the hash compared when a user logs in with an unknown username, see dummyPasswordHash.
+	dummyHashOnce sync.Once
+	dummyHash     string
+	dummyHashErr  error
+
+	// registrationEnabled reports whether open registration is enabled when the
+	// setting isn't stored by SettingService, see RegistrationEnabled.
+	registrationMu      sync.RWMutex
+	registrationEnabled bool
 
 	// Services used by HTTP handler.
-	CityService service.CityService
+	CityService     service.CityService
+	UserService     service.UserService
+	PasswordService service.PasswordService
+	APIKeyService   service.APIKeyService
+
+	PasswordResetService service.PasswordResetService
+	Mailer               service.Mailer
+	LoginThrottleService service.LoginThrottleService
+
+	// PasswordPolicyService checks the passwords chosen by the users, if set.
+	PasswordPolicyService service.PasswordPolicyService
+
+	TOTPService service.TOTPService
+	MFAService  service.MFAService
+
+	// MFARequiredPermissions are withheld from the tokens of the users without a confirmed
+	// second factor, who can still log in to enroll one. Defaults to users:manage.
+	MFARequiredPermissions []entity.Permission
+
+	SessionService service.SessionService
+
+	// SettingService stores the settings changed by the admins, shared by all the nodes.
+	// If nil, the settings are only held in the memory of this process.
+	SettingService service.SettingService
+
+	// OIDCProvider is the identity provider users can log in with,
+	// the OIDC login is disabled if nil.
+	OIDCProvider     service.OIDCProvider
+	OIDCLoginService service.OIDCLoginService
+	IdentityService  service.IdentityService
+
+	// OIDCProvisioning enables the creation of a user at the first login of an
+	// identity that can't be linked to an existing user.
+	OIDCProvisioning bool
 
-	Users map[int64]*entity.User
+	// OIDCEmailLinking enables linking an identity logging in for the first time to the
+	// user with the same email, when both the provider and the user have verified it.
+	// Privileged users are never linked, see entity.User.Privileged.
+	OIDCEmailLinking bool
 }
 
 // NewServerAPI creates a new API server.
@@ -86,15 +125,25 @@ func NewServerAPI() *ServerAPI {
 	s := &ServerAPI{
 		server:  &http.Server{},
 		handler: echo.New(),
+		PublicRoutes: map[string]bool{
+			routeKey(http.MethodGet, "/v1/city/:name"):   true,
+			routeKey(http.MethodPost, "/v1/city/search"): true,
+		},
+		MFARequiredPermissions: []entity.Permission{entity.PermissionUsersManage},
 	}
 
 	// Set echo as the default HTTP handler.
 	s.server.Handler = s.handler
 
+	// the client IP is the address of the connection, headers set by the client can't be trusted,
+	// see SetTrustedProxies.
+	s.handler.IPExtractor = echo.ExtractIPDirect()
+
 	// Base Middleware
 	s.handler.Use(middleware.Secure())
 	s.handler.Use(middleware.CORS())
 	s.handler.Use(s.RecoverPanicMiddleware)
+	s.handler.Use(s.ClientMiddleware)
 
 	s.handler.GET("/", func(c echo.Context) error {
 		//return c.String(http.StatusOK, "Welcome to API")
@@ -108,6 +157,20 @@ func NewServerAPI() *ServerAPI {
 		})
 	})
 
+	// Public keys used to verify the issued tokens, only published for JWT tokens.
+	s.handler.GET("/.well-known/jwks.json", func(c echo.Context) error {
+		keys, ok := s.JWTService.(jwksService)
+		if !ok {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.ENOTFOUND, "the tokens are not verifiable with a JWKS"), nil)
+		}
+		c.Response().Header().Set("Cache-Control", "public, max-age=3600")
+		return SuccessResponseJSON(c, http.StatusOK, keys.JWKS())
+	})
+
+	// OAuth2 token endpoint.
+	oauthGroup := s.handler.Group("/oauth")
+	s.registerOAuthRoutes(oauthGroup)
+
 	// Register routes for the API v1.
 	v1Group := s.handler.Group("/v1")
 	s.registerRoutes(v1Group)
@@ -169,6 +232,57 @@ func (s *ServerAPI) URL() string {
 	return fmt.Sprintf("%s://%s:%d", scheme, domain, port)
 }
 
+// RegistrationEnabled reports whether new users can register through the API.
+// The setting stored by SettingService takes precedence over the default set
+// with SetRegistrationEnabled.
+func (s *ServerAPI) RegistrationEnabled(ctx context.Context) (bool, error) {
+	if s.SettingService != nil {
+		value, err := s.SettingService.FindSetting(ctx, entity.SettingRegistrationEnabled)
+		if err == nil {
+			return value == "true", nil
+		} else if apperr.ErrorCode(err) != apperr.ENOTFOUND {
+			return false, err
+		}
+	}
+
+	s.registrationMu.RLock()
+	defer s.registrationMu.RUnlock()
+	return s.registrationEnabled, nil
+}
+
+// SetRegistrationEnabled sets whether new users can register through the API
+// until an admin changes the setting, see UpdateRegistrationEnabled.
+func (s *ServerAPI) SetRegistrationEnabled(enabled bool) {
+	s.registrationMu.Lock()
+	defer s.registrationMu.Unlock()
+	s.registrationEnabled = enabled
+}
+
+// UpdateRegistrationEnabled enables or disables the registration of new users through the API.
+// The setting is stored by SettingService if set, otherwise it only applies to this process
+// and is lost on restart.
+func (s *ServerAPI) UpdateRegistrationEnabled(ctx context.Context, enabled bool) error {
+	if s.SettingService != nil {
+		return s.SettingService.SetSetting(ctx, entity.SettingRegistrationEnabled, strconv.FormatBool(enabled))
+	}
+
+	s.SetRegistrationEnabled(enabled)
+	return nil
+}
+
+// SetTrustedProxies makes the server take the client IP from the X-Forwarded-For header,
+// skipping the addresses of the given proxies only. The client IP is used by the login
+// throttling and recorded in the sessions.
+func (s *ServerAPI) SetTrustedProxies(proxies []*net.IPNet) {
+
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		options = append(options, echo.TrustIPRange(proxy))
+	}
+
+	s.handler.IPExtractor = echo.ExtractIPFromXFFHeader(options...)
+}
+
 // UseTLS returns true if the server is using TLS.
 func (s *ServerAPI) UseTLS() bool {
 	return s.Domain != ""
@@ -179,8 +293,25 @@ func (s *ServerAPI) registerRoutes(g *echo.Group) {
 	authGroup := g.Group("/auth")
 	s.registerAuthRoutes(authGroup)
 
-	cityGroup := g.Group("/city")
+	mfaGroup := authGroup.Group("/mfa")
+	s.registerMFARoutes(mfaGroup)
+
+	sessionGroup := authGroup.Group("/sessions", s.AuthMiddleware, s.RequirePermission(entity.PermissionAccountManage))
+	s.registerSessionRoutes(sessionGroup)
+
+	oidcGroup := authGroup.Group("/oidc")
+	s.registerOIDCRoutes(oidcGroup)
+
+	cityGroup := g.Group("/city", s.AuthMiddleware)
 	s.registerCityRoutes(cityGroup)
+
+	// the impersonation tokens carry the full scope of the user, they must not reach
+	// the routes managing the other accounts.
+	apiKeyGroup := g.Group("/apikeys", s.AuthMiddleware, s.RequirePermission(entity.PermissionAPIKeysManage), s.DenyImpersonation)
+	s.registerAPIKeyRoutes(apiKeyGroup)
+
+	adminGroup := g.Group("/admin", s.AuthMiddleware, s.RequirePermission(entity.PermissionUsersManage), s.DenyImpersonation)
+	s.registerAdminRoutes(adminGroup)
 }
 
 func (s *ServerAPI) registerAuthRoutes(g *echo.Group) {
@@ -188,6 +319,9 @@ func (s *ServerAPI) registerAuthRoutes(g *echo.Group) {
 		type LoginParams struct {
 			Username string `json:"username"`
 			Password string `json:"password"`
+
+			// Scope optionally limits the permissions of the tokens, see entity.ParseScope.
+			Scope string `json:"scope"`
 		}
 
 		var login LoginParams
@@ -199,142 +333,1364 @@ func (s *ServerAPI) registerAuthRoutes(g *echo.Group) {
 			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "dati inseriti non validi"), nil)
 		}
 
-		var user *entity.User
+		scope, err := entity.ParseScope(login.Scope)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
 
-		usersMux.RLock()
-		defer usersMux.RUnlock()
-		for _, u := range users {
-			if u.Username == login.Username {
-				user = u
-				break
-			}
+		user, err := s.authenticate(c, login.Username, login.Password)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return s.loginResponse(c, user, scope)
+	})
+
+	g.POST("/register", func(c echo.Context) error {
+		type RegisterParams struct {
+			Username string `json:"username"`
+			Name     string `json:"name"`
+			Email    string `json:"email"`
+			Password string `json:"password"`
 		}
 
-		// nota: questo tipo di errore non è corretto, meglio essere generici con la restituzione di errore per
-		// un login non autorizzato
-		// if user == nil {
-		// 	return ErrorResponseJSON(c, apperr.Errorf(apperr.ENOTFOUND, "utente non trovato"), nil)
-		// }
-		
-		// if user.Password != login.Password {
-		// 	return ErrorResponseJSON(c, apperr.Errorf(apperr.EUNAUTHORIZED, "password non valida"), nil)
-		// }
+		if enabled, err := s.RegistrationEnabled(c.Request().Context()); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		} else if !enabled {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EFORBIDDEN, "registrazione disabilitata"), nil)
+		}
+
+		var params RegisterParams
+		if err := c.Bind(&params); err != nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		if params.Password == "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "Password invalida"), nil)
+		}
 
-		if user == nil || user.Password != login.Password {
-			return ErrorResponseJSON(c, apperr.Errorf(apperr.EUNAUTHORIZED, "username e/o password invalidi"), nil)
+		if details, err := s.validatePassword(c.Request().Context(), params.Password, &entity.User{
+			Username: params.Username,
+			Name:     params.Name,
+			Email:    params.Email,
+		}); err != nil {
+			return ErrorResponseJSON(c, err, details)
 		}
 
-		token, err := s.JWTService.Exchange(c.Request().Context(), user)
+		hash, err := s.PasswordService.Hash(c.Request().Context(), params.Password)
 		if err != nil {
-			return err
+			return ErrorResponseJSON(c, err, nil)
 		}
 
-		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
-			"token": token,
+		user := entity.User{
+			Username:     params.Username,
+			Name:         params.Name,
+			Email:        params.Email,
+			PasswordHash: hash,
+			Roles:        []entity.Role{entity.RoleViewer},
+		}
+
+		if err := s.UserService.CreateUser(c.Request().Context(), &user); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return SuccessResponseJSON(c, http.StatusCreated, echo.Map{
+			"user": user.Profile(),
 		})
 	})
-}
 
-// registerCityRoutes registers all routes for the API group city.
-func (s *ServerAPI) registerCityRoutes(g *echo.Group) {
-	g.POST("", func(c echo.Context) error {
-		var city entity.City
-		if err := c.Bind(&city); err != nil {
+	g.POST("/refresh", func(c echo.Context) error {
+		type RefreshParams struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		var params RefreshParams
+		if err := c.Bind(&params); err != nil {
 			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
 		}
 
-		if err := s.CityService.CreateCity(c.Request().Context(), &city); err != nil {
+		if params.RefreshToken == "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "refresh token mancante"), nil)
+		}
+
+		token, err := s.JWTService.Refresh(c.Request().Context(), params.RefreshToken)
+		if err != nil {
 			return ErrorResponseJSON(c, err, nil)
 		}
 
 		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
-			"city": city,
+			"token": token,
 		})
 	})
 
-	g.GET("/:name", func(c echo.Context) error {
-		cityName := c.Param("name")
-		cityFilter := service.CityFilter{Name: &cityName}
-		cities, err := s.CityService.FindCities(c.Request().Context(), cityFilter)
+	g.POST("/logout", func(c echo.Context) error {
+
+		claims, err := AuthClaims(c)
 		if err != nil {
 			return ErrorResponseJSON(c, err, nil)
 		}
 
-		if len(cities) == 0 {
-			return ErrorResponseJSON(c, apperr.Errorf(apperr.ENOTFOUND, "Città non trovata"), nil)
+		// the token only needs to stay blacklisted until it would expire on its own.
+		expiration := s.JWTService.RevocationTTL(time.Unix(claims.ExpiresAt, 0))
+
+		if err := s.JWTBlacklistService.Invalidate(c.Request().Context(), claims.Id, expiration); err != nil {
+			return ErrorResponseJSON(c, err, nil)
 		}
 
-		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
-			"city": cities[0],
-		})
+		// the refresh token of the session must not outlive the logout.
+		if claims.SessionID != "" {
+			session, err := s.SessionService.FindSessionByID(c.Request().Context(), claims.SessionID)
+			if err != nil {
+				return ErrorResponseJSON(c, err, nil)
+			}
+
+			if err := s.revokeSession(c.Request().Context(), session); err != nil {
+				return ErrorResponseJSON(c, err, nil)
+			}
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}, s.AuthMiddleware)
+
+	g.POST("/password/forgot", func(c echo.Context) error {
+		type ForgotParams struct {
+			Email string `json:"email"`
+		}
+
+		var params ForgotParams
+		if err := c.Bind(&params); err != nil || params.Email == "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		// the response is the same whether the email belongs to a user or not, so that
+		// the endpoint can't be used to find out the registered emails.
+		response := echo.Map{
+			"message": "se l'email è registrata riceverai le istruzioni per il reset della password",
+		}
+
+		users, err := s.UserService.FindUsers(c.Request().Context(), service.UserFilter{Email: &params.Email})
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		// the reset is sent in the background, otherwise the time taken by the mail
+		// server would tell the registered emails apart from the others.
+		go s.sendPasswordResets(users)
+
+		return SuccessResponseJSON(c, http.StatusAccepted, response)
 	})
 
-	g.DELETE("/:name", func(c echo.Context) error {
+	g.POST("/password/reset", func(c echo.Context) error {
+		type ResetParams struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
 
-		id, err := s.CityService.FindIdByName(c.Request().Context(), c.Param("name"))
+		var params ResetParams
+		if err := c.Bind(&params); err != nil || params.Token == "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		if params.Password == "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "Password invalida"), nil)
+		}
+
+		ctx := c.Request().Context()
+
+		// the password is checked before consuming the token, so that the user can pick another one.
+		reset, err := s.PasswordResetService.FindPasswordReset(ctx, params.Token)
 		if err != nil {
 			return ErrorResponseJSON(c, err, nil)
 		}
 
-		if err := s.CityService.DeleteCity(c.Request().Context(), *id); err != nil {
+		user, err := s.UserService.FindUserByID(ctx, reset.UserID)
+		if apperr.ErrorCode(err) == apperr.ENOTFOUND {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EUNAUTHORIZED, "token di reset non valido"), nil)
+		} else if err != nil {
 			return ErrorResponseJSON(c, err, nil)
 		}
 
-		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
-			"città eliminata correttamente con id = ": id,
-		})
+		if details, err := s.validatePassword(ctx, params.Password, user); err != nil {
+			return ErrorResponseJSON(c, err, details)
+		}
+
+		if reset, err = s.PasswordResetService.ConsumePasswordReset(ctx, params.Token); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		if err := s.setPassword(c.Request().Context(), reset.UserID, params.Password); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return c.NoContent(http.StatusNoContent)
 	})
 
-	g.PATCH("/:name", func(c echo.Context) error {
+	g.POST("/password/change", func(c echo.Context) error {
+		type ChangeParams struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
 
-		id, err := s.CityService.FindIdByName(c.Request().Context(), c.Param("name"))
+		authUser, err := AuthUser(c)
 		if err != nil {
 			return ErrorResponseJSON(c, err, nil)
 		}
 
-		var upd service.CityUpdate
-		if err := c.Bind(&upd); err != nil {
+		var params ChangeParams
+		if err := c.Bind(&params); err != nil {
 			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
 		}
 
-		if err := s.CityService.UpdateCity(c.Request().Context(), *id, upd); err != nil {
+		if params.NewPassword == "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "Password invalida"), nil)
+		}
+
+		user, err := s.UserService.FindUserByID(c.Request().Context(), authUser.ID)
+		if err != nil {
 			return ErrorResponseJSON(c, err, nil)
 		}
 
-		cities, err := s.CityService.FindCities(c.Request().Context(), service.CityFilter{Id: id})
+		if match, _, err := s.PasswordService.Compare(c.Request().Context(), params.CurrentPassword, user.PasswordHash); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		} else if !match {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EUNAUTHORIZED, "password attuale non valida"), nil)
+		}
+
+		if details, err := s.validatePassword(c.Request().Context(), params.NewPassword, user); err != nil {
+			return ErrorResponseJSON(c, err, details)
+		}
+
+		if err := s.setPassword(c.Request().Context(), user.ID, params.NewPassword); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}, s.AuthMiddleware, s.RequirePermission(entity.PermissionAccountManage), s.DenyImpersonation)
+
+	g.POST("/introspect", func(c echo.Context) error {
+		// IntrospectionResponse is described by RFC 7662, inactive tokens only carry active.
+		type IntrospectionResponse struct {
+			Active    bool   `json:"active"`
+			Scope     string `json:"scope,omitempty"`
+			ClientID  string `json:"client_id,omitempty"`
+			Username  string `json:"username,omitempty"`
+			TokenType string `json:"token_type,omitempty"`
+			Exp       int64  `json:"exp,omitempty"`
+			Iat       int64  `json:"iat,omitempty"`
+			Nbf       int64  `json:"nbf,omitempty"`
+			Sub       string `json:"sub,omitempty"`
+			Aud       string `json:"aud,omitempty"`
+			Iss       string `json:"iss,omitempty"`
+			Jti       string `json:"jti,omitempty"`
+
+			// Act is the admin acting as the user, see RFC 8693 section 4.1.
+			Act *entity.Actor `json:"act,omitempty"`
+		}
+
+		c.Response().Header().Set("Cache-Control", "no-store")
+
+		token := c.FormValue("token")
+		if token == "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "token mancante"), nil)
+		}
+
+		// the reason a token is not valid is not disclosed, see RFC 7662 section 2.2.
+		inactive := IntrospectionResponse{Active: false}
+
+		claims, err := s.JWTService.Parse(c.Request().Context(), token)
+		if code := apperr.ErrorCode(err); code == apperr.EINTERNAL || code == apperr.EUNKNOWN {
+			return ErrorResponseJSON(c, err, nil)
+		} else if err != nil {
+			return SuccessResponseJSON(c, http.StatusOK, inactive)
+		}
+
+		response := IntrospectionResponse{
+			Active:    true,
+			Scope:     claims.Scope,
+			TokenType: entity.TokenTypeBearer,
+			Exp:       claims.ExpiresAt,
+			Iat:       claims.IssuedAt,
+			Nbf:       claims.NotBefore,
+			Sub:       claims.Subject,
+			Aud:       claims.Audience,
+			Iss:       claims.Issuer,
+			Jti:       claims.Id,
+		}
+
+		if claims.User != nil {
+			response.Username = claims.User.Username
+		}
+		response.Act = claims.Actor
+
+		// the tokens of a client are active only as long as its API key.
+		if claims.ClientID != "" {
+			apiKey, err := s.clientAPIKey(c.Request().Context(), claims.ClientID)
+			if apperr.ErrorCode(err) == apperr.EUNAUTHORIZED {
+				return SuccessResponseJSON(c, http.StatusOK, inactive)
+			} else if err != nil {
+				return ErrorResponseJSON(c, err, nil)
+			}
+
+			// the scope of the token shrinks along with the scopes of the key.
+			scope, err := entity.ParseScope(claims.Scope)
+			if err != nil {
+				return SuccessResponseJSON(c, http.StatusOK, inactive)
+			}
+
+			response.ClientID = claims.ClientID
+			response.Scope = entity.FormatScope(entity.ReduceScope(apiKey.Scopes, scope))
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, response)
+	}, s.ClientAuthMiddleware)
+
+	g.GET("/me", func(c echo.Context) error {
+
+		user, err := AuthUser(c)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		response := echo.Map{
+			"user": user.Profile(),
+		}
+
+		// support staff acting as the user can tell whose session they are in.
+		if actor, err := AuthActor(c); err == nil {
+			response["act"] = actor
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, response)
+	}, s.AuthMiddleware)
+}
+
+// registerMFARoutes registers all routes for the API group mfa.
+func (s *ServerAPI) registerMFARoutes(g *echo.Group) {
+	g.POST("/verify", func(c echo.Context) error {
+		type VerifyParams struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+
+		var params VerifyParams
+		if err := c.Bind(&params); err != nil || params.MFAToken == "" || params.Code == "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		ctx, ip := c.Request().Context(), c.RealIP()
+
+		claims, err := s.JWTService.ParseMFAChallenge(ctx, params.MFAToken)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		user, err := s.UserService.FindUserByID(ctx, claims.User.ID)
+		if apperr.ErrorCode(err) == apperr.ENOTFOUND {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EUNAUTHORIZED, "user no longer exists"), nil)
+		} else if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		if err := s.throttleCode(ctx, user, ip, func() error {
+			return s.verifySecondFactor(ctx, user.ID, params.Code)
+		}); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		// the challenge can be exchanged only once.
+		if err := s.JWTBlacklistService.Invalidate(ctx, claims.Id, s.JWTService.RevocationTTL(time.Unix(claims.ExpiresAt, 0))); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		// the scope requested at login is carried by the challenge.
+		scope, err := entity.ParseScope(claims.Scope)
+		if err != nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EUNAUTHORIZED, "invalid mfa token scope"), nil)
+		}
+
+		token, err := s.JWTService.Exchange(ctx, user, scope)
 		if err != nil {
 			return ErrorResponseJSON(c, err, nil)
 		}
 
 		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
-			"city": cities[0],
+			"token": token,
 		})
 	})
 
-	g.POST("/search", func(c echo.Context) error {
+	g.POST("/totp", func(c echo.Context) error {
 
-		var fil service.CityFilter
-		if err := c.Bind(&fil); err != nil {
+		user, err := AuthUser(c)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		secret, err := s.TOTPService.GenerateSecret(c.Request().Context())
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		totp := entity.TOTP{
+			UserID: user.ID,
+			Secret: secret,
+		}
+
+		if err := s.MFAService.CreateTOTP(c.Request().Context(), &totp); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		// the secret is shown only now, the uri is meant to be rendered as a QR code.
+		return SuccessResponseJSON(c, http.StatusCreated, echo.Map{
+			"secret": secret,
+			"uri":    s.TOTPService.ProvisioningURI(c.Request().Context(), user.Username, secret),
+		})
+	}, s.AuthMiddleware, s.RequirePermission(entity.PermissionAccountManage), s.DenyImpersonation)
+
+	g.POST("/totp/confirm", func(c echo.Context) error {
+		type ConfirmParams struct {
+			Code string `json:"code"`
+		}
+
+		user, err := AuthUser(c)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		var params ConfirmParams
+		if err := c.Bind(&params); err != nil || params.Code == "" {
 			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
 		}
 
-		cities, err := s.CityService.FindCities(c.Request().Context(), fil)
+		totp, err := s.MFAService.FindTOTPByUserID(c.Request().Context(), user.ID)
 		if err != nil {
 			return ErrorResponseJSON(c, err, nil)
+		} else if totp.Confirmed() {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EEXISTS, "autenticazione a due fattori già attiva"), nil)
 		}
 
-		switch len(cities) {
-		case 0:
-			return ErrorResponseJSON(c, apperr.Errorf(apperr.ENOTFOUND, "nessuna città corrispondente"), nil)
-		case 1:
-			return SuccessResponseJSON(c, http.StatusOK, echo.Map{
-				"city": cities[0],
-			})
-		default:
-			return SuccessResponseJSON(c, http.StatusOK, echo.Map{
-				"cities": cities,
-			})
+		if err := s.throttleCode(c.Request().Context(), user, c.RealIP(), func() error {
+			return s.verifyTOTP(c.Request().Context(), totp, params.Code)
+		}); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		if err := s.MFAService.ConfirmTOTP(c.Request().Context(), user.ID); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		codes, err := s.MFAService.ReplaceRecoveryCodes(c.Request().Context(), user.ID)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
 		}
+
+		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+			"recovery_codes": codes,
+		})
+	}, s.AuthMiddleware, s.RequirePermission(entity.PermissionAccountManage), s.DenyImpersonation)
+
+	g.POST("/totp/disable", func(c echo.Context) error {
+		type DisableParams struct {
+			Code string `json:"code"`
+		}
+
+		user, err := AuthUser(c)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		var params DisableParams
+		if err := c.Bind(&params); err != nil || params.Code == "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		if err := s.throttleCode(c.Request().Context(), user, c.RealIP(), func() error {
+			return s.verifySecondFactor(c.Request().Context(), user.ID, params.Code)
+		}); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		if err := s.MFAService.DeleteTOTP(c.Request().Context(), user.ID); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		// whoever stole the second factor is logged out, as after a password change.
+		if err := s.revokeUserTokens(c.Request().Context(), user.ID); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}, s.AuthMiddleware, s.RequirePermission(entity.PermissionAccountManage), s.DenyImpersonation)
+
+	g.POST("/recovery-codes", func(c echo.Context) error {
+		type RecoveryCodesParams struct {
+			Code string `json:"code"`
+		}
+
+		user, err := AuthUser(c)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		var params RecoveryCodesParams
+		if err := c.Bind(&params); err != nil || params.Code == "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		totp, err := s.MFAService.FindTOTPByUserID(c.Request().Context(), user.ID)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		} else if !totp.Confirmed() {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.ENOTFOUND, "autenticazione a due fattori non configurata"), nil)
+		}
+
+		// new codes require the authenticator app, not one of the codes being replaced.
+		if err := s.throttleCode(c.Request().Context(), user, c.RealIP(), func() error {
+			return s.verifyTOTP(c.Request().Context(), totp, params.Code)
+		}); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		codes, err := s.MFAService.ReplaceRecoveryCodes(c.Request().Context(), user.ID)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+			"recovery_codes": codes,
+		})
+	}, s.AuthMiddleware, s.RequirePermission(entity.PermissionAccountManage), s.DenyImpersonation)
+}
+
+// registerSessionRoutes registers all routes for the API group sessions.
+func (s *ServerAPI) registerSessionRoutes(g *echo.Group) {
+	g.GET("", func(c echo.Context) error {
+		type SessionResponse struct {
+			*entity.Session
+			Current bool `json:"current"`
+		}
+
+		claims, err := AuthClaims(c)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		user, err := AuthUser(c)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		sessions, err := s.SessionService.FindSessions(c.Request().Context(), service.SessionFilter{UserID: &user.ID, Active: true})
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		response := make([]SessionResponse, len(sessions))
+		for i, session := range sessions {
+			response[i] = SessionResponse{Session: session, Current: session.ID == claims.SessionID}
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+			"sessions": response,
+		})
+	})
+
+	g.DELETE("/:id", func(c echo.Context) error {
+
+		user, err := AuthUser(c)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		// the sessions of other users are reported as not found, not to disclose their ids.
+		session, err := s.SessionService.FindSessionByID(c.Request().Context(), c.Param("id"))
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		} else if session.UserID != user.ID {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.ENOTFOUND, "sessione non trovata"), nil)
+		}
+
+		if err := s.revokeSession(c.Request().Context(), session); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}, s.DenyImpersonation)
+
+	// log out everywhere, the current session included.
+	g.DELETE("", func(c echo.Context) error {
+
+		user, err := AuthUser(c)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		if err := s.revokeSessions(c.Request().Context(), user.ID); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}, s.DenyImpersonation)
+}
+
+// registerOIDCRoutes registers all routes for the API group oidc, the login through
+// the OpenID Connect identity provider with the authorization code flow.
+func (s *ServerAPI) registerOIDCRoutes(g *echo.Group) {
+	g.GET("/login", func(c echo.Context) error {
+
+		if s.OIDCProvider == nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.ENOTIMPLEMENTED, "login OIDC non configurato"), nil)
+		}
+
+		login, err := entity.NewOIDCLogin()
+		if err != nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINTERNAL, "failed to create oidc login: %v", err), nil)
+		}
+
+		if err := s.OIDCLoginService.CreateOIDCLogin(c.Request().Context(), login); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		authURL, err := s.OIDCProvider.AuthCodeURL(c.Request().Context(), login)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return c.Redirect(http.StatusFound, authURL)
+	})
+
+	g.GET("/callback", func(c echo.Context) error {
+
+		if s.OIDCProvider == nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.ENOTIMPLEMENTED, "login OIDC non configurato"), nil)
+		}
+
+		if e := c.QueryParam("error"); e != "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EUNAUTHORIZED, "login rifiutato dal provider: %s", e), nil)
+		}
+
+		state, code := c.QueryParam("state"), c.QueryParam("code")
+		if state == "" || code == "" {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		// the state binds the callback to a login started here, preventing CSRF.
+		login, err := s.OIDCLoginService.ConsumeOIDCLogin(c.Request().Context(), state)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		identity, err := s.OIDCProvider.ExchangeCode(c.Request().Context(), login, code)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		user, err := s.federatedUser(c.Request().Context(), identity)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return s.loginResponse(c, user, nil)
+	})
+}
+
+// registerCityRoutes registers all routes for the API group city.
+func (s *ServerAPI) registerCityRoutes(g *echo.Group) {
+	g.POST("", func(c echo.Context) error {
+		var city entity.City
+		if err := c.Bind(&city); err != nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		if err := s.CityService.CreateCity(c.Request().Context(), &city); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+			"city": city,
+		})
+	}, s.RequirePermission(entity.PermissionCitiesWrite))
+
+	g.GET("/:name", func(c echo.Context) error {
+		cityName := c.Param("name")
+		cityFilter := service.CityFilter{Name: &cityName}
+		cities, err := s.CityService.FindCities(c.Request().Context(), cityFilter)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		if len(cities) == 0 {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.ENOTFOUND, "Città non trovata"), nil)
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+			"city": cities[0],
+		})
+	}, s.RequirePermission(entity.PermissionCitiesRead))
+
+	g.DELETE("/:name", func(c echo.Context) error {
+
+		id, err := s.CityService.FindIdByName(c.Request().Context(), c.Param("name"))
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		if err := s.CityService.DeleteCity(c.Request().Context(), *id); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+			"città eliminata correttamente con id = ": id,
+		})
+	}, s.RequirePermission(entity.PermissionCitiesDelete))
+
+	g.PATCH("/:name", func(c echo.Context) error {
+
+		id, err := s.CityService.FindIdByName(c.Request().Context(), c.Param("name"))
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		var upd service.CityUpdate
+		if err := c.Bind(&upd); err != nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		if err := s.CityService.UpdateCity(c.Request().Context(), *id, upd); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		cities, err := s.CityService.FindCities(c.Request().Context(), service.CityFilter{Id: id})
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+			"city": cities[0],
+		})
+	}, s.RequirePermission(entity.PermissionCitiesWrite))
+
+	g.POST("/search", func(c echo.Context) error {
+
+		var fil service.CityFilter
+		if err := c.Bind(&fil); err != nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		cities, err := s.CityService.FindCities(c.Request().Context(), fil)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		switch len(cities) {
+		case 0:
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.ENOTFOUND, "nessuna città corrispondente"), nil)
+		case 1:
+			return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+				"city": cities[0],
+			})
+		default:
+			return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+				"cities": cities,
+			})
+		}
+	}, s.RequirePermission(entity.PermissionCitiesRead))
+}
+
+// authenticate returns the user with the given credentials.
+// Failed attempts are tracked by the LoginThrottleService, which may reject the
+// attempt before the credentials are even checked.
+func (s *ServerAPI) authenticate(c echo.Context, username string, password string) (*entity.User, error) {
+
+	ctx, ip := c.Request().Context(), c.RealIP()
+
+	if err := s.LoginThrottleService.Check(ctx, username, ip); err != nil {
+		return nil, err
+	}
+
+	user, err := s.UserService.FindUserByUsername(ctx, username)
+	if err != nil && apperr.ErrorCode(err) != apperr.ENOTFOUND {
+		return nil, err
+	}
+
+	match := false
+	rehash := false
+
+	// a password is compared even if the user does not exist, otherwise the time
+	// taken by the response would tell the existing usernames apart.
+	hash, err := s.dummyPasswordHash(ctx)
+	if err != nil {
+		return nil, err
+	} else if user != nil {
+		hash = user.PasswordHash
+	}
+
+	if match, rehash, err = s.PasswordService.Compare(ctx, password, hash); err != nil {
+		return nil, err
+	}
+	match = match && user != nil
+
+	// nota: non distinguiamo tra utente inesistente e password errata, meglio essere generici
+	// con la restituzione di errore per un login non autorizzato
+	if !match {
+		if err := s.LoginThrottleService.RecordFailure(ctx, username, ip); err != nil {
+			return nil, err
+		}
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "username e/o password invalidi")
+	}
+
+	if err := s.LoginThrottleService.RecordSuccess(ctx, username, ip); err != nil {
+		return nil, err
+	}
+
+	// the stored hash uses outdated parameters: now that we know the plaintext
+	// password we can replace it, a failure here must not prevent the login.
+	if rehash {
+		if hash, err := s.PasswordService.Hash(ctx, password); err != nil {
+			c.Logger().Errorf("failed to rehash password for user %d: %v", user.ID, err)
+		} else if err := s.UserService.UpdateUser(ctx, user.ID, service.UserUpdate{PasswordHash: &hash}); err != nil {
+			c.Logger().Errorf("failed to update password hash for user %d: %v", user.ID, err)
+		}
+	}
+
+	return user, nil
+}
+
+// dummyPasswordHash returns the hash compared with the password of the logins of unknown users.
+// It is computed once by the PasswordService, so that comparing it costs as much as comparing
+// the hash of an actual user.
+func (s *ServerAPI) dummyPasswordHash(ctx context.Context) (string, error) {
+
+	s.dummyHashOnce.Do(func() {
+		s.dummyHash, s.dummyHashErr = s.PasswordService.Hash(ctx, "dummy password")
+	})
+
+	return s.dummyHash, s.dummyHashErr
+}
+
+// loginResponse returns the token pair of the user who has just logged in, limited to the scope if not nil.
+// Users with a second factor only get a challenge, which must be exchanged
+// together with a code at /v1/auth/mfa/verify.
+func (s *ServerAPI) loginResponse(c echo.Context, user *entity.User, scope []entity.Permission) error {
+
+	if required, err := s.mfaRequired(c.Request().Context(), user.ID); err != nil {
+		return ErrorResponseJSON(c, err, nil)
+	} else if required {
+		mfaToken, err := s.JWTService.IssueMFAChallenge(c.Request().Context(), user, scope)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int64(entity.MFAChallengeExpiration.Seconds()),
+		})
+	}
+
+	scope, err := s.scopeWithoutMFA(user, scope)
+	if err != nil {
+		return ErrorResponseJSON(c, err, nil)
+	}
+
+	token, err := s.JWTService.Exchange(c.Request().Context(), user, scope)
+	if err != nil {
+		return ErrorResponseJSON(c, err, nil)
+	}
+
+	return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+		"token": token,
+	})
+}
+
+// scopeWithoutMFA returns the scope of the tokens of a user logging in without a second factor,
+// limited to the requested one if not nil: the permissions in MFARequiredPermissions are withheld.
+// Returns EFORBIDDEN if only withheld permissions have been requested.
+func (s *ServerAPI) scopeWithoutMFA(user *entity.User, scope []entity.Permission) ([]entity.Permission, error) {
+
+	requested := scope
+	if requested == nil {
+		requested = entity.Permissions(user.Roles)
+	}
+
+	var allowed, withheld []entity.Permission
+	for _, permission := range requested {
+		if s.mfaRequiredFor(permission) {
+			withheld = append(withheld, permission)
+		} else {
+			allowed = append(allowed, permission)
+		}
+	}
+
+	if len(withheld) == 0 {
+		return scope, nil
+	} else if len(allowed) == 0 {
+		return nil, apperr.Errorf(apperr.EFORBIDDEN, "configura l'autenticazione a due fattori per ottenere i permessi %s", entity.FormatScope(withheld))
+	}
+
+	return allowed, nil
+}
+
+// mfaRequiredFor reports whether the permission is granted only to the users with a second factor.
+func (s *ServerAPI) mfaRequiredFor(permission entity.Permission) bool {
+	for _, p := range s.MFARequiredPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// federatedUser returns the user the identity logs in as.
+// An identity logging in for the first time is linked to the user with the same verified email
+// if OIDCEmailLinking is enabled, otherwise a new user is created if OIDCProvisioning is enabled.
+// An identity whose email has been verified by a user it can't be linked to is refused, rather
+// than provisioning a second user with the same email. The users who haven't verified their
+// email, e.g. the self-registered ones, are ignored: anyone could have registered with it.
+func (s *ServerAPI) federatedUser(ctx context.Context, identity *entity.Identity) (*entity.User, error) {
+
+	if linked, err := s.IdentityService.FindIdentity(ctx, identity.Issuer, identity.Subject); err == nil {
+		user, err := s.UserService.FindUserByID(ctx, linked.UserID)
+		if apperr.ErrorCode(err) == apperr.ENOTFOUND {
+			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "user no longer exists")
+		}
+		return user, err
+	} else if apperr.ErrorCode(err) != apperr.ENOTFOUND {
+		return nil, err
+	}
+
+	var user *entity.User
+
+	if identity.Email != "" && identity.EmailVerified {
+		users, err := s.UserService.FindUsers(ctx, service.UserFilter{Email: &identity.Email, EmailVerified: true})
+		if err != nil {
+			return nil, err
+		} else if len(users) == 1 && s.OIDCEmailLinking && !users[0].Privileged() {
+			user = users[0]
+		} else if len(users) > 0 {
+			// an administrator taking over the email at the provider must not get the account.
+			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "l'email è già associata a un utente, accedi con la password")
+		}
+	}
+
+	if user == nil {
+		if !s.OIDCProvisioning {
+			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "nessun utente associato a questa identità")
+		}
+
+		var err error
+		if user, err = s.provisionUser(ctx, identity); err != nil {
+			return nil, err
+		}
+	}
+
+	identity.UserID = user.ID
+
+	if err := s.IdentityService.CreateIdentity(ctx, identity); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// provisionUser creates a viewer for the identity. The user has a random password,
+// it can set its own with the password reset.
+func (s *ServerAPI) provisionUser(ctx context.Context, identity *entity.Identity) (*entity.User, error) {
+
+	username := identity.PreferredUsername
+	if username == "" {
+		username = identity.Email
+	}
+	if username == "" {
+		username = identity.Subject
+	}
+
+	name := identity.Name
+	if name == "" {
+		name = username
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to generate password: %v", err)
+	}
+
+	hash, err := s.PasswordService.Hash(ctx, base64.RawURLEncoding.EncodeToString(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	email := ""
+	if identity.EmailVerified {
+		email = identity.Email
+	}
+
+	user := &entity.User{
+		Username:      username,
+		Name:          name,
+		Email:         email,
+		EmailVerified: email != "",
+		PasswordHash:  hash,
+		Roles:         []entity.Role{entity.RoleViewer},
+	}
+
+	if err := s.UserService.CreateUser(ctx, user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// mfaRequired reports whether the user has a confirmed second factor.
+func (s *ServerAPI) mfaRequired(ctx context.Context, userID int64) (bool, error) {
+
+	totp, err := s.MFAService.FindTOTPByUserID(ctx, userID)
+	if apperr.ErrorCode(err) == apperr.ENOTFOUND {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return totp.Confirmed(), nil
+}
+
+// verifySecondFactor checks a code of the authenticator app or a recovery code of the user.
+// Returns EUNAUTHORIZED if the code is not valid.
+func (s *ServerAPI) verifySecondFactor(ctx context.Context, userID int64, code string) error {
+
+	totp, err := s.MFAService.FindTOTPByUserID(ctx, userID)
+	if apperr.ErrorCode(err) == apperr.ENOTFOUND {
+		return apperr.Errorf(apperr.EUNAUTHORIZED, "autenticazione a due fattori non configurata")
+	} else if err != nil {
+		return err
+	} else if !totp.Confirmed() {
+		return apperr.Errorf(apperr.EUNAUTHORIZED, "autenticazione a due fattori non configurata")
+	}
+
+	// codes of the app are only digits, recovery codes always contain letters.
+	if strings.Trim(code, "0123456789") == "" {
+		return s.verifyTOTP(ctx, totp, code)
+	}
+
+	return s.MFAService.ConsumeRecoveryCode(ctx, userID, code)
+}
+
+// throttleCode runs verify, which checks a second factor code of the user. Wrong codes count
+// as failed logins of the user, so that codes can't be guessed from any of the routes
+// accepting them.
+func (s *ServerAPI) throttleCode(ctx context.Context, user *entity.User, ip string, verify func() error) error {
+
+	if err := s.LoginThrottleService.Check(ctx, user.Username, ip); err != nil {
+		return err
+	}
+
+	if err := verify(); apperr.ErrorCode(err) == apperr.EUNAUTHORIZED {
+		if err := s.LoginThrottleService.RecordFailure(ctx, user.Username, ip); err != nil {
+			return err
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	return s.LoginThrottleService.RecordSuccess(ctx, user.Username, ip)
+}
+
+// verifyTOTP checks a code of the authenticator app, a code is accepted only once.
+// Returns EUNAUTHORIZED if the code is not valid.
+func (s *ServerAPI) verifyTOTP(ctx context.Context, totp *entity.TOTP, code string) error {
+
+	counter, ok, err := s.TOTPService.Validate(ctx, totp.Secret, code)
+	if err != nil {
+		return err
+	} else if !ok {
+		return apperr.Errorf(apperr.EUNAUTHORIZED, "codice non valido")
+	}
+
+	return s.MFAService.UseTOTPCounter(ctx, totp.UserID, counter)
+}
+
+// revokeSession revokes the session and blacklists its id, so that all of its tokens are rejected.
+func (s *ServerAPI) revokeSession(ctx context.Context, session *entity.Session) error {
+
+	if err := s.SessionService.RevokeSession(ctx, session.ID); err != nil {
+		return err
+	}
+
+	// no token of the session outlives its last refresh token.
+	return s.JWTBlacklistService.Invalidate(ctx, session.ID, s.JWTService.RevocationTTL(session.ExpiresAt))
+}
+
+// revokeSessions revokes all the active sessions of the user.
+func (s *ServerAPI) revokeSessions(ctx context.Context, userID int64) error {
+
+	sessions, err := s.SessionService.FindSessions(ctx, service.SessionFilter{UserID: &userID, Active: true})
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if err := s.revokeSession(ctx, session); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendPasswordResets sends a password reset to each of the users, errors are only logged
+// since nobody is waiting for them.
+func (s *ServerAPI) sendPasswordResets(users entity.Users) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), PasswordResetTimeout)
+	defer cancel()
+
+	for _, user := range users {
+		if err := s.sendPasswordReset(ctx, user); err != nil {
+			s.handler.Logger.Errorf("failed to send password reset to user %d: %v", user.ID, err)
+		}
+	}
+}
+
+// sendPasswordReset creates a password reset token for the user and mails it.
+func (s *ServerAPI) sendPasswordReset(ctx context.Context, user *entity.User) error {
+
+	if user.Email == "" {
+		return nil
+	}
+
+	token, err := s.PasswordResetService.CreatePasswordReset(ctx, user.ID, entity.PasswordResetExpiration)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Ciao %s,\n\nper impostare una nuova password usa questo codice entro %v:\n\n%s\n",
+		user.Name, entity.PasswordResetExpiration, token)
+
+	if s.PasswordResetURL != "" {
+		body = fmt.Sprintf("Ciao %s,\n\nper impostare una nuova password apri questo link entro %v:\n\n%s?token=%s\n",
+			user.Name, entity.PasswordResetExpiration, s.PasswordResetURL, url.QueryEscape(token))
+	}
+
+	body += "\nSe non hai richiesto il reset della password ignora questa email.\n"
+
+	return s.Mailer.Send(ctx, &entity.Mail{
+		To:      user.Email,
+		Subject: "Reset della password",
+		Body:    body,
+	})
+}
+
+// validatePassword checks the password chosen by the user against the password policy.
+// The rules it violates are returned as the details of the EINVALID error.
+func (s *ServerAPI) validatePassword(ctx context.Context, password string, user *entity.User) (details interface{}, err error) {
+
+	if s.PasswordPolicyService == nil {
+		return nil, nil
+	}
+
+	violations, err := s.PasswordPolicyService.Validate(ctx, password, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(violations) > 0 {
+		return echo.Map{"violations": violations}, apperr.Errorf(apperr.EINVALID, "la password non rispetta i requisiti")
+	}
+
+	return nil, nil
+}
+
+// setPassword hashes the password and sets it as the password of the user.
+// All the sessions and refresh tokens of the user are revoked, the current one included,
+// so that whoever knew the previous password is logged out.
+func (s *ServerAPI) setPassword(ctx context.Context, userID int64, password string) error {
+
+	hash, err := s.PasswordService.Hash(ctx, password)
+	if err != nil {
+		return err
+	}
+
+	if err := s.UserService.UpdateUser(ctx, userID, service.UserUpdate{PasswordHash: &hash}); err != nil {
+		return err
+	}
+
+	return s.revokeUserTokens(ctx, userID)
+}
+
+// revokeUserTokens revokes all the refresh tokens and sessions of the user, the current one included.
+func (s *ServerAPI) revokeUserTokens(ctx context.Context, userID int64) error {
+
+	if err := s.RefreshTokenService.RevokeRefreshTokens(ctx, userID); err != nil {
+		return err
+	}
+
+	return s.revokeSessions(ctx, userID)
+}
+
+// registerAdminRoutes registers all routes for the API group admin.
+func (s *ServerAPI) registerAdminRoutes(g *echo.Group) {
+	// registration responds with the registration setting, persistent is false if the
+	// setting only applies to the node serving the request and is lost on restart.
+	registration := func(c echo.Context) error {
+		enabled, err := s.RegistrationEnabled(c.Request().Context())
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+			"enabled":    enabled,
+			"persistent": s.SettingService != nil,
+		})
+	}
+
+	g.GET("/registration", registration)
+
+	g.PUT("/registration", func(c echo.Context) error {
+		type RegistrationParams struct {
+			Enabled *bool `json:"enabled"`
+		}
+
+		var params RegistrationParams
+		if err := c.Bind(&params); err != nil || params.Enabled == nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		if err := s.UpdateRegistrationEnabled(c.Request().Context(), *params.Enabled); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return registration(c)
+	})
+
+	g.POST("/users/:id/unlock", func(c echo.Context) error {
+
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "id non valido"), nil)
+		}
+
+		user, err := s.UserService.FindUserByID(c.Request().Context(), id)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		if err := s.LoginThrottleService.Unlock(c.Request().Context(), user.Username); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	g.POST("/users/:id/impersonate", func(c echo.Context) error {
+		type ImpersonateParams struct {
+			// Reason is written in the log along with the start of the impersonation.
+			Reason string `json:"reason"`
+		}
+
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "id non valido"), nil)
+		}
+
+		var params ImpersonateParams
+		if err := c.Bind(&params); err != nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		admin, err := AuthUser(c)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		if admin.ID == id {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "non puoi impersonare te stesso"), nil)
+		}
+
+		user, err := s.UserService.FindUserByID(c.Request().Context(), id)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		// acting as another admin would hand over the control of the other accounts.
+		if user.Privileged() {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EFORBIDDEN, "non puoi impersonare un amministratore"), nil)
+		}
+
+		token, err := s.JWTService.Impersonate(c.Request().Context(), admin, user)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		c.Logger().Printf("impersonation: admin %d (%s) started acting as user %d (%s) from %s, reason: %q",
+			admin.ID, admin.Username, user.ID, user.Username, c.RealIP(), params.Reason)
+
+		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+			"token": token,
+		})
+	})
+}
+
+// registerAPIKeyRoutes registers all routes for the API group apikeys.
+func (s *ServerAPI) registerAPIKeyRoutes(g *echo.Group) {
+	g.POST("", func(c echo.Context) error {
+		type APIKeyParams struct {
+			Name   string              `json:"name"`
+			Scopes []entity.Permission `json:"scopes"`
+		}
+
+		var params APIKeyParams
+		if err := c.Bind(&params); err != nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "invalid request"), nil)
+		}
+
+		// a caller can't create a key more powerful than itself.
+		for _, scope := range params.Scopes {
+			if scope.Valid() && !grantsPermission(c, scope) {
+				return ErrorResponseJSON(c, apperr.Errorf(apperr.EFORBIDDEN, "non puoi concedere lo scope %s", scope), nil)
+			}
+		}
+
+		apiKey := entity.APIKey{
+			Name:   params.Name,
+			Scopes: params.Scopes,
+		}
+
+		key, err := s.APIKeyService.CreateAPIKey(c.Request().Context(), &apiKey)
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		// the key is returned only now, it can't be retrieved again.
+		return SuccessResponseJSON(c, http.StatusCreated, echo.Map{
+			"api_key": apiKey,
+			"key":     key,
+		})
+	})
+
+	g.GET("", func(c echo.Context) error {
+
+		apiKeys, err := s.APIKeyService.FindAPIKeys(c.Request().Context(), service.APIKeyFilter{})
+		if err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return SuccessResponseJSON(c, http.StatusOK, echo.Map{
+			"api_keys": apiKeys,
+		})
+	})
+
+	g.DELETE("/:id", func(c echo.Context) error {
+
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return ErrorResponseJSON(c, apperr.Errorf(apperr.EINVALID, "id non valido"), nil)
+		}
+
+		if err := s.APIKeyService.RevokeAPIKey(c.Request().Context(), id); err != nil {
+			return ErrorResponseJSON(c, err, nil)
+		}
+
+		return c.NoContent(http.StatusNoContent)
 	})
 }
 
@@ -0,0 +1,1124 @@
+package http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"mysql/inmem"
+	"mysql/jwt"
+	"mysql/password"
+	"mysql/token"
+	"mysql/totp"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gojwt "github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+)
+
+// newTestServer returns a server issuing HS256 tokens, backed by in-memory services.
+func newTestServer(t *testing.T) *ServerAPI {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	passwordService := password.NewPasswordService()
+	passwordService.Params = password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+	refreshTokenService := &refreshTokenService{}
+	userService := &userService{}
+	sessionService := &sessionService{}
+	jwtBlacklistService := inmem.NewJWTBlacklistService(ctx, inmem.DefaultSweepInterval)
+
+	jwtService := jwt.NewJWTService("secret")
+	jwtService.RefreshTokenService = refreshTokenService
+	jwtService.UserService = userService
+	jwtService.SessionService = sessionService
+	jwtService.JWTBlacklistService = jwtBlacklistService
+
+	s := NewServerAPI()
+	s.JWTService = jwtService
+	s.JWTBlacklistService = jwtBlacklistService
+	s.LoginThrottleService = inmem.NewLoginThrottleService(ctx, inmem.DefaultSweepInterval)
+	s.RefreshTokenService = refreshTokenService
+	s.MFAService = &mfaService{}
+	s.APIKeyService = &apiKeyService{}
+	s.UserService = userService
+	s.SessionService = sessionService
+	s.CityService = &cityService{}
+	s.TOTPService = totp.NewTOTPService("test")
+	s.PasswordService = passwordService
+	s.PasswordResetService = &passwordResetService{}
+	s.Mailer = make(mailer, 10)
+
+	return s
+}
+
+// createUser stores a user with the given password and roles.
+func createUser(t *testing.T, s *ServerAPI, username string, pass string, roles ...entity.Role) *entity.User {
+	t.Helper()
+
+	hash, err := s.PasswordService.Hash(context.Background(), pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &entity.User{Username: username, Name: username, Email: username + "@example.com", PasswordHash: hash, Roles: roles}
+	if err := s.UserService.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// accessToken returns an access token of the user with the given scope, empty for an unrestricted token.
+func accessToken(t *testing.T, s *ServerAPI, user *entity.User, scope string) string {
+	t.Helper()
+
+	claims := entity.NewAppClaims(user, entity.AccessTokenUse, time.Hour)
+	claims.Scope = scope
+
+	token, err := s.JWTService.(*jwt.JWTService).Codec.Encode(context.Background(), claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// serve sends the request to the server, body is encoded as JSON if not nil.
+func serve(s *ServerAPI, method string, path string, body interface{}, header http.Header) *httptest.ResponseRecorder {
+
+	var data string
+	if body != nil {
+		b, _ := json.Marshal(body)
+		data = string(b)
+	}
+
+	req := httptest.NewRequest(method, path, strings.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	for k, values := range header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// serveForm sends a POST request to the server with the form encoded body.
+func serveForm(s *ServerAPI, path string, form url.Values, header http.Header) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	for k, values := range header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// bearer returns the header authenticating a request with the token.
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func TestCreateAPIKey_Scopes(t *testing.T) {
+	s := newTestServer(t)
+
+	admin := &entity.User{ID: 1, Username: "admin", Roles: []entity.Role{entity.RoleAdmin}}
+
+	// a client allowed to manage keys, but only to read cities.
+	if _, err := s.APIKeyService.CreateAPIKey(context.Background(), &entity.APIKey{
+		Name:   "manager",
+		Scopes: []entity.Permission{entity.PermissionAPIKeysManage, entity.PermissionCitiesRead},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		scopes []entity.Permission
+		status int
+	}{
+		{
+			name:   "admin",
+			header: bearer(accessToken(t, s, admin, "")),
+			scopes: []entity.Permission{entity.PermissionCitiesDelete, entity.PermissionUsersManage},
+			status: http.StatusCreated,
+		},
+		{
+			name:   "admin token without the scope",
+			header: bearer(accessToken(t, s, admin, "apikeys:manage cities:read")),
+			scopes: []entity.Permission{entity.PermissionCitiesDelete},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "admin token with the scope",
+			header: bearer(accessToken(t, s, admin, "apikeys:manage cities:delete")),
+			scopes: []entity.Permission{entity.PermissionCitiesDelete},
+			status: http.StatusCreated,
+		},
+		{
+			name:   "api key with the scope",
+			header: http.Header{APIKeyHeader: {"manager"}},
+			scopes: []entity.Permission{entity.PermissionCitiesRead},
+			status: http.StatusCreated,
+		},
+		{
+			name:   "api key without the scope",
+			header: http.Header{APIKeyHeader: {"manager"}},
+			scopes: []entity.Permission{entity.PermissionCitiesRead, entity.PermissionCitiesWrite},
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(s, http.MethodPost, "/v1/apikeys", map[string]interface{}{
+				"name":   tt.name,
+				"scopes": tt.scopes,
+			}, tt.header)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestPasswordChange_RevokesSessions(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	user := createUser(t, s, "mario", "Vecchia-password-1", entity.RoleViewer)
+
+	session := &entity.Session{ID: "session", UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := s.SessionService.CreateSession(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(s, http.MethodPost, "/v1/auth/password/change", map[string]string{
+		"current_password": "Vecchia-password-1",
+		"new_password":     "Nuova-password-2",
+	}, bearer(accessToken(t, s, user, "")))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+
+	if sessions, err := s.SessionService.FindSessions(ctx, service.SessionFilter{UserID: &user.ID, Active: true}); err != nil {
+		t.Fatal(err)
+	} else if len(sessions) != 0 {
+		t.Fatalf("expected no active session, got %d", len(sessions))
+	}
+
+	if blacklisted, err := s.JWTBlacklistService.IsBlacklisted(ctx, session.ID); err != nil {
+		t.Fatal(err)
+	} else if !blacklisted {
+		t.Fatal("expected the tokens of the session to be revoked")
+	}
+
+	if revoked := s.RefreshTokenService.(*refreshTokenService).revoked; len(revoked) != 1 || revoked[0] != user.ID {
+		t.Fatalf("expected the refresh tokens of the user to be revoked, got %v", revoked)
+	}
+}
+
+func TestAccountRoutes_Scope(t *testing.T) {
+	s := newTestServer(t)
+
+	user := createUser(t, s, "mario", "Password-segreta-1", entity.RoleViewer)
+
+	for _, tt := range []struct {
+		scope string
+		code  int
+	}{
+		// tokens without a scope are limited only by the roles.
+		{scope: "", code: http.StatusNoContent},
+		{scope: entity.FormatScope(entity.RoleViewer.Permissions()), code: http.StatusNoContent},
+		{scope: string(entity.PermissionAccountManage), code: http.StatusNoContent},
+		{scope: string(entity.PermissionCitiesRead), code: http.StatusForbidden},
+	} {
+		t.Run(tt.scope, func(t *testing.T) {
+			rec := serve(s, http.MethodDelete, "/v1/auth/sessions", nil, bearer(accessToken(t, s, user, tt.scope)))
+			if rec.Code != tt.code {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.code, rec.Body)
+			}
+		})
+	}
+
+	// the other account routes are gated as well.
+	token := accessToken(t, s, user, string(entity.PermissionCitiesRead))
+	for _, path := range []string{
+		"/v1/auth/sessions",
+		"/v1/auth/password/change",
+		"/v1/auth/mfa/totp",
+		"/v1/auth/mfa/totp/disable",
+		"/v1/auth/mfa/recovery-codes",
+	} {
+		method := http.MethodPost
+		if path == "/v1/auth/sessions" {
+			method = http.MethodGet
+		}
+
+		rec := serve(s, method, path, nil, bearer(token))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s: status = %d, want %d: %s", method, path, rec.Code, http.StatusForbidden, rec.Body)
+		}
+	}
+}
+
+func TestPasswordForgot(t *testing.T) {
+	s := newTestServer(t)
+
+	user := createUser(t, s, "mario", "Password-segreta-1", entity.RoleViewer)
+
+	unknown := serve(s, http.MethodPost, "/v1/auth/password/forgot", map[string]string{"email": "nessuno@example.com"}, nil)
+	known := serve(s, http.MethodPost, "/v1/auth/password/forgot", map[string]string{"email": user.Email}, nil)
+
+	// the responses must not tell the registered emails apart.
+	if unknown.Code != http.StatusAccepted || known.Code != http.StatusAccepted {
+		t.Fatalf("status = %d and %d, want %d", unknown.Code, known.Code, http.StatusAccepted)
+	} else if unknown.Body.String() != known.Body.String() {
+		t.Fatalf("responses differ: %s and %s", unknown.Body, known.Body)
+	}
+
+	select {
+	case mail := <-s.Mailer.(mailer):
+		if mail.To != user.Email {
+			t.Fatalf("mail sent to %s, want %s", mail.To, user.Email)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("password reset not sent")
+	}
+
+	select {
+	case mail := <-s.Mailer.(mailer):
+		t.Fatalf("unexpected mail sent to %s", mail.To)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// countingPasswordService counts the passwords compared.
+type countingPasswordService struct {
+	service.PasswordService
+	compared int
+}
+
+func (s *countingPasswordService) Compare(ctx context.Context, password string, hash string) (bool, bool, error) {
+	s.compared++
+	return s.PasswordService.Compare(ctx, password, hash)
+}
+
+func TestLogin_UnknownUser(t *testing.T) {
+	s := newTestServer(t)
+
+	createUser(t, s, "mario", "Password-segreta-1", entity.RoleViewer)
+
+	passwordService := &countingPasswordService{PasswordService: s.PasswordService}
+	s.PasswordService = passwordService
+
+	for _, username := range []string{"mario", "luigi"} {
+		rec := serve(s, http.MethodPost, "/v1/auth/login", map[string]string{
+			"username": username,
+			"password": "Password-sbagliata-1",
+		}, nil)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+		}
+	}
+
+	// the unknown user costs a comparison as well, against the dummy hash.
+	if passwordService.compared != 2 {
+		t.Fatalf("compared %d passwords, want 2", passwordService.compared)
+	}
+}
+
+func TestServerAPI_ClientIP(t *testing.T) {
+	s := newTestServer(t)
+
+	newRequest := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+		req.Header.Set(echo.HeaderXRealIP, "203.0.113.8")
+		return req
+	}
+
+	// the headers are ignored by default, they could be set by the client.
+	if ip := s.handler.IPExtractor(newRequest("198.51.100.1:1234")); ip != "198.51.100.1" {
+		t.Fatalf("IP = %s, want the address of the connection", ip)
+	}
+
+	_, proxy, _ := net.ParseCIDR("10.0.0.0/8")
+	s.SetTrustedProxies([]*net.IPNet{proxy})
+
+	if ip := s.handler.IPExtractor(newRequest("10.0.0.1:1234")); ip != "203.0.113.7" {
+		t.Fatalf("IP = %s, want the one forwarded by the proxy", ip)
+	}
+	if ip := s.handler.IPExtractor(newRequest("198.51.100.1:1234")); ip != "198.51.100.1" {
+		t.Fatalf("IP = %s, want the address of the untrusted connection", ip)
+	}
+}
+
+// login logs the user in with the password and returns the decoded response.
+func login(t *testing.T, s *ServerAPI, username string, pass string, scope string) map[string]interface{} {
+	t.Helper()
+
+	rec := serve(s, http.MethodPost, "/v1/auth/login", map[string]string{
+		"username": username,
+		"password": pass,
+		"scope":    scope,
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestLogin_MFARequiredPermissions(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	admin := createUser(t, s, "admin", "Password-segreta-1", entity.RoleAdmin)
+
+	// without a second factor the admin can log in, but not manage the users.
+	response := login(t, s, "admin", "Password-segreta-1", "")
+
+	token := response["token"].(map[string]interface{})
+	if scope := token["scope"].(string); strings.Contains(scope, string(entity.PermissionUsersManage)) {
+		t.Fatalf("scope = %q, want users:manage withheld", scope)
+	}
+
+	rec := serve(s, http.MethodGet, "/v1/admin/registration", nil, bearer(token["access_token"].(string)))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+
+	// asking only for the withheld permissions is refused.
+	rec = serve(s, http.MethodPost, "/v1/auth/login", map[string]string{
+		"username": "admin",
+		"password": "Password-segreta-1",
+		"scope":    string(entity.PermissionUsersManage),
+	}, nil)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+
+	// users without the permissions are not affected.
+	createUser(t, s, "mario", "Password-segreta-2", entity.RoleViewer)
+	if scope := login(t, s, "mario", "Password-segreta-2", "")["token"].(map[string]interface{})["scope"]; scope != entity.FormatScope(entity.RoleViewer.Permissions()) {
+		t.Fatalf("scope = %q, want all the permissions of the user", scope)
+	}
+
+	// with a confirmed second factor the admin gets a challenge instead.
+	if err := s.MFAService.CreateTOTP(ctx, &entity.TOTP{UserID: admin.ID, Secret: "JBSWY3DPEHPK3PXP"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.MFAService.ConfirmTOTP(ctx, admin.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := login(t, s, "admin", "Password-segreta-1", ""); response["mfa_required"] != true {
+		t.Fatalf("expected a mfa challenge, got %v", response)
+	}
+}
+
+func TestImpersonate(t *testing.T) {
+	s := newTestServer(t)
+
+	admin := createUser(t, s, "admin", "Password-segreta-1", entity.RoleAdmin)
+	other := createUser(t, s, "luigi", "Password-segreta-2", entity.RoleAdmin)
+	user := createUser(t, s, "mario", "Password-segreta-3", entity.RoleEditor)
+
+	impersonate := func(id int64) *httptest.ResponseRecorder {
+		return serve(s, http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/impersonate", id), map[string]string{
+			"reason": "supporto",
+		}, bearer(accessToken(t, s, admin, "")))
+	}
+
+	if rec := impersonate(user.ID); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	// the users that can manage the other accounts cannot be impersonated.
+	if rec := impersonate(other.ID); rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+
+	// impersonation tokens never reach the management routes, whatever the user.
+	claims := entity.NewAppClaims(other, entity.AccessTokenUse, entity.ImpersonationExpiration)
+	claims.Actor = &entity.Actor{Subject: fmt.Sprint(admin.ID), Username: admin.Username}
+
+	token, err := s.JWTService.(*jwt.JWTService).Codec.Encode(context.Background(), claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/v1/apikeys", "/v1/admin/registration"} {
+		rec := serve(s, http.MethodGet, path, nil, bearer(token))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("GET %s: status = %d, want %d: %s", path, rec.Code, http.StatusForbidden, rec.Body)
+		} else if !strings.Contains(rec.Body.String(), "impersonificazione") {
+			t.Errorf("GET %s: expected the impersonation to be denied, got %s", path, rec.Body)
+		}
+	}
+}
+
+// loginTokens logs the user in and returns its access and refresh tokens.
+func loginTokens(t *testing.T, s *ServerAPI, username string, pass string, scope string) (string, string) {
+	t.Helper()
+
+	token := login(t, s, username, pass, scope)["token"].(map[string]interface{})
+	return token["access_token"].(string), token["refresh_token"].(string)
+}
+
+func TestRefresh(t *testing.T) {
+	s := newTestServer(t)
+
+	createUser(t, s, "mario", "Password-segreta-1", entity.RoleEditor)
+	accessToken, refreshToken := loginTokens(t, s, "mario", "Password-segreta-1", string(entity.PermissionCitiesRead))
+
+	rec := serve(s, http.MethodPost, "/v1/auth/refresh", map[string]string{"refresh_token": refreshToken}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var response struct {
+		Token entity.Token `json:"token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	} else if response.Token.Scope != string(entity.PermissionCitiesRead) {
+		t.Fatalf("scope = %q, want %q", response.Token.Scope, entity.PermissionCitiesRead)
+	}
+
+	// the new access token carries the same scope.
+	if rec := serve(s, http.MethodGet, "/v1/auth/sessions", nil, bearer(response.Token.AccessToken)); rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+
+	for name, token := range map[string]string{
+		"reused refresh token": refreshToken,
+		"access token":         accessToken,
+		"malformed":            "not-a-token",
+	} {
+		rec := serve(s, http.MethodPost, "/v1/auth/refresh", map[string]string{"refresh_token": token}, nil)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want %d: %s", name, rec.Code, http.StatusUnauthorized, rec.Body)
+		}
+	}
+
+	// a refresh token can't be used as an access token.
+	if rec := serve(s, http.MethodGet, "/v1/auth/me", nil, bearer(response.Token.RefreshToken)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	s := newTestServer(t)
+
+	createUser(t, s, "mario", "Password-segreta-1", entity.RoleViewer)
+	accessToken, refreshToken := loginTokens(t, s, "mario", "Password-segreta-1", "")
+
+	// another session of the user is not affected.
+	otherToken, _ := loginTokens(t, s, "mario", "Password-segreta-1", "")
+
+	if rec := serve(s, http.MethodPost, "/v1/auth/logout", nil, bearer(accessToken)); rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+
+	if rec := serve(s, http.MethodGet, "/v1/auth/me", nil, bearer(accessToken)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("access token: status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+
+	if rec := serve(s, http.MethodPost, "/v1/auth/refresh", map[string]string{"refresh_token": refreshToken}, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh token: status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+
+	if rec := serve(s, http.MethodGet, "/v1/auth/me", nil, bearer(otherToken)); rec.Code != http.StatusOK {
+		t.Fatalf("other session: status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	// logging out twice is refused, the token is no longer valid.
+	if rec := serve(s, http.MethodPost, "/v1/auth/logout", nil, bearer(accessToken)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+}
+
+func TestLogout_Unauthenticated(t *testing.T) {
+	s := newTestServer(t)
+
+	for name, header := range map[string]http.Header{
+		"no token":      nil,
+		"invalid token": bearer("not-a-token"),
+	} {
+		if rec := serve(s, http.MethodPost, "/v1/auth/logout", nil, header); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want %d: %s", name, rec.Code, http.StatusUnauthorized, rec.Body)
+		}
+	}
+}
+
+func TestAuthMiddleware_PublicRoutes(t *testing.T) {
+	s := newTestServer(t)
+
+	if err := s.CityService.CreateCity(context.Background(), &entity.City{Name: "roma", Population: 2800000}); err != nil {
+		t.Fatal(err)
+	}
+
+	editor := createUser(t, s, "mario", "Password-segreta-1", entity.RoleEditor)
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		header http.Header
+		code   int
+	}{
+		{name: "anonymous read", method: http.MethodGet, path: "/v1/city/roma", code: http.StatusOK},
+		{name: "anonymous search", method: http.MethodPost, path: "/v1/city/search", body: map[string]string{"name": "roma"}, code: http.StatusOK},
+		{name: "anonymous create", method: http.MethodPost, path: "/v1/city", body: map[string]interface{}{"name": "milano"}, code: http.StatusUnauthorized},
+		{name: "anonymous update", method: http.MethodPatch, path: "/v1/city/roma", body: map[string]int{"population": 1}, code: http.StatusUnauthorized},
+		{name: "anonymous delete", method: http.MethodDelete, path: "/v1/city/roma", code: http.StatusUnauthorized},
+		// a token is never ignored, not even on the public routes.
+		{name: "invalid token on a public route", method: http.MethodGet, path: "/v1/city/roma", header: bearer("not-a-token"), code: http.StatusUnauthorized},
+		{name: "invalid API key on a public route", method: http.MethodGet, path: "/v1/city/roma", header: http.Header{APIKeyHeader: {"unknown"}}, code: http.StatusUnauthorized},
+		{name: "authenticated read", method: http.MethodGet, path: "/v1/city/roma", header: bearer(accessToken(t, s, editor, "")), code: http.StatusOK},
+		{name: "authenticated update", method: http.MethodPatch, path: "/v1/city/roma", body: map[string]int{"population": 2700000}, header: bearer(accessToken(t, s, editor, "")), code: http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := serve(s, tt.method, tt.path, tt.body, tt.header); rec.Code != tt.code {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.code, rec.Body)
+			}
+		})
+	}
+
+	// the rejected requests have not changed the city.
+	if cities, err := s.CityService.FindCities(context.Background(), service.CityFilter{}); err != nil {
+		t.Fatal(err)
+	} else if len(cities) != 1 || cities[0].Population != 2700000 {
+		t.Fatalf("unexpected cities: %+v", cities)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	s := newTestServer(t)
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the symmetric and the retired keys are never published.
+	keys := jwt.NewKeyRing(&jwt.Key{ID: "ec", Method: gojwt.SigningMethodES256, SignKey: pk, VerifyKey: &pk.PublicKey})
+	keys.AddVerificationKey(jwt.NewHMACKey("hmac", []byte("secret")), time.Now().Add(time.Hour))
+	keys.AddVerificationKey(&jwt.Key{ID: "retired", Method: gojwt.SigningMethodES256, SignKey: retired, VerifyKey: &retired.PublicKey}, time.Now().Add(-time.Second))
+
+	jwtService := jwt.NewJWTServiceWithKeyRing(keys)
+	jwtService.RefreshTokenService = s.RefreshTokenService
+	s.JWTService = jwtService
+
+	rec := serve(s, http.MethodGet, "/.well-known/jwks.json", nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var set jwt.JSONWebKeySet
+	if err := json.Unmarshal(rec.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	} else if len(set.Keys) != 1 || set.Keys[0].Kid != "ec" {
+		t.Fatalf("unexpected JWKS: %s", rec.Body)
+	}
+
+	// the tokens issued by the server are verified with the published key.
+	pub, err := set.Keys[0].PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createUser(t, s, "mario", "Password-segreta-1", entity.RoleViewer)
+	token, _ := loginTokens(t, s, "mario", "Password-segreta-1", "")
+
+	if _, err := gojwt.Parse(token, func(t *gojwt.Token) (interface{}, error) {
+		if t.Header["kid"] != set.Keys[0].Kid {
+			return nil, fmt.Errorf("unexpected kid %v", t.Header["kid"])
+		}
+		return pub, nil
+	}); err != nil {
+		t.Fatalf("failed to verify the token with the JWKS: %v", err)
+	}
+}
+
+// setClock makes the token service and the blacklist of the server see now as the current time.
+func setClock(s *ServerAPI, now time.Time) {
+	s.JWTService.(*jwt.JWTService).Now = func() time.Time { return now }
+	s.JWTBlacklistService.(*inmem.JWTBlacklistService).Now = func() time.Time { return now }
+}
+
+// enableTOTP configures a confirmed second factor for the user and returns its secret.
+func enableTOTP(t *testing.T, s *ServerAPI, user *entity.User) string {
+	t.Helper()
+
+	const secret = "JBSWY3DPEHPK3PXP"
+	if err := s.MFAService.CreateTOTP(context.Background(), &entity.TOTP{UserID: user.ID, Secret: secret}); err != nil {
+		t.Fatal(err)
+	} else if err := s.MFAService.ConfirmTOTP(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// totpCode returns the current code of the secret.
+func totpCode(t *testing.T, s *ServerAPI, secret string) string {
+	t.Helper()
+
+	code, err := s.TOTPService.(*totp.TOTPService).Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestLogout_Leeway(t *testing.T) {
+	s := newTestServer(t)
+
+	user := createUser(t, s, "mario", "Password-segreta-1", entity.RoleViewer)
+
+	// a token without a session is revoked by its id only.
+	revoked := accessToken(t, s, user, "")
+	if rec := serve(s, http.MethodPost, "/v1/auth/logout", nil, bearer(revoked)); rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+
+	// past its expiration the token is still accepted within the leeway, so it must still be blacklisted.
+	setClock(s, time.Now().Add(time.Hour+token.DefaultLeeway/2))
+	if rec := serve(s, http.MethodGet, "/v1/auth/me", nil, bearer(revoked)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+}
+
+func TestMFAVerify_ChallengeReuse(t *testing.T) {
+	s := newTestServer(t)
+
+	user := createUser(t, s, "mario", "Password-segreta-1", entity.RoleViewer)
+	secret := enableTOTP(t, s, user)
+
+	mfaToken := login(t, s, "mario", "Password-segreta-1", "")["mfa_token"].(string)
+
+	verify := func() *httptest.ResponseRecorder {
+		return serve(s, http.MethodPost, "/v1/auth/mfa/verify", map[string]string{
+			"mfa_token": mfaToken,
+			"code":      totpCode(t, s, secret),
+		}, nil)
+	}
+
+	if rec := verify(); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	if rec := verify(); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reused challenge: status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+
+	// the consumed challenge stays blacklisted while it is accepted within the leeway.
+	setClock(s, time.Now().Add(entity.MFAChallengeExpiration+token.DefaultLeeway/2))
+	if rec := verify(); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reused challenge within the leeway: status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	s := newTestServer(t)
+	s.SettingService = &settingService{}
+	s.PasswordPolicyService = password.NewPolicyService(password.DefaultPolicy)
+
+	admin := createUser(t, s, "admin", "Password-segreta-1", entity.RoleAdmin)
+	params := map[string]string{"username": "mario", "name": "Mario Rossi", "email": "mario@example.com", "password": "Buongiorno-2022"}
+
+	// registration is disabled by default.
+	if rec := serve(s, http.MethodPost, "/v1/auth/register", params, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+
+	rec := serve(s, http.MethodPut, "/v1/admin/registration", map[string]bool{"enabled": true}, bearer(accessToken(t, s, admin, "")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var body struct {
+		Enabled    bool `json:"enabled"`
+		Persistent bool `json:"persistent"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	} else if !body.Enabled || !body.Persistent {
+		t.Fatalf("unexpected response: %s", rec.Body)
+	}
+
+	// the setting is stored, so that it's shared by the other nodes.
+	if value, err := s.SettingService.FindSetting(context.Background(), entity.SettingRegistrationEnabled); err != nil {
+		t.Fatal(err)
+	} else if value != "true" {
+		t.Fatalf("stored setting = %q, want true", value)
+	}
+
+	if rec := serve(s, http.MethodPost, "/v1/auth/register", params, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+
+	if user, err := s.UserService.FindUserByUsername(context.Background(), "mario"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(user.Roles, []entity.Role{entity.RoleViewer}) {
+		t.Fatalf("roles = %v, want [%s]", user.Roles, entity.RoleViewer)
+	}
+
+	for _, tt := range []struct {
+		name string
+		upd  map[string]string
+		code int
+	}{
+		{name: "duplicate username", code: http.StatusConflict},
+		{name: "no name", upd: map[string]string{"username": "luigi", "name": ""}, code: http.StatusBadRequest},
+		{name: "no username", upd: map[string]string{"username": ""}, code: http.StatusBadRequest},
+		{name: "invalid email", upd: map[string]string{"username": "luigi", "email": "luigi"}, code: http.StatusBadRequest},
+		{name: "no password", upd: map[string]string{"username": "luigi", "password": ""}, code: http.StatusBadRequest},
+		{name: "weak password", upd: map[string]string{"username": "luigi", "password": "password"}, code: http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := make(map[string]string)
+			for k, v := range params {
+				p[k] = v
+			}
+			for k, v := range tt.upd {
+				p[k] = v
+			}
+
+			if rec := serve(s, http.MethodPost, "/v1/auth/register", p, nil); rec.Code != tt.code {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.code, rec.Body)
+			}
+		})
+	}
+
+	if users, err := s.UserService.FindUsers(context.Background(), service.UserFilter{}); err != nil {
+		t.Fatal(err)
+	} else if len(users) != 2 {
+		t.Fatalf("%d users, want 2", len(users))
+	}
+}
+
+func TestAdminRegistration_InMemory(t *testing.T) {
+	s := newTestServer(t)
+	s.SetRegistrationEnabled(true)
+
+	token := accessToken(t, s, createUser(t, s, "admin", "Password-segreta-1", entity.RoleAdmin), "")
+
+	rec := serve(s, http.MethodPut, "/v1/admin/registration", map[string]bool{"enabled": false}, bearer(token))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	// without a SettingService the response says the setting only applies to this process.
+	var body map[string]bool
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	} else if body["enabled"] || body["persistent"] {
+		t.Fatalf("unexpected response: %s", rec.Body)
+	}
+
+	if enabled, err := s.RegistrationEnabled(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if enabled {
+		t.Fatal("expected registration to be disabled")
+	}
+}
+
+func TestMFACodes_Throttled(t *testing.T) {
+	for _, path := range []string{
+		"/v1/auth/mfa/totp/confirm",
+		"/v1/auth/mfa/totp/disable",
+		"/v1/auth/mfa/recovery-codes",
+	} {
+		t.Run(path, func(t *testing.T) {
+			s := newTestServer(t)
+
+			user := createUser(t, s, "mario", "Password-segreta-1", entity.RoleViewer)
+			secret := enableTOTP(t, s, user)
+			if path == "/v1/auth/mfa/totp/confirm" {
+				s.MFAService.(*mfaService).totps[user.ID].ConfirmedAt = nil
+			}
+			token := accessToken(t, s, user, "")
+
+			// the codes have 6 digits, so this one is always wrong.
+			for i := 0; i < inmem.DefaultMaxUserFailures; i++ {
+				if rec := serve(s, http.MethodPost, path, map[string]string{"code": "12345"}, bearer(token)); rec.Code != http.StatusUnauthorized {
+					t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+				}
+			}
+
+			// once locked out, not even the right code is checked.
+			if rec := serve(s, http.MethodPost, path, map[string]string{"code": totpCode(t, s, secret)}, bearer(token)); rec.Code != http.StatusLocked {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusLocked, rec.Body)
+			}
+
+			// the failures count as failed logins of the user.
+			if err := s.LoginThrottleService.Check(context.Background(), "mario", "192.0.2.2"); apperr.ErrorCode(err) != apperr.ELOCKED {
+				t.Fatalf("expected %s, got %v", apperr.ELOCKED, err)
+			}
+		})
+	}
+}
+
+func TestTOTPDisable_RevokesSessions(t *testing.T) {
+	s := newTestServer(t)
+
+	user := createUser(t, s, "mario", "Password-segreta-1", entity.RoleViewer)
+	accessToken, refreshToken := loginTokens(t, s, "mario", "Password-segreta-1", "")
+	secret := enableTOTP(t, s, user)
+
+	if rec := serve(s, http.MethodPost, "/v1/auth/mfa/totp/disable", map[string]string{"code": totpCode(t, s, secret)}, bearer(accessToken)); rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+
+	// whoever held the second factor is logged out, the current session included.
+	if rec := serve(s, http.MethodGet, "/v1/auth/me", nil, bearer(accessToken)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+	if rec := serve(s, http.MethodPost, "/v1/auth/refresh", map[string]string{"refresh_token": refreshToken}, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+
+	if revoked := s.RefreshTokenService.(*refreshTokenService).revoked; len(revoked) != 1 || revoked[0] != user.ID {
+		t.Fatalf("expected the refresh tokens of the user to be revoked, got %v", revoked)
+	}
+}
+
+// listSessions returns the active sessions listed for the token, keyed by id, true for the current one.
+func listSessions(t *testing.T, s *ServerAPI, token string) map[string]bool {
+	t.Helper()
+
+	rec := serve(s, http.MethodGet, "/v1/auth/sessions", nil, bearer(token))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var response struct {
+		Sessions []struct {
+			ID      string `json:"id"`
+			Current bool   `json:"current"`
+		} `json:"sessions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := make(map[string]bool)
+	for _, session := range response.Sessions {
+		sessions[session.ID] = session.Current
+	}
+	return sessions
+}
+
+func TestDeleteSession(t *testing.T) {
+	s := newTestServer(t)
+
+	createUser(t, s, "mario", "Password-segreta-1", entity.RoleViewer)
+	createUser(t, s, "luigi", "Password-segreta-2", entity.RoleViewer)
+
+	// mario is logged in on two devices.
+	laptop, _ := loginTokens(t, s, "mario", "Password-segreta-1", "")
+	phone, phoneRefresh := loginTokens(t, s, "mario", "Password-segreta-1", "")
+	other, _ := loginTokens(t, s, "luigi", "Password-segreta-2", "")
+
+	// each device sees both sessions, only its own marked as current.
+	var laptopSession, phoneSession string
+	for id, current := range listSessions(t, s, laptop) {
+		if current {
+			laptopSession = id
+		} else {
+			phoneSession = id
+		}
+	}
+	if laptopSession == "" || phoneSession == "" {
+		t.Fatalf("expected a current and another session, got %v", listSessions(t, s, laptop))
+	} else if sessions := listSessions(t, s, phone); len(sessions) != 2 || !sessions[phoneSession] || sessions[laptopSession] {
+		t.Fatalf("unexpected sessions of the phone: %v", sessions)
+	}
+
+	// the sessions of other users are not found, as well as the unknown ones.
+	var otherSession string
+	for id := range listSessions(t, s, other) {
+		otherSession = id
+	}
+	for _, id := range []string{otherSession, "unknown"} {
+		if rec := serve(s, http.MethodDelete, "/v1/auth/sessions/"+id, nil, bearer(laptop)); rec.Code != http.StatusNotFound {
+			t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNotFound, rec.Body)
+		}
+	}
+	if rec := serve(s, http.MethodGet, "/v1/auth/me", nil, bearer(other)); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	// the laptop logs the phone out.
+	if rec := serve(s, http.MethodDelete, "/v1/auth/sessions/"+phoneSession, nil, bearer(laptop)); rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+
+	if rec := serve(s, http.MethodGet, "/v1/auth/me", nil, bearer(phone)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("phone: status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+	if rec := serve(s, http.MethodPost, "/v1/auth/refresh", map[string]string{"refresh_token": phoneRefresh}, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("phone refresh: status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+
+	if rec := serve(s, http.MethodGet, "/v1/auth/me", nil, bearer(laptop)); rec.Code != http.StatusOK {
+		t.Fatalf("laptop: status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if sessions := listSessions(t, s, laptop); len(sessions) != 1 || !sessions[laptopSession] {
+		t.Fatalf("unexpected sessions of the laptop: %v", sessions)
+	}
+}
+
+// introspect sends the token to the introspection endpoint, authenticated as the client.
+func introspect(t *testing.T, s *ServerAPI, client http.Header, token string) map[string]interface{} {
+	t.Helper()
+
+	rec := serveForm(s, "/v1/auth/introspect", url.Values{"token": {token}}, client)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestIntrospect(t *testing.T) {
+	s := newTestServer(t)
+
+	createUser(t, s, "mario", "Password-segreta-1", entity.RoleEditor)
+	resourceServer := basicAuth(createClient(t, s, "server"))
+
+	access, _ := loginTokens(t, s, "mario", "Password-segreta-1", string(entity.PermissionCitiesRead))
+
+	response := introspect(t, s, resourceServer, access)
+	if response["active"] != true || response["username"] != "mario" || response["scope"] != string(entity.PermissionCitiesRead) || response["token_type"] != entity.TokenTypeBearer {
+		t.Fatalf("unexpected response: %v", response)
+	} else if response["exp"] == nil || response["sub"] == nil || response["jti"] == nil {
+		t.Fatalf("missing claims in response: %v", response)
+	}
+
+	// the reason a token is inactive is not disclosed, nor any of its claims.
+	if rec := serve(s, http.MethodPost, "/v1/auth/logout", nil, bearer(access)); rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	for name, token := range map[string]string{
+		"revoked":   access,
+		"malformed": "not-a-token",
+	} {
+		if response := introspect(t, s, resourceServer, token); !reflect.DeepEqual(response, map[string]interface{}{"active": false}) {
+			t.Errorf("%s: unexpected response: %v", name, response)
+		}
+	}
+}
+
+func TestIntrospect_ClientToken(t *testing.T) {
+	s := newTestServer(t)
+
+	resourceServer := basicAuth(createClient(t, s, "server"))
+	clientID, clientSecret := createClient(t, s, "client", entity.PermissionCitiesRead, entity.PermissionCitiesWrite)
+
+	token := decodeToken(t, serveToken(s, url.Values{"grant_type": {GrantTypeClientCredentials}}, basicAuth(clientID, clientSecret)))
+
+	response := introspect(t, s, resourceServer, token.AccessToken)
+	if response["active"] != true || response["client_id"] != clientID || response["scope"] != token.Scope {
+		t.Fatalf("unexpected response: %v", response)
+	}
+
+	// the scope of the token shrinks along with the scopes of the key.
+	key, err := s.APIKeyService.FindAPIKeyByID(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Scopes = []entity.Permission{entity.PermissionCitiesRead}
+
+	if response := introspect(t, s, resourceServer, token.AccessToken); response["active"] != true || response["scope"] != string(entity.PermissionCitiesRead) {
+		t.Fatalf("unexpected response: %v", response)
+	}
+
+	// the tokens of a revoked key are inactive, even if not expired.
+	if err := s.APIKeyService.RevokeAPIKey(context.Background(), key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if response := introspect(t, s, resourceServer, token.AccessToken); !reflect.DeepEqual(response, map[string]interface{}{"active": false}) {
+		t.Fatalf("unexpected response: %v", response)
+	}
+}
+
+func TestIntrospect_ClientAuth(t *testing.T) {
+	s := newTestServer(t)
+
+	createUser(t, s, "mario", "Password-segreta-1", entity.RoleEditor)
+	access, _ := loginTokens(t, s, "mario", "Password-segreta-1", "")
+
+	clientID, _ := createClient(t, s, "server")
+	revokedID, revokedSecret := createClient(t, s, "revoked")
+	id, _ := strconv.ParseInt(revokedID, 10, 64)
+	if err := s.APIKeyService.RevokeAPIKey(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the clients can introspect tokens, not the holders of the tokens.
+	for name, header := range map[string]http.Header{
+		"no client":      nil,
+		"bearer token":   bearer(access),
+		"wrong secret":   basicAuth(clientID, "sbagliato"),
+		"revoked client": basicAuth(revokedID, revokedSecret),
+	} {
+		rec := serveForm(s, "/v1/auth/introspect", url.Values{"token": {access}}, header)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want %d: %s", name, rec.Code, http.StatusUnauthorized, rec.Body)
+		} else if strings.Contains(rec.Body.String(), `"active"`) {
+			t.Errorf("%s: unexpected introspection response: %s", name, rec.Body)
+		}
+	}
+
+	if rec := serveForm(s, "/v1/auth/introspect", url.Values{"token": {access}}, nil); rec.Header().Get(echo.HeaderWWWAuthenticate) == "" {
+		t.Fatal("expected a WWW-Authenticate challenge")
+	}
+
+	// the token is required.
+	if rec := serveForm(s, "/v1/auth/introspect", url.Values{}, basicAuth(createClient(t, s, "other"))); rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+}
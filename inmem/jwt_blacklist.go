@@ -0,0 +1,111 @@
+package inmem
+
+import (
+	"context"
+	"mysql/app/apperr"
+	"mysql/app/service"
+	"sync"
+	"time"
+)
+
+// DefaultSweepInterval is the interval between two sweeps of the expired entries.
+const DefaultSweepInterval = 1 * time.Minute
+
+var _ service.JWTBlacklistService = (*JWTBlacklistService)(nil)
+
+// JWTBlacklistService is an in-process blacklist, the revocations are lost on restart
+// and are not shared between nodes, so it is meant for development and single-node deployments.
+type JWTBlacklistService struct {
+	mu      sync.RWMutex
+	entries map[string]time.Time // jti -> expiration
+
+	// Now returns the current time, it can be replaced in tests.
+	Now func() time.Time
+}
+
+// NewJWTBlacklistService creates a new blacklist and starts sweeping its expired
+// entries every sweepInterval until ctx is done. DefaultSweepInterval is used
+// if sweepInterval is not positive.
+func NewJWTBlacklistService(ctx context.Context, sweepInterval time.Duration) *JWTBlacklistService {
+
+	s := &JWTBlacklistService{
+		entries: make(map[string]time.Time),
+		Now:     time.Now,
+	}
+
+	go s.sweepLoop(ctx, validSweepInterval(sweepInterval))
+
+	return s
+}
+
+// Invalidate implements service.JWTBlacklistService
+func (s *JWTBlacklistService) Invalidate(ctx context.Context, id string, expiration time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		expiresAt := s.Now().Add(expiration)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if current, ok := s.entries[id]; !ok || current.Before(expiresAt) {
+			s.entries[id] = expiresAt
+		}
+
+		return nil
+	}
+}
+
+// IsBlacklisted implements service.JWTBlacklistService
+func (s *JWTBlacklistService) IsBlacklisted(ctx context.Context, id string) (bool, error) {
+	select {
+	case <-ctx.Done():
+		return false, apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		expiresAt, ok := s.entries[id]
+
+		return ok && s.Now().Before(expiresAt), nil
+	}
+}
+
+// validSweepInterval returns the interval, or DefaultSweepInterval if it is not positive,
+// since a ticker can't be created with such an interval.
+func validSweepInterval(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return DefaultSweepInterval
+	}
+	return interval
+}
+
+// sweepLoop removes the expired entries every interval until ctx is done.
+func (s *JWTBlacklistService) sweepLoop(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep(s.Now())
+		}
+	}
+}
+
+// sweep removes the entries expired at now.
+func (s *JWTBlacklistService) sweep(now time.Time) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, expiresAt := range s.entries {
+		if !now.Before(expiresAt) {
+			delete(s.entries, id)
+		}
+	}
+}
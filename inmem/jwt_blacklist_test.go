@@ -0,0 +1,96 @@
+package inmem
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestJWTBlacklistService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewJWTBlacklistService(ctx, time.Hour)
+
+	if blacklisted, err := s.IsBlacklisted(ctx, "jti"); err != nil {
+		t.Fatal(err)
+	} else if blacklisted {
+		t.Fatal("expected an unknown id not to be blacklisted")
+	}
+
+	if err := s.Invalidate(ctx, "jti", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if blacklisted, err := s.IsBlacklisted(ctx, "jti"); err != nil {
+		t.Fatal(err)
+	} else if !blacklisted {
+		t.Fatal("expected the id to be blacklisted")
+	}
+
+	// a shorter expiration never shortens an existing one.
+	if err := s.Invalidate(ctx, "jti", time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	if blacklisted, err := s.IsBlacklisted(ctx, "jti"); err != nil {
+		t.Fatal(err)
+	} else if !blacklisted {
+		t.Fatal("expected the id to be still blacklisted")
+	}
+}
+
+func TestJWTBlacklistService_Expiration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewJWTBlacklistService(ctx, time.Hour)
+
+	if err := s.Invalidate(ctx, "jti", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if blacklisted, err := s.IsBlacklisted(ctx, "jti"); err != nil {
+		t.Fatal(err)
+	} else if blacklisted {
+		t.Fatal("expected the entry to be expired")
+	}
+
+	s.sweep(time.Now())
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.entries) != 0 {
+		t.Fatalf("expected the expired entry to be swept, got %d entries", len(s.entries))
+	}
+}
+
+func TestNewJWTBlacklistService_InvalidSweepInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a non positive interval must not make the sweep loop panic.
+	for _, interval := range []time.Duration{0, -time.Second} {
+		s := NewJWTBlacklistService(ctx, interval)
+		if err := s.Invalidate(ctx, "jti", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if got := validSweepInterval(0); got != DefaultSweepInterval {
+		t.Fatalf("validSweepInterval(0) = %v, want %v", got, DefaultSweepInterval)
+	}
+}
+
+func TestJWTBlacklistService_ContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewJWTBlacklistService(ctx, time.Hour)
+	cancel()
+
+	if err := s.Invalidate(ctx, "jti", time.Minute); err == nil {
+		t.Fatal("expected an error with a cancelled context")
+	}
+}
@@ -0,0 +1,205 @@
+package inmem
+
+import (
+	"context"
+	"math"
+	"mysql/app/apperr"
+	"mysql/app/service"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default login throttling parameters.
+const (
+	DefaultMaxUserFailures = 5
+	DefaultLockoutDuration = 15 * time.Minute
+	DefaultFreeIPFailures  = 5
+	DefaultIPBaseDelay     = 1 * time.Second
+	DefaultIPMaxDelay      = 5 * time.Minute
+	DefaultFailureWindow   = 15 * time.Minute
+)
+
+var _ service.LoginThrottleService = (*LoginThrottleService)(nil)
+
+// LoginThrottleService keeps the failed logins in process.
+//
+// A username is locked out for LockoutDuration after MaxUserFailures consecutive failures.
+// A client IP can fail FreeIPFailures times, then it must wait before each new attempt
+// a delay starting at IPBaseDelay and doubling at every failure, up to IPMaxDelay.
+// Failures older than FailureWindow are forgotten.
+type LoginThrottleService struct {
+	MaxUserFailures int
+	LockoutDuration time.Duration
+	FreeIPFailures  int
+	IPBaseDelay     time.Duration
+	IPMaxDelay      time.Duration
+	FailureWindow   time.Duration
+
+	// Now returns the current time, it can be replaced in tests.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	users map[string]*failures
+	ips   map[string]*failures
+}
+
+// failures are the consecutive failed logins of a username or of a client IP.
+type failures struct {
+	count int
+	last  time.Time
+	until time.Time // no attempt is allowed before until
+}
+
+// NewLoginThrottleService creates a LoginThrottleService with the default parameters and starts
+// sweeping the forgotten failures every sweepInterval until ctx is done.
+// DefaultSweepInterval is used if sweepInterval is not positive.
+func NewLoginThrottleService(ctx context.Context, sweepInterval time.Duration) *LoginThrottleService {
+
+	s := &LoginThrottleService{
+		MaxUserFailures: DefaultMaxUserFailures,
+		LockoutDuration: DefaultLockoutDuration,
+		FreeIPFailures:  DefaultFreeIPFailures,
+		IPBaseDelay:     DefaultIPBaseDelay,
+		IPMaxDelay:      DefaultIPMaxDelay,
+		FailureWindow:   DefaultFailureWindow,
+		Now:             time.Now,
+		users:           make(map[string]*failures),
+		ips:             make(map[string]*failures),
+	}
+
+	go s.sweepLoop(ctx, validSweepInterval(sweepInterval))
+
+	return s
+}
+
+// Check implements service.LoginThrottleService
+func (s *LoginThrottleService) Check(ctx context.Context, username string, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.Now()
+
+	if f := s.users[userKey(username)]; f != nil && now.Before(f.until) {
+		return apperr.Errorf(apperr.ELOCKED, "account bloccato per troppi tentativi falliti, riprova tra %s", retryAfter(now, f.until))
+	}
+
+	if f := s.ips[ip]; f != nil && now.Before(f.until) {
+		return apperr.Errorf(apperr.ETOOMANYREQUESTS, "troppi tentativi falliti, riprova tra %s", retryAfter(now, f.until))
+	}
+
+	return nil
+}
+
+// RecordFailure implements service.LoginThrottleService
+func (s *LoginThrottleService) RecordFailure(ctx context.Context, username string, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.Now()
+
+	u := s.record(s.users, userKey(username), now)
+	if u.count >= s.MaxUserFailures {
+		u.until = now.Add(s.LockoutDuration)
+		// the lockout is a fresh start: once it expires the user gets all its attempts back.
+		u.count = 0
+	}
+
+	i := s.record(s.ips, ip, now)
+	if n := i.count - s.FreeIPFailures; n > 0 {
+		i.until = now.Add(s.ipDelay(n))
+	}
+
+	return nil
+}
+
+// RecordSuccess implements service.LoginThrottleService
+func (s *LoginThrottleService) RecordSuccess(ctx context.Context, username string, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the failures of the IP are kept: an attacker must not be able to reset them
+	// by logging in to its own account between the attempts on the others.
+	delete(s.users, userKey(username))
+
+	return nil
+}
+
+// Unlock implements service.LoginThrottleService
+func (s *LoginThrottleService) Unlock(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.users, userKey(username))
+
+	return nil
+}
+
+// record adds a failure to the entry with the given key, starting over if the previous
+// failures are older than the failure window.
+func (s *LoginThrottleService) record(m map[string]*failures, key string, now time.Time) *failures {
+
+	f, ok := m[key]
+	if !ok || now.Sub(f.last) > s.FailureWindow {
+		f = &failures{}
+		m[key] = f
+	}
+
+	f.count++
+	f.last = now
+
+	return f
+}
+
+// ipDelay returns the delay imposed to a client IP after n failures over the free ones.
+func (s *LoginThrottleService) ipDelay(n int) time.Duration {
+
+	delay := float64(s.IPBaseDelay) * math.Pow(2, float64(n-1))
+	if delay > float64(s.IPMaxDelay) {
+		return s.IPMaxDelay
+	}
+
+	return time.Duration(delay)
+}
+
+// sweepLoop removes the forgotten failures every interval until ctx is done.
+func (s *LoginThrottleService) sweepLoop(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+// sweep removes the failures that are older than the failure window and no longer block attempts.
+func (s *LoginThrottleService) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.Now()
+
+	for _, m := range []map[string]*failures{s.users, s.ips} {
+		for key, f := range m {
+			if now.Sub(f.last) > s.FailureWindow && !now.Before(f.until) {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// userKey returns the key of a username, usernames are compared case insensitively like the database does.
+func userKey(username string) string {
+	return strings.ToLower(username)
+}
+
+// retryAfter returns the time to wait until t, rounded up to the second.
+func retryAfter(now time.Time, t time.Time) time.Duration {
+	return t.Sub(now).Truncate(time.Second) + time.Second
+}
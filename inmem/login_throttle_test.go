@@ -0,0 +1,174 @@
+package inmem
+
+import (
+	"context"
+	"mysql/app/apperr"
+	"testing"
+	"time"
+)
+
+// newTestLoginThrottle returns a throttle whose clock is moved by the returned function.
+func newTestLoginThrottle(t *testing.T) (*LoginThrottleService, func(time.Duration)) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	s := NewLoginThrottleService(ctx, DefaultSweepInterval)
+	s.Now = func() time.Time { return now }
+
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLoginThrottleService_UserLockout(t *testing.T) {
+	ctx := context.Background()
+	s, advance := newTestLoginThrottle(t)
+
+	// each attempt comes from another IP, so that only the username is throttled.
+	for i := 0; i < s.MaxUserFailures; i++ {
+		if err := s.Check(ctx, "Mario", string(rune('a'+i))); err != nil {
+			t.Fatalf("Check() = %v, want nil at attempt %d", err, i)
+		}
+		if err := s.RecordFailure(ctx, "Mario", string(rune('a'+i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// usernames are compared case insensitively.
+	if err := s.Check(ctx, "mario", "z"); apperr.ErrorCode(err) != apperr.ELOCKED {
+		t.Fatalf("Check() = %v, want ELOCKED", err)
+	}
+
+	advance(s.LockoutDuration)
+
+	if err := s.Check(ctx, "mario", "z"); err != nil {
+		t.Fatalf("Check() = %v, want nil after the lockout", err)
+	}
+}
+
+func TestLoginThrottleService_Unlock(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestLoginThrottle(t)
+
+	for i := 0; i < s.MaxUserFailures; i++ {
+		if err := s.RecordFailure(ctx, "mario", string(rune('a'+i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Unlock(ctx, "mario"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Check(ctx, "mario", "z"); err != nil {
+		t.Fatalf("Check() = %v, want nil after Unlock", err)
+	}
+}
+
+func TestLoginThrottleService_IPDelay(t *testing.T) {
+	ctx := context.Background()
+	s, advance := newTestLoginThrottle(t)
+
+	// each attempt targets another username, so that only the IP is throttled.
+	for i := 0; i < s.FreeIPFailures; i++ {
+		if err := s.RecordFailure(ctx, string(rune('a'+i)), "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Check(ctx, "z", "10.0.0.1"); err != nil {
+		t.Fatalf("Check() = %v, want nil within the free failures", err)
+	}
+
+	for i, want := range []time.Duration{s.IPBaseDelay, 2 * s.IPBaseDelay, 4 * s.IPBaseDelay} {
+		if err := s.RecordFailure(ctx, "z", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Check(ctx, "y", "10.0.0.1"); apperr.ErrorCode(err) != apperr.ETOOMANYREQUESTS {
+			t.Fatalf("Check() = %v, want ETOOMANYREQUESTS at failure %d", err, i)
+		}
+		if err := s.Check(ctx, "y", "10.0.0.2"); err != nil {
+			t.Fatalf("Check() = %v, want nil for another IP", err)
+		}
+
+		advance(want)
+
+		if err := s.Check(ctx, "y", "10.0.0.1"); err != nil {
+			t.Fatalf("Check() = %v, want nil after %v", err, want)
+		}
+	}
+}
+
+func TestLoginThrottleService_IPMaxDelay(t *testing.T) {
+	s, _ := newTestLoginThrottle(t)
+
+	if got := s.ipDelay(100); got != s.IPMaxDelay {
+		t.Fatalf("ipDelay(100) = %v, want %v", got, s.IPMaxDelay)
+	}
+}
+
+func TestLoginThrottleService_RecordSuccess(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestLoginThrottle(t)
+
+	for i := 0; i < s.FreeIPFailures+1; i++ {
+		if err := s.RecordFailure(ctx, "mario", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a login to another account from the same IP must not reset the failures of the IP.
+	if err := s.RecordSuccess(ctx, "luigi", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Check(ctx, "luigi", "10.0.0.1"); apperr.ErrorCode(err) != apperr.ETOOMANYREQUESTS {
+		t.Fatalf("Check() = %v, want ETOOMANYREQUESTS", err)
+	}
+
+	if err := s.RecordSuccess(ctx, "mario", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if f := s.users[userKey("mario")]; f != nil {
+		t.Fatalf("expected the failures of the user to be cleared, got %d", f.count)
+	}
+}
+
+func TestLoginThrottleService_FailureWindow(t *testing.T) {
+	ctx := context.Background()
+	s, advance := newTestLoginThrottle(t)
+
+	for i := 0; i < s.MaxUserFailures-1; i++ {
+		if err := s.RecordFailure(ctx, "mario", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	advance(s.FailureWindow + time.Second)
+
+	// the previous failures are forgotten, this one starts over.
+	if err := s.RecordFailure(ctx, "mario", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Check(ctx, "mario", "10.0.0.2"); err != nil {
+		t.Fatalf("Check() = %v, want nil", err)
+	}
+
+	advance(s.FailureWindow + time.Second)
+	s.sweep()
+
+	if len(s.users) != 0 || len(s.ips) != 0 {
+		t.Fatalf("expected the forgotten failures to be swept, got %d users and %d ips", len(s.users), len(s.ips))
+	}
+}
+
+func TestLoginThrottleService_InvalidSweepInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a non positive interval would make the ticker panic.
+	NewLoginThrottleService(ctx, 0)
+	NewLoginThrottleService(ctx, -time.Second)
+}
@@ -0,0 +1,97 @@
+package inmem
+
+import (
+	"context"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"sync"
+	"time"
+)
+
+var _ service.OIDCLoginService = (*OIDCLoginService)(nil)
+
+// OIDCLoginService keeps the pending logins in process, the callback must then be
+// served by the node that started the login.
+type OIDCLoginService struct {
+	mu     sync.Mutex
+	logins map[string]*entity.OIDCLogin // state -> login
+}
+
+// NewOIDCLoginService creates a new OIDCLoginService and starts sweeping the expired
+// logins every sweepInterval until ctx is done. DefaultSweepInterval is used if
+// sweepInterval is not positive.
+func NewOIDCLoginService(ctx context.Context, sweepInterval time.Duration) *OIDCLoginService {
+
+	s := &OIDCLoginService{
+		logins: make(map[string]*entity.OIDCLogin),
+	}
+
+	go s.sweepLoop(ctx, validSweepInterval(sweepInterval))
+
+	return s
+}
+
+// CreateOIDCLogin implements service.OIDCLoginService
+func (s *OIDCLoginService) CreateOIDCLogin(ctx context.Context, login *entity.OIDCLogin) error {
+	select {
+	case <-ctx.Done():
+		return apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.logins[login.State] = login
+
+		return nil
+	}
+}
+
+// ConsumeOIDCLogin implements service.OIDCLoginService
+func (s *OIDCLoginService) ConsumeOIDCLogin(ctx context.Context, state string) (*entity.OIDCLogin, error) {
+	select {
+	case <-ctx.Done():
+		return nil, apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		login, ok := s.logins[state]
+		delete(s.logins, state)
+
+		if !ok || !time.Now().Before(login.ExpiresAt) {
+			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "login non valido o scaduto")
+		}
+
+		return login, nil
+	}
+}
+
+// sweepLoop removes the expired logins every interval until ctx is done.
+func (s *OIDCLoginService) sweepLoop(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.sweep(now)
+		}
+	}
+}
+
+// sweep removes the logins expired at now.
+func (s *OIDCLoginService) sweep(now time.Time) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for state, login := range s.logins {
+		if !now.Before(login.ExpiresAt) {
+			delete(s.logins, state)
+		}
+	}
+}
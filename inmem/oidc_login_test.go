@@ -0,0 +1,92 @@
+package inmem
+
+import (
+	"context"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"testing"
+	"time"
+)
+
+func TestOIDCLoginService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewOIDCLoginService(ctx, time.Hour)
+
+	login := &entity.OIDCLogin{State: "state", Nonce: "nonce", CodeVerifier: "verifier", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := s.CreateOIDCLogin(ctx, login); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ConsumeOIDCLogin(ctx, "unknown"); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("ConsumeOIDCLogin() = %v, want EUNAUTHORIZED", err)
+	}
+
+	if got, err := s.ConsumeOIDCLogin(ctx, "state"); err != nil {
+		t.Fatal(err)
+	} else if got != login {
+		t.Fatalf("ConsumeOIDCLogin() = %+v, want %+v", got, login)
+	}
+
+	// a login can be completed only once.
+	if _, err := s.ConsumeOIDCLogin(ctx, "state"); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("ConsumeOIDCLogin() = %v, want EUNAUTHORIZED", err)
+	}
+}
+
+func TestOIDCLoginService_Expiration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewOIDCLoginService(ctx, time.Hour)
+
+	now := time.Now()
+
+	for state, expiresAt := range map[string]time.Time{
+		"expired": now.Add(-time.Second),
+		"pending": now.Add(time.Hour),
+	} {
+		if err := s.CreateOIDCLogin(ctx, &entity.OIDCLogin{State: state, ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.ConsumeOIDCLogin(ctx, "expired"); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("ConsumeOIDCLogin() = %v, want EUNAUTHORIZED", err)
+	}
+
+	s.sweep(now.Add(time.Minute))
+
+	if len(s.logins) != 1 {
+		t.Fatalf("len(logins) = %d, want 1", len(s.logins))
+	}
+
+	s.sweep(now.Add(time.Hour))
+
+	if len(s.logins) != 0 {
+		t.Fatalf("len(logins) = %d, want 0", len(s.logins))
+	}
+}
+
+func TestOIDCLoginService_InvalidSweepInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a non positive interval would make the ticker panic.
+	NewOIDCLoginService(ctx, 0)
+	NewOIDCLoginService(ctx, -time.Second)
+}
+
+func TestOIDCLoginService_ContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewOIDCLoginService(ctx, time.Hour)
+	cancel()
+
+	if err := s.CreateOIDCLogin(ctx, &entity.OIDCLogin{State: "state"}); apperr.ErrorCode(err) != apperr.EINTERNAL {
+		t.Fatalf("CreateOIDCLogin() = %v, want EINTERNAL", err)
+	}
+	if _, err := s.ConsumeOIDCLogin(ctx, "state"); apperr.ErrorCode(err) != apperr.EINTERNAL {
+		t.Fatalf("ConsumeOIDCLogin() = %v, want EINTERNAL", err)
+	}
+}
@@ -0,0 +1,156 @@
+package jwt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"mysql/app/apperr"
+	"strings"
+)
+
+// EncryptionKeySize is the size of the keys encrypting the tokens with A256GCM.
+const EncryptionKeySize = 32
+
+// Algorithms of the encrypted tokens: the content is encrypted directly with the
+// shared key, no content encryption key is wrapped in the token.
+const (
+	jweAlg = "dir"
+	jweEnc = "A256GCM"
+)
+
+// EncryptionKey is a symmetric key encrypting the issued tokens, identified by the kid header.
+type EncryptionKey struct {
+	ID     string
+	Secret []byte
+}
+
+// NewEncryptionKey returns an encryption key using the given secret, which must be
+// EncryptionKeySize bytes long.
+func NewEncryptionKey(id string, secret []byte) (*EncryptionKey, error) {
+
+	if len(secret) != EncryptionKeySize {
+		return nil, apperr.Errorf(apperr.EINVALID, "the encryption key must be %d bytes long", EncryptionKeySize)
+	}
+
+	return &EncryptionKey{ID: id, Secret: secret}, nil
+}
+
+// jweHeader is the protected header of the encrypted tokens, cty is JWT since
+// the content is a signed JWT (RFC 7519 section 5.2).
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Cty string `json:"cty,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// isEncrypted reports whether the token is in the JWE compact serialization,
+// which has five parts where a JWS has three.
+func isEncrypted(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// encrypt returns the signed token encrypted with the key, in the JWE compact serialization.
+func (k *EncryptionKey) encrypt(signed string) (string, error) {
+
+	gcm, err := k.gcm()
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(jweHeader{Alg: jweAlg, Enc: jweEnc, Cty: "JWT", Kid: k.ID})
+	if err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to encode JWE header: %v", err)
+	}
+	protected := base64.RawURLEncoding.EncodeToString(header)
+
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to generate IV: %v", err)
+	}
+
+	// the protected header is authenticated as additional data, the tag is appended to the ciphertext by Seal.
+	sealed := gcm.Seal(nil, iv, []byte(signed), []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{
+		protected,
+		"", // no encrypted key with direct encryption
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// decrypt returns the signed token encrypted in the JWE token.
+func (k *EncryptionKey) decrypt(token string) (string, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return "", apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token header")
+	}
+
+	var header jweHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return "", apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token header")
+	}
+
+	if header.Alg != jweAlg || header.Enc != jweEnc || parts[1] != "" {
+		return "", apperr.Errorf(apperr.ETOKENSIGNATURE, "unexpected encryption algorithm: %s %s", header.Alg, header.Enc)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(header.Kid), []byte(k.ID)) != 1 {
+		return "", apperr.Errorf(apperr.ETOKENSIGNATURE, "unknown encryption key id: %q", header.Kid)
+	}
+
+	gcm, err := k.gcm()
+	if err != nil {
+		return "", err
+	}
+
+	iv, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(iv) != gcm.NonceSize() {
+		return "", apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token IV")
+	}
+
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token ciphertext")
+	}
+
+	tag, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil || len(tag) != gcm.Overhead() {
+		return "", apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token tag")
+	}
+
+	signed, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", apperr.Errorf(apperr.ETOKENSIGNATURE, "failed to decrypt token")
+	}
+
+	return string(signed), nil
+}
+
+// gcm returns the AES-GCM cipher of the key.
+func (k *EncryptionKey) gcm() (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(k.Secret)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "invalid encryption key: %v", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "invalid encryption key: %v", err)
+	}
+
+	return gcm, nil
+}
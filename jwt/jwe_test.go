@@ -0,0 +1,182 @@
+package jwt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"mysql/app/apperr"
+	"strings"
+	"testing"
+)
+
+// newEncryptionKey returns an encryption key with a secret filled with b.
+func newEncryptionKey(t *testing.T, id string, b byte) *EncryptionKey {
+	t.Helper()
+
+	key, err := NewEncryptionKey(id, bytes.Repeat([]byte{b}, EncryptionKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// encodePart returns the JWE part encoding the bytes.
+func encodePart(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestNewEncryptionKey(t *testing.T) {
+	for _, size := range []int{0, 16, EncryptionKeySize - 1, EncryptionKeySize + 1} {
+		if _, err := NewEncryptionKey("enc", make([]byte, size)); apperr.ErrorCode(err) != apperr.EINVALID {
+			t.Errorf("size %d: expected %s, got %v", size, apperr.EINVALID, err)
+		}
+	}
+}
+
+func TestCodec_Encrypted_RoundTrip(t *testing.T) {
+	c := &Codec{Keys: NewKeyRing(NewHMACKey("hmac", []byte("secret"))), Encryption: newEncryptionKey(t, "enc", 1)}
+
+	token, err := c.Encode(context.Background(), newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		t.Fatalf("expected a JWE compact serialization, got %q", token)
+	} else if parts[1] != "" {
+		t.Fatalf("expected no encrypted key, got %q", parts[1])
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header jweHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		t.Fatal(err)
+	} else if header != (jweHeader{Alg: "dir", Enc: "A256GCM", Cty: "JWT", Kid: "enc"}) {
+		t.Fatalf("unexpected header: %+v", header)
+	}
+
+	claims, err := c.Decode(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	} else if claims.Subject != "1" || claims.User.Username != "mario" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+}
+
+func TestCodec_Encrypted_Decode_Errors(t *testing.T) {
+	keys := NewKeyRing(NewHMACKey("hmac", []byte("secret")))
+	c := &Codec{Keys: keys, Encryption: newEncryptionKey(t, "enc", 1)}
+
+	token, err := c.Encode(context.Background(), newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	// replace returns the token with the i-th part replaced.
+	replace := func(i int, part string) string {
+		p := append([]string{}, parts...)
+		p[i] = part
+		return strings.Join(p, ".")
+	}
+
+	// flip returns the token with the first byte of the i-th part flipped.
+	flip := func(i int) string {
+		b, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0xff
+		return replace(i, encodePart(b))
+	}
+
+	header := func(h jweHeader) string {
+		data, err := json.Marshal(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encodePart(data)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		codec *Codec
+		token string
+		code  string
+	}{
+		{name: "tampered ciphertext", codec: c, token: flip(3), code: apperr.ETOKENSIGNATURE},
+		{name: "tampered tag", codec: c, token: flip(4), code: apperr.ETOKENSIGNATURE},
+		{name: "tampered IV", codec: c, token: flip(2), code: apperr.ETOKENSIGNATURE},
+		// the protected header is authenticated, changing it breaks the tag even with a known kid.
+		{name: "tampered header", codec: c, token: replace(0, header(jweHeader{Alg: "dir", Enc: "A256GCM", Kid: "enc"})), code: apperr.ETOKENSIGNATURE},
+		{name: "wrong kid", codec: c, token: replace(0, header(jweHeader{Alg: "dir", Enc: "A256GCM", Cty: "JWT", Kid: "other"})), code: apperr.ETOKENSIGNATURE},
+		{name: "wrong key", codec: &Codec{Keys: keys, Encryption: newEncryptionKey(t, "enc", 2)}, token: token, code: apperr.ETOKENSIGNATURE},
+		{name: "unsupported alg", codec: c, token: replace(0, header(jweHeader{Alg: "A256KW", Enc: "A256GCM", Kid: "enc"})), code: apperr.ETOKENSIGNATURE},
+		{name: "unsupported enc", codec: c, token: replace(0, header(jweHeader{Alg: "dir", Enc: "A128GCM", Kid: "enc"})), code: apperr.ETOKENSIGNATURE},
+		{name: "encrypted key", codec: c, token: replace(1, encodePart([]byte("key"))), code: apperr.ETOKENSIGNATURE},
+		{name: "short IV", codec: c, token: replace(2, encodePart(make([]byte, 8))), code: apperr.ETOKENMALFORMED},
+		{name: "long IV", codec: c, token: replace(2, encodePart(make([]byte, 16))), code: apperr.ETOKENMALFORMED},
+		{name: "malformed IV", codec: c, token: replace(2, "!"), code: apperr.ETOKENMALFORMED},
+		{name: "short tag", codec: c, token: replace(4, encodePart(make([]byte, 8))), code: apperr.ETOKENMALFORMED},
+		{name: "malformed header", codec: c, token: replace(0, encodePart([]byte("{"))), code: apperr.ETOKENMALFORMED},
+		{name: "no encryption key", codec: &Codec{Keys: keys}, token: token, code: apperr.ETOKENMALFORMED},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.codec.Decode(context.Background(), tt.token); apperr.ErrorCode(err) != tt.code {
+				t.Fatalf("expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestCodec_Encrypted_SignedOnly(t *testing.T) {
+	keys := NewKeyRing(NewHMACKey("hmac", []byte("secret")))
+
+	// a token issued before the encryption key was set.
+	signed, err := (&Codec{Keys: keys}).Encode(context.Background(), newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Codec{Keys: keys, Encryption: newEncryptionKey(t, "enc", 1)}
+	if _, err := c.Decode(context.Background(), signed); err != nil {
+		t.Fatalf("expected the signed token to be accepted, got %v", err)
+	}
+
+	c.RequireEncryption = true
+	if _, err := c.Decode(context.Background(), signed); apperr.ErrorCode(err) != apperr.ETOKENMALFORMED {
+		t.Fatalf("expected %s, got %v", apperr.ETOKENMALFORMED, err)
+	}
+
+	// the encrypted tokens are still accepted.
+	token, err := c.Encode(context.Background(), newClaims())
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := c.Decode(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTService_EncryptTokens(t *testing.T) {
+	s := NewJWTService("secret")
+	s.EncryptTokens(newEncryptionKey(t, "enc", 1), true)
+
+	token, err := s.Codec.Encode(context.Background(), newClaims())
+	if err != nil {
+		t.Fatal(err)
+	} else if !isEncrypted(token) {
+		t.Fatalf("expected an encrypted token, got %q", token)
+	}
+
+	signed, err := (&Codec{Keys: s.Keys}).Encode(context.Background(), newClaims())
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Codec.Decode(context.Background(), signed); apperr.ErrorCode(err) != apperr.ETOKENMALFORMED {
+		t.Fatalf("expected %s, got %v", apperr.ETOKENMALFORMED, err)
+	}
+}
@@ -5,73 +5,172 @@ import (
 	"mysql/app/apperr"
 	"mysql/app/entity"
 	"mysql/app/service"
+	"mysql/token"
 
 	"github.com/golang-jwt/jwt"
 )
 
-const (
-	accessTokenExpiration = entity.AccessTokenExpiration
-)
+// DefaultLeeway is the clock skew tolerated by default between the issuer and the verifier.
+const DefaultLeeway = token.DefaultLeeway
 
 var _ service.JWTService = (*JWTService)(nil)
 
+// JWTService issues signed JWTs, see token.Service.
+// With an encryption key, see EncryptTokens, the signed JWTs are also encrypted.
 type JWTService struct {
-	Secret              string
-	JWTBlacklistService service.JWTBlacklistService
+	*token.Service
+
+	// Keys holds the key signing the issued tokens and the keys verifying the received ones.
+	Keys *KeyRing
+
+	codec *Codec
 }
 
-func NewJWTService (secret string) *JWTService{
+// NewJWTService creates a JWTService signing tokens with HS256 and the given secret.
+func NewJWTService(secret string) *JWTService {
+	return NewJWTServiceWithKey(NewHMACKey("", []byte(secret)))
+}
+
+// NewJWTServiceWithKey creates a JWTService signing tokens with the given key.
+func NewJWTServiceWithKey(key *Key) *JWTService {
+	return NewJWTServiceWithKeyRing(NewKeyRing(key))
+}
+
+// NewJWTServiceWithKeyRing creates a JWTService using the keys of the given ring.
+func NewJWTServiceWithKeyRing(keys *KeyRing) *JWTService {
+
+	codec := &Codec{Keys: keys}
+
 	return &JWTService{
-		Secret: secret,
+		Service: token.NewService(codec),
+		Keys:    keys,
+		codec:   codec,
 	}
 }
 
-// Exchange implements service.JWTService
-func (s *JWTService) Exchange(ctx context.Context, auth *entity.User) (*entity.Token, error) {
-	select {
-	case <-ctx.Done():
-		return nil, apperr.Errorf(apperr.EINTERNAL, "context cancelled")
-	default:
-		accessTokenclaims := entity.NewAppClaims(auth, accessTokenExpiration)
+// EncryptTokens makes the service issue nested JWTs: the signed tokens are encrypted
+// with the key (JWE with A256GCM), so that their claims cannot be read by the holders.
+//
+// The tokens that are only signed are still accepted, unless required is true:
+// it should be set once the tokens issued before encrypting them have expired.
+func (s *JWTService) EncryptTokens(key *EncryptionKey, required bool) {
+	s.codec.Encryption = key
+	s.codec.RequireEncryption = required
+}
 
-		accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessTokenclaims)
+// JWKS returns the public keys that can be used to verify the issued tokens,
+// including the previous keys that are not retired yet.
+// Symmetric keys are never included.
+func (s *JWTService) JWKS() JSONWebKeySet {
 
-		accessTokenString, err := accessToken.SignedString([]byte(s.Secret))
-		if err != nil {
-			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to sign access token: %v", err)
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+
+	for _, key := range s.Keys.Keys() {
+		if jwk, ok := key.JSONWebKey(); ok {
+			set.Keys = append(set.Keys, jwk)
 		}
+	}
+
+	return set
+}
+
+var _ token.Codec = (*Codec)(nil)
+
+// Codec encodes the claims as JWTs signed with the keys of the ring.
+type Codec struct {
+	Keys *KeyRing
+
+	// Encryption, if set, encrypts the signed tokens. The received tokens that are
+	// only signed are still accepted, e.g. the ones issued before the key was set,
+	// unless RequireEncryption is set.
+	Encryption *EncryptionKey
+
+	// RequireEncryption rejects the received tokens that are only signed. It should be
+	// set once the signed tokens issued before the encryption key was set have expired.
+	RequireEncryption bool
+}
+
+// Encode implements token.Codec
+func (c *Codec) Encode(ctx context.Context, claims *entity.AppClaims) (string, error) {
 
-		return &entity.Token{
-			AccessToken: accessTokenString,
-		}, nil
+	key := c.Keys.SigningKey()
+
+	t := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		t.Header["kid"] = key.ID
+	}
+
+	signed, err := t.SignedString(key.SignKey)
+	if err != nil || c.Encryption == nil {
+		return signed, err
 	}
+
+	return c.Encryption.encrypt(signed)
 }
 
-func (s *JWTService) Parse(ctx context.Context, token string) (*entity.AppClaims, error) {
-	select {
-	case <-ctx.Done():
-		return nil, apperr.Errorf(apperr.EINTERNAL, "context cancelled")
-	default:
-		t, err := jwt.ParseWithClaims(token, &entity.AppClaims{}, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, apperr.Errorf(apperr.EINTERNAL, "unexpected signing method: %v", token.Header["alg"])
-			}
+// Decode implements token.Codec
+func (c *Codec) Decode(ctx context.Context, token string) (*entity.AppClaims, error) {
 
-			return []byte(s.Secret), nil
-		})
+	if isEncrypted(token) {
+		if c.Encryption == nil {
+			return nil, apperr.Errorf(apperr.ETOKENMALFORMED, "encrypted tokens are not supported")
+		}
+
+		signed, err := c.Encryption.decrypt(token)
 		if err != nil {
-			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to parse token: %v", err)
+			return nil, err
 		}
+		token = signed
+	} else if c.RequireEncryption {
+		return nil, apperr.Errorf(apperr.ETOKENMALFORMED, "the token must be encrypted")
+	}
+
+	// time based claims are validated by token.Service, which knows about the leeway and the clock.
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+
+	claims := &entity.AppClaims{}
+
+	if _, err := parser.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
 
-		claims, ok := t.Claims.(*entity.AppClaims)
+		key, ok := c.Keys.VerificationKey(kid)
 		if !ok {
-			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to parse claims")
+			return nil, apperr.Errorf(apperr.ETOKENSIGNATURE, "unknown key id: %v", token.Header["kid"])
 		}
 
-		if !t.Valid {
-			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "invalid token")
+		// the algorithm must be the one of the key, otherwise a public key could be
+		// used as a HMAC secret to forge tokens.
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, apperr.Errorf(apperr.ETOKENSIGNATURE, "unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return claims, nil
+		return key.VerifyKey, nil
+	}); err != nil {
+		return nil, parseError(err)
 	}
-}
\ No newline at end of file
+
+	return claims, nil
+}
+
+// parseError converts an error returned by the jwt parser to an application error.
+func parseError(err error) error {
+
+	ve, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return apperr.Errorf(apperr.ETOKENMALFORMED, "failed to parse token: %v", err)
+	}
+
+	// errors returned by the key function are already application errors.
+	if e, ok := ve.Inner.(*apperr.Error); ok {
+		return e
+	}
+
+	switch {
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token")
+	case ve.Errors&(jwt.ValidationErrorSignatureInvalid|jwt.ValidationErrorUnverifiable) != 0:
+		return apperr.Errorf(apperr.ETOKENSIGNATURE, "invalid token signature")
+	default:
+		return apperr.Errorf(apperr.EUNAUTHORIZED, "invalid token: %v", err)
+	}
+}
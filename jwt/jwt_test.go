@@ -0,0 +1,151 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// newECKey returns a new ES256 key.
+func newECKey(t *testing.T, id string) *Key {
+	t.Helper()
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Key{ID: id, Method: jwt.SigningMethodES256, SignKey: pk, VerifyKey: &pk.PublicKey}
+}
+
+// newClaims returns the claims of an access token of a test user.
+func newClaims() *entity.AppClaims {
+	user := &entity.User{ID: 1, Username: "mario", Roles: []entity.Role{entity.RoleViewer}}
+
+	claims := entity.NewAppClaims(user, entity.AccessTokenUse, time.Hour)
+	claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	return claims
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	for name, key := range map[string]*Key{
+		"HS256": NewHMACKey("hmac", []byte("secret")),
+		"ES256": newECKey(t, "ec"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := &Codec{Keys: NewKeyRing(key)}
+
+			token, err := c.Encode(context.Background(), newClaims())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := c.Decode(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			} else if claims.Subject != "1" || claims.User.Username != "mario" {
+				t.Fatalf("unexpected claims: %+v", claims)
+			}
+		})
+	}
+}
+
+func TestCodec_Decode_Errors(t *testing.T) {
+	ctx := context.Background()
+
+	ecKey := newECKey(t, "ec")
+	c := &Codec{Keys: NewKeyRing(ecKey)}
+
+	valid, err := c.Encode(ctx, newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a token signed by a key the ring doesn't know.
+	unknown, err := (&Codec{Keys: NewKeyRing(newECKey(t, "other"))}).Encode(ctx, newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a token signed by a different key with the same kid.
+	forged, err := (&Codec{Keys: NewKeyRing(newECKey(t, "ec"))}).Encode(ctx, newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a HS256 token claiming the kid of the EC key, the algorithm confusion attack.
+	confused, err := (&Codec{Keys: NewKeyRing(NewHMACKey("ec", []byte("secret")))}).Encode(ctx, newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the payload of another token with the signature of the valid one.
+	parts := strings.Split(valid, ".")
+	tampered := parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]
+
+	tests := []struct {
+		name  string
+		token string
+		code  string
+	}{
+		{name: "empty", token: "", code: apperr.ETOKENMALFORMED},
+		{name: "malformed", token: "not.a.jwt", code: apperr.ETOKENMALFORMED},
+		{name: "two segments", token: parts[0] + "." + parts[1], code: apperr.ETOKENMALFORMED},
+		{name: "tampered payload", token: tampered, code: apperr.ETOKENSIGNATURE},
+		{name: "unknown kid", token: unknown, code: apperr.ETOKENSIGNATURE},
+		{name: "wrong key", token: forged, code: apperr.ETOKENSIGNATURE},
+		{name: "alg mismatch", token: confused, code: apperr.ETOKENSIGNATURE},
+		{name: "encrypted without encryption key", token: "a.b.c.d.e", code: apperr.ETOKENMALFORMED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := c.Decode(ctx, tt.token); apperr.ErrorCode(err) != tt.code {
+				t.Fatalf("Decode() = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestJWTService_Parse_Time(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	s := NewJWTService("secret")
+	s.Now = func() time.Time { return now }
+
+	user := &entity.User{ID: 1, Username: "mario", Roles: []entity.Role{entity.RoleViewer}}
+
+	token, err := s.IssueMFAChallenge(ctx, user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ParseMFAChallenge(ctx, token); err != nil {
+		t.Fatalf("ParseMFAChallenge() = %v, want nil", err)
+	}
+
+	// the token must not be accepted before it was issued, beyond the leeway.
+	s.Now = func() time.Time { return now.Add(-s.Leeway - time.Second) }
+	if _, err := s.ParseMFAChallenge(ctx, token); apperr.ErrorCode(err) != apperr.ETOKENNOTYETVALID {
+		t.Fatalf("ParseMFAChallenge() = %v, want ETOKENNOTYETVALID", err)
+	}
+
+	s.Now = func() time.Time { return now.Add(entity.MFAChallengeExpiration + s.Leeway + time.Second) }
+	if _, err := s.ParseMFAChallenge(ctx, token); apperr.ErrorCode(err) != apperr.ETOKENEXPIRED {
+		t.Fatalf("ParseMFAChallenge() = %v, want ETOKENEXPIRED", err)
+	}
+
+	// access tokens are not MFA challenges.
+	s.Now = time.Now
+	if _, err := s.Parse(ctx, token); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("Parse() = %v, want EUNAUTHORIZED", err)
+	}
+}
@@ -0,0 +1,219 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"math"
+	"math/big"
+	"mysql/app/apperr"
+	"os"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Key is a key used to sign and verify tokens, identified by the kid header.
+type Key struct {
+	// ID is the key id, it is written in the kid header of the signed tokens.
+	ID string
+
+	// Method is the signing method used with the key.
+	Method jwt.SigningMethod
+
+	// SignKey is the key used to sign tokens:
+	// []byte for HMAC, *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey.
+	SignKey interface{}
+
+	// VerifyKey is the key used to verify tokens:
+	// []byte for HMAC, *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+	VerifyKey interface{}
+}
+
+// NewHMACKey returns a HS256 key using the given secret.
+func NewHMACKey(id string, secret []byte) *Key {
+	return &Key{
+		ID:        id,
+		Method:    jwt.SigningMethodHS256,
+		SignKey:   secret,
+		VerifyKey: secret,
+	}
+}
+
+// LoadKeyFromPEM reads the PEM encoded private key at path and returns a key using the
+// given algorithm, one of RS256, RS384, RS512, ES256, ES384, ES512 or EdDSA.
+func LoadKeyFromPEM(id string, alg string, path string) (*Key, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to read key file: %v", err)
+	}
+
+	return ParseKeyFromPEM(id, alg, data)
+}
+
+// ParseKeyFromPEM returns a key using the given algorithm and PEM encoded private key.
+func ParseKeyFromPEM(id string, alg string, data []byte) (*Key, error) {
+
+	key := &Key{ID: id}
+
+	switch alg {
+	case jwt.SigningMethodRS256.Alg(), jwt.SigningMethodRS384.Alg(), jwt.SigningMethodRS512.Alg():
+		pk, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to parse RSA private key: %v", err)
+		}
+		key.SignKey, key.VerifyKey = pk, &pk.PublicKey
+	case jwt.SigningMethodES256.Alg(), jwt.SigningMethodES384.Alg(), jwt.SigningMethodES512.Alg():
+		pk, err := jwt.ParseECPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to parse EC private key: %v", err)
+		}
+		key.SignKey, key.VerifyKey = pk, &pk.PublicKey
+	case jwt.SigningMethodEdDSA.Alg():
+		pk, err := jwt.ParseEdPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to parse Ed25519 private key: %v", err)
+		}
+		key.SignKey, key.VerifyKey = pk, pk.(ed25519.PrivateKey).Public()
+	default:
+		return nil, apperr.Errorf(apperr.EINVALID, "unsupported signing algorithm: %s", alg)
+	}
+
+	key.Method = jwt.GetSigningMethod(alg)
+
+	return key, nil
+}
+
+// JSONWebKey is the public part of a key, as described by RFC 7517.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg"`
+
+	// RSA keys.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP keys.
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is a set of public keys, as served by the JWKS endpoint.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JSONWebKey returns the public part of the key.
+// Returns false for symmetric keys, which must never be published.
+func (k *Key) JSONWebKey() (JSONWebKey, bool) {
+
+	jwk := JSONWebKey{
+		Use: "sig",
+		Kid: k.ID,
+		Alg: k.Method.Alg(),
+	}
+
+	switch pub := k.VerifyKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeBigInt(pub.N, 0)
+		jwk.E = encodeBigInt(big.NewInt(int64(pub.E)), 0)
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = encodeBigInt(pub.X, size)
+		jwk.Y = encodeBigInt(pub.Y, size)
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	default:
+		return JSONWebKey{}, false
+	}
+
+	return jwk, true
+}
+
+// PublicKey returns the public key described by the JWK:
+// *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+func (k JSONWebKey) PublicKey() (interface{}, error) {
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		} else if !e.IsInt64() || e.Int64() > math.MaxInt32 {
+			return nil, apperr.Errorf(apperr.EINVALID, "key %q: invalid RSA exponent", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, apperr.Errorf(apperr.EINVALID, "key %q: unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, apperr.Errorf(apperr.EINVALID, "key %q: point is not on the curve", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, apperr.Errorf(apperr.EINVALID, "key %q: unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, apperr.Errorf(apperr.EINVALID, "key %q: invalid Ed25519 key", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, apperr.Errorf(apperr.EINVALID, "key %q: unsupported key type %q", k.Kid, k.Kty)
+	}
+}
+
+// decodeBigInt returns the integer encoded by encodeBigInt.
+func decodeBigInt(s string) (*big.Int, error) {
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, apperr.Errorf(apperr.EINVALID, "invalid key parameter")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+// encodeBigInt returns the base64url encoding of n, left padded with zeros to size bytes.
+func encodeBigInt(n *big.Int, size int) string {
+	b := n.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
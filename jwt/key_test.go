@@ -0,0 +1,151 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// newRSAKey returns a new RS256 key.
+func newRSAKey(t *testing.T, id string) *Key {
+	t.Helper()
+
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Key{ID: id, Method: jwt.SigningMethodRS256, SignKey: pk, VerifyKey: &pk.PublicKey}
+}
+
+// newEdKey returns a new EdDSA key.
+func newEdKey(t *testing.T, id string) *Key {
+	t.Helper()
+
+	pub, pk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Key{ID: id, Method: jwt.SigningMethodEdDSA, SignKey: pk, VerifyKey: pub}
+}
+
+func TestKey_JSONWebKey(t *testing.T) {
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		key *Key
+		kty string
+		crv string
+	}{
+		{key: newRSAKey(t, "rsa"), kty: "RSA"},
+		{key: newECKey(t, "ec"), kty: "EC", crv: "P-256"},
+		{key: &Key{ID: "p384", Method: jwt.SigningMethodES384, SignKey: p384, VerifyKey: &p384.PublicKey}, kty: "EC", crv: "P-384"},
+		{key: newEdKey(t, "ed"), kty: "OKP", crv: "Ed25519"},
+	} {
+		t.Run(tt.key.ID, func(t *testing.T) {
+			jwk, ok := tt.key.JSONWebKey()
+			if !ok {
+				t.Fatal("expected a public key")
+			} else if jwk.Kty != tt.kty || jwk.Crv != tt.crv || jwk.Kid != tt.key.ID || jwk.Use != "sig" || jwk.Alg != tt.key.Method.Alg() {
+				t.Fatalf("unexpected JWK: %+v", jwk)
+			}
+
+			// the key survives the JSON encoding of the JWKS endpoint.
+			data, err := json.Marshal(jwk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded JSONWebKey
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+
+			pub, err := decoded.PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(pub, tt.key.VerifyKey) {
+				t.Fatalf("PublicKey() = %v, want %v", pub, tt.key.VerifyKey)
+			}
+
+			// a token signed with the private key is verified with the published key.
+			token, err := jwt.NewWithClaims(tt.key.Method, jwt.StandardClaims{Subject: "1"}).SignedString(tt.key.SignKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return pub, nil }); err != nil {
+				t.Fatalf("failed to verify the token with the published key: %v", err)
+			}
+		})
+	}
+}
+
+func TestKey_JSONWebKey_Symmetric(t *testing.T) {
+	if jwk, ok := NewHMACKey("hmac", []byte("secret")).JSONWebKey(); ok {
+		t.Fatalf("expected the symmetric key not to be published, got %+v", jwk)
+	}
+}
+
+func TestJSONWebKey_PublicKey_Invalid(t *testing.T) {
+	ec, _ := newECKey(t, "ec").JSONWebKey()
+	offCurve := ec
+	offCurve.Y = ec.X
+
+	for name, jwk := range map[string]JSONWebKey{
+		"unknown type":   {Kty: "oct"},
+		"unknown curve":  {Kty: "EC", Crv: "P-192", X: ec.X, Y: ec.Y},
+		"off the curve":  offCurve,
+		"short Ed25519":  {Kty: "OKP", Crv: "Ed25519", X: "AAAA"},
+		"X25519":         {Kty: "OKP", Crv: "X25519", X: ec.X},
+		"malformed RSA":  {Kty: "RSA", N: "!", E: "AQAB"},
+		"large exponent": {Kty: "RSA", N: "AQAB", E: "AQAAAAAAAAAA"},
+	} {
+		if _, err := jwk.PublicKey(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestJWTService_JWKS(t *testing.T) {
+	now := time.Now()
+
+	keys := NewKeyRing(newECKey(t, "current"))
+	keys.Now = func() time.Time { return now }
+	keys.AddVerificationKey(newRSAKey(t, "previous"), now.Add(time.Hour))
+	keys.AddVerificationKey(newEdKey(t, "retired"), now.Add(-time.Second))
+	keys.AddVerificationKey(NewHMACKey("hmac", []byte("secret")), now.Add(time.Hour))
+
+	s := NewJWTServiceWithKeyRing(keys)
+
+	kids := func() []string {
+		var kids []string
+		for _, jwk := range s.JWKS().Keys {
+			kids = append(kids, jwk.Kid)
+		}
+		return kids
+	}
+
+	// the signing key comes first, the symmetric and the retired keys are never published.
+	if got := kids(); !reflect.DeepEqual(got, []string{"current", "previous"}) {
+		t.Fatalf("JWKS kids = %q, want [current previous]", got)
+	}
+
+	now = now.Add(time.Hour)
+	if got := kids(); !reflect.DeepEqual(got, []string{"current"}) {
+		t.Fatalf("JWKS kids = %q, want [current]", got)
+	}
+
+	// a JWKS without public keys is still a valid set.
+	if set := NewJWTService("secret").JWKS(); set.Keys == nil || len(set.Keys) != 0 {
+		t.Fatalf("unexpected JWKS: %+v", set)
+	}
+}
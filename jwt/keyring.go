@@ -0,0 +1,192 @@
+package jwt
+
+import (
+	"encoding/json"
+	"mysql/app/apperr"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// KeyRing holds the key used to sign new tokens and the previous keys that are still
+// accepted to verify the tokens they signed, so that keys can be rotated without
+// invalidating the issued tokens. Keys are selected by the kid header.
+//
+// KeyRing is safe for concurrent use.
+type KeyRing struct {
+	mu      sync.RWMutex
+	current *Key
+	retired map[string]*retiredKey
+
+	// Now returns the current time, it can be replaced in tests.
+	Now func() time.Time
+}
+
+// retiredKey is a key that no longer signs tokens and that is accepted for verification until retireAt.
+type retiredKey struct {
+	key      *Key
+	retireAt time.Time
+}
+
+// NewKeyRing creates a KeyRing signing tokens with the given key.
+func NewKeyRing(current *Key) *KeyRing {
+	return &KeyRing{
+		current: current,
+		retired: make(map[string]*retiredKey),
+		Now:     time.Now,
+	}
+}
+
+// SigningKey returns the key used to sign new tokens.
+func (r *KeyRing) SigningKey() *Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.current
+}
+
+// VerificationKey returns the key with the given id if it can be used to verify tokens.
+func (r *KeyRing) VerificationKey(id string) (*Key, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.current.ID == id {
+		return r.current, true
+	}
+
+	if rk, ok := r.retired[id]; ok && r.Now().Before(rk.retireAt) {
+		return rk.key, true
+	}
+
+	return nil, false
+}
+
+// Rotate replaces the signing key with next. The previous signing key keeps verifying
+// tokens for retireAfter, which should not be shorter than the lifetime of the tokens it signed.
+func (r *KeyRing) Rotate(next *Key, retireAfter time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.retired[r.current.ID] = &retiredKey{key: r.current, retireAt: r.Now().Add(retireAfter)}
+	delete(r.retired, next.ID)
+	r.current = next
+}
+
+// AddVerificationKey adds a key that only verifies tokens, until retireAt.
+func (r *KeyRing) AddVerificationKey(key *Key, retireAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.retired[key.ID] = &retiredKey{key: key, retireAt: retireAt}
+}
+
+// Keys returns the signing key followed by the verification keys that are not retired yet.
+// Retired keys are dropped from the ring.
+func (r *KeyRing) Keys() []*Key {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.Now()
+	keys := []*Key{r.current}
+
+	for id, rk := range r.retired {
+		if !now.Before(rk.retireAt) {
+			delete(r.retired, id)
+			continue
+		}
+		keys = append(keys, rk.key)
+	}
+
+	return keys
+}
+
+// keyRingFile is the format of the file read by LoadKeyRing.
+type keyRingFile struct {
+	Signing      keyFileEntry   `json:"signing"`
+	Verification []keyFileEntry `json:"verification"`
+}
+
+type keyFileEntry struct {
+	ID  string `json:"kid"`
+	Alg string `json:"alg"`
+
+	// File is the path of the PEM private key, relative paths are resolved
+	// from the directory of the key ring file.
+	File string `json:"file"`
+
+	// Secret is the HMAC secret, used when alg is HS256.
+	Secret string `json:"secret"`
+
+	// RetireAt is the time after which a verification key is no longer accepted.
+	RetireAt time.Time `json:"retire_at"`
+}
+
+// LoadKeyRing reads a key ring from a JSON file such as:
+//
+//	{
+//	  "signing": {"kid": "2022-10", "alg": "ES256", "file": "2022-10.pem"},
+//	  "verification": [
+//	    {"kid": "2022-09", "alg": "ES256", "file": "2022-09.pem", "retire_at": "2022-10-16T00:00:00Z"}
+//	  ]
+//	}
+func LoadKeyRing(path string) (*KeyRing, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to read key ring file: %v", err)
+	}
+
+	var f keyRingFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to parse key ring file: %v", err)
+	}
+
+	dir := filepath.Dir(path)
+
+	current, err := f.Signing.load(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewKeyRing(current)
+
+	for _, e := range f.Verification {
+		// a key without retire_at would never verify a token, the entry is most likely a mistake.
+		if e.RetireAt.IsZero() {
+			return nil, apperr.Errorf(apperr.EINVALID, "verification key %q: retire_at is required", e.ID)
+		}
+
+		key, err := e.load(dir)
+		if err != nil {
+			return nil, err
+		} else if key.ID == current.ID {
+			return nil, apperr.Errorf(apperr.EINVALID, "verification key %q has the same id of the signing key", key.ID)
+		}
+		r.AddVerificationKey(key, e.RetireAt)
+	}
+
+	return r, nil
+}
+
+// load returns the key described by the entry.
+func (e keyFileEntry) load(dir string) (*Key, error) {
+
+	if e.ID == "" {
+		return nil, apperr.Errorf(apperr.EINVALID, "key id is required")
+	}
+
+	if e.Alg == "HS256" {
+		if e.Secret == "" {
+			return nil, apperr.Errorf(apperr.EINVALID, "key %q: secret is required", e.ID)
+		}
+		return NewHMACKey(e.ID, []byte(e.Secret)), nil
+	}
+
+	path := e.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	return LoadKeyFromPEM(e.ID, e.Alg, path)
+}
@@ -0,0 +1,98 @@
+package jwt
+
+import (
+	"mysql/app/apperr"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyRing writes a key ring file in a temporary directory and returns its path.
+func writeKeyRing(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	path := writeKeyRing(t, `{
+		"signing": {"kid": "new", "alg": "HS256", "secret": "new-secret"},
+		"verification": [
+			{"kid": "old", "alg": "HS256", "secret": "old-secret", "retire_at": "2100-01-01T00:00:00Z"},
+			{"kid": "retired", "alg": "HS256", "secret": "retired-secret", "retire_at": "2000-01-01T00:00:00Z"}
+		]
+	}`)
+
+	r, err := LoadKeyRing(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.SigningKey().ID; got != "new" {
+		t.Fatalf("SigningKey().ID = %q, want new", got)
+	}
+
+	for kid, want := range map[string]bool{"new": true, "old": true, "retired": false, "unknown": false} {
+		if _, ok := r.VerificationKey(kid); ok != want {
+			t.Errorf("VerificationKey(%q) = %v, want %v", kid, ok, want)
+		}
+	}
+}
+
+func TestLoadKeyRing_Invalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"missing retire_at": `{
+			"signing": {"kid": "new", "alg": "HS256", "secret": "s"},
+			"verification": [{"kid": "old", "alg": "HS256", "secret": "s"}]
+		}`,
+		"same id": `{
+			"signing": {"kid": "new", "alg": "HS256", "secret": "s"},
+			"verification": [{"kid": "new", "alg": "HS256", "secret": "s", "retire_at": "2100-01-01T00:00:00Z"}]
+		}`,
+		"missing kid": `{
+			"signing": {"alg": "HS256", "secret": "s"}
+		}`,
+		"missing secret": `{
+			"signing": {"kid": "new", "alg": "HS256"}
+		}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadKeyRing(writeKeyRing(t, content)); apperr.ErrorCode(err) != apperr.EINVALID {
+				t.Fatalf("LoadKeyRing() = %v, want EINVALID", err)
+			}
+		})
+	}
+}
+
+func TestKeyRing_Rotate(t *testing.T) {
+	now := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	r := NewKeyRing(NewHMACKey("first", []byte("first")))
+	r.Now = func() time.Time { return now }
+
+	r.Rotate(NewHMACKey("second", []byte("second")), time.Hour)
+
+	if got := r.SigningKey().ID; got != "second" {
+		t.Fatalf("SigningKey().ID = %q, want second", got)
+	}
+	if _, ok := r.VerificationKey("first"); !ok {
+		t.Fatal("expected the previous key to still verify tokens")
+	}
+	if n := len(r.Keys()); n != 2 {
+		t.Fatalf("len(Keys()) = %d, want 2", n)
+	}
+
+	now = now.Add(time.Hour)
+
+	if _, ok := r.VerificationKey("first"); ok {
+		t.Fatal("expected the previous key to be retired")
+	}
+	if n := len(r.Keys()); n != 1 {
+		t.Fatalf("len(Keys()) = %d, want 1", n)
+	}
+}
@@ -0,0 +1,57 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ service.Mailer = (*LogMailer)(nil)
+
+// LogMailer writes the messages to a writer instead of sending them, it is meant
+// for local development, where the messages can be read from the console or a file.
+type LogMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLogMailer creates a LogMailer writing the messages to w.
+func NewLogMailer(w io.Writer) *LogMailer {
+	return &LogMailer{w: w}
+}
+
+// NewFileMailer creates a LogMailer appending the messages to the file at path.
+func NewFileMailer(path string) (*LogMailer, error) {
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to open mail file: %v", err)
+	}
+
+	return NewLogMailer(f), nil
+}
+
+// Send implements service.Mailer
+func (m *LogMailer) Send(ctx context.Context, mail *entity.Mail) error {
+	select {
+	case <-ctx.Done():
+		return apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if _, err := fmt.Fprintf(m.w, "Date: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n\r\n",
+			time.Now().Format(time.RFC1123Z), mail.To, mail.Subject, mail.Body,
+		); err != nil {
+			return apperr.Errorf(apperr.EINTERNAL, "failed to write mail: %v", err)
+		}
+
+		return nil
+	}
+}
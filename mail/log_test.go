@@ -0,0 +1,73 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"mysql/app/entity"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// logMessage matches a message written by LogMailer.
+var logMessage = regexp.MustCompile(`^Date: [^\r\n]+\r\nTo: mario@example\.com\r\nSubject: Ciao\r\n\r\nCiao Mario\r\n\r\n$`)
+
+func TestLogMailer_Send(t *testing.T) {
+	var b bytes.Buffer
+	m := NewLogMailer(&b)
+
+	if err := m.Send(context.Background(), &entity.Mail{To: "mario@example.com", Subject: "Ciao", Body: "Ciao Mario"}); err != nil {
+		t.Fatal(err)
+	} else if !logMessage.Match(b.Bytes()) {
+		t.Fatalf("unexpected message %q", b.String())
+	}
+
+	// nothing is written once the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	b.Reset()
+	if err := m.Send(ctx, &entity.Mail{To: "mario@example.com", Subject: "Ciao", Body: "Ciao Mario"}); err == nil {
+		t.Fatal("expected an error")
+	} else if b.Len() != 0 {
+		t.Fatalf("unexpected message %q", b.String())
+	}
+}
+
+func TestFileMailer_Send(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.txt")
+
+	// the messages are appended to the file, also when it is opened again.
+	for i := 0; i < 2; i++ {
+		m, err := NewFileMailer(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Send(context.Background(), &entity.Mail{To: "mario@example.com", Subject: "Ciao", Body: "Ciao Mario"}); err != nil {
+			t.Fatal(err)
+		}
+		m.w.(*os.File).Close()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := bytes.SplitAfter(data, []byte("Ciao Mario\r\n\r\n"))
+	if len(messages) != 3 || len(messages[2]) != 0 {
+		t.Fatalf("expected 2 messages in %q", data)
+	}
+	for _, message := range messages[:2] {
+		if !logMessage.Match(message) {
+			t.Fatalf("unexpected message %q", message)
+		}
+	}
+}
+
+func TestNewFileMailer_Invalid(t *testing.T) {
+	if _, err := NewFileMailer(filepath.Join(t.TempDir(), "missing", "mail.txt")); err == nil {
+		t.Fatal("expected an error")
+	}
+}
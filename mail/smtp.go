@@ -0,0 +1,128 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+var _ service.Mailer = (*SMTPMailer)(nil)
+
+// SMTPMailer sends the messages through an SMTP server.
+type SMTPMailer struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+
+	// From is the sender address of the messages.
+	From string
+
+	// Username and Password authenticate to the server with PLAIN auth, when set.
+	// net/smtp refuses to send them over a connection without TLS, unless the
+	// server is on localhost.
+	Username string
+	Password string
+
+	// TLSConfig is used when the server supports STARTTLS.
+	// If nil, a config with the server host name is used.
+	TLSConfig *tls.Config
+}
+
+// NewSMTPMailer creates a SMTPMailer sending messages from the given address.
+func NewSMTPMailer(addr string, from string) *SMTPMailer {
+	return &SMTPMailer{
+		Addr: addr,
+		From: from,
+	}
+}
+
+// Send implements service.Mailer
+func (m *SMTPMailer) Send(ctx context.Context, mail *entity.Mail) error {
+
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "invalid smtp address: %v", err)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to connect to smtp server: %v", err)
+	}
+	defer conn.Close()
+
+	// net/smtp does not support contexts, the deadline bounds the whole conversation.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to create smtp client: %v", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := m.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: host}
+		}
+		if err := c.StartTLS(config); err != nil {
+			return apperr.Errorf(apperr.EINTERNAL, "failed to start tls: %v", err)
+		}
+	}
+
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return apperr.Errorf(apperr.EINTERNAL, "failed to authenticate to smtp server: %v", err)
+		}
+	}
+
+	if err := c.Mail(m.From); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "smtp MAIL command failed: %v", err)
+	}
+
+	if err := c.Rcpt(mail.To); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "smtp RCPT command failed: %v", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "smtp DATA command failed: %v", err)
+	}
+
+	if _, err := w.Write(m.message(mail)); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to write mail: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to send mail: %v", err)
+	}
+
+	return c.Quit()
+}
+
+// message returns the RFC 5322 message of the mail.
+func (m *SMTPMailer) message(mail *entity.Mail) []byte {
+
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: %s\r\n", m.From)
+	fmt.Fprintf(&b, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(mail.Body, "\r\n", "\n"), "\n", "\r\n"))
+
+	return b.Bytes()
+}
@@ -0,0 +1,169 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"mysql/app/entity"
+	"net"
+	"strings"
+	"testing"
+)
+
+// smtpServer is a minimal SMTP server accepting a single connection,
+// it records the commands and the raw message of the DATA command.
+type smtpServer struct {
+	ln net.Listener
+
+	// rcptReply is the reply to the RCPT command.
+	rcptReply string
+
+	commands []string
+	data     string
+	done     chan struct{}
+}
+
+// newSMTPServer starts a smtpServer on a random port of 127.0.0.1.
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &smtpServer{ln: ln, rcptReply: "250 OK", done: make(chan struct{})}
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *smtpServer) serve() {
+	defer close(s.done)
+
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		s.commands = append(s.commands, line)
+
+		switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case "MAIL":
+			reply("250 OK")
+		case "RCPT":
+			reply(s.rcptReply)
+		case "DATA":
+			reply("354 Go ahead")
+
+			// the raw lines are kept, to check the line endings sent by the client.
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				} else if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.data = data.String()
+
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPMailer_Send(t *testing.T) {
+	s := newSMTPServer(t)
+
+	m := NewSMTPMailer(s.Addr(), "noreply@example.com")
+	if err := m.Send(context.Background(), &entity.Mail{
+		To:      "mario@example.com",
+		Subject: "Città",
+		Body:    "Ciao Mario,\nil link è:\r\nhttps://example.com\n",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	<-s.done
+
+	want := []string{
+		"EHLO localhost",
+		"MAIL FROM:<noreply@example.com> BODY=8BITMIME",
+		"RCPT TO:<mario@example.com>",
+		"DATA",
+		"QUIT",
+	}
+	if strings.Join(s.commands, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("commands = %q, want %q", s.commands, want)
+	}
+
+	header, body, ok := strings.Cut(s.data, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no header in message %q", s.data)
+	}
+
+	for _, h := range []string{
+		"From: noreply@example.com",
+		"To: mario@example.com",
+		"Subject: =?utf-8?q?Citt=C3=A0?=",
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	} {
+		if !strings.Contains(header+"\r\n", h+"\r\n") {
+			t.Errorf("missing header %q in %q", h, header)
+		}
+	}
+	if !strings.Contains(header, "\r\nDate: ") {
+		t.Errorf("missing Date header in %q", header)
+	}
+
+	// every line of the body ends with CRLF, whatever the line endings of the mail.
+	if want := "Ciao Mario,\r\nil link è:\r\nhttps://example.com\r\n"; body != want {
+		t.Fatalf("body = %q, want %q", body, want)
+	}
+}
+
+func TestSMTPMailer_Send_RcptRejected(t *testing.T) {
+	s := newSMTPServer(t)
+	s.rcptReply = "550 No such user"
+
+	m := NewSMTPMailer(s.Addr(), "noreply@example.com")
+	if err := m.Send(context.Background(), &entity.Mail{To: "nessuno@example.com", Subject: "Ciao", Body: "Ciao"}); err == nil {
+		t.Fatal("expected an error")
+	} else if !strings.Contains(err.Error(), "RCPT") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSMTPMailer_Send_Unreachable(t *testing.T) {
+	s := newSMTPServer(t)
+	s.ln.Close()
+
+	m := NewSMTPMailer(s.Addr(), "noreply@example.com")
+	if err := m.Send(context.Background(), &entity.Mail{To: "mario@example.com"}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -2,17 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"mysql/app/entity"
 	"mysql/app/service"
 	"mysql/http"
 	apphttp "mysql/http"
+	"mysql/inmem"
 	"mysql/jwt"
+	"mysql/mail"
+	"mysql/oidc"
+	"mysql/opaque"
+	"mysql/paseto"
+	"mysql/password"
 	appsql "mysql/sql"
+	"mysql/token"
+	"mysql/totp"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -48,14 +61,107 @@ func main() {
 func run(ctx context.Context, db *sql.DB) error {
 
 	sqlCityService := appsql.NewCityService(db)
-	jwtservice := jwt.NewJWTService("lafsjghhpv4950&%$%£&)%éç*§°ç!")
+	sqlUserService := appsql.NewUserService(db)
+	passwordService := password.NewPasswordService()
+	sqlRefreshTokenService := appsql.NewRefreshTokenService(db)
+	sqlAPIKeyService := appsql.NewAPIKeyService(db)
+	sqlPasswordResetService := appsql.NewPasswordResetService(db)
+	sqlMFAService := appsql.NewMFAService(db)
+	sqlSessionService := appsql.NewSessionService(db)
+	sqlSettingService := appsql.NewSettingService(db)
+
+	mailer, err := newMailer()
+	if err != nil {
+		return err
+	}
+
+	passwordPolicyService, err := newPasswordPolicyService(ctx)
+	if err != nil {
+		return err
+	}
+
+	// JWT_BLACKLIST=memory keeps the revoked tokens in process, for development
+	// and single-node deployments that don't want a table just for revocations.
+	var jwtBlacklistService service.JWTBlacklistService
+	switch os.Getenv("JWT_BLACKLIST") {
+	case "memory":
+		jwtBlacklistService = inmem.NewJWTBlacklistService(ctx, inmem.DefaultSweepInterval)
+	default:
+		jwtBlacklistService = appsql.NewJWTBlacklistService(db)
+	}
+
+	tokenService, tokenCore, err := newTokenService(db)
+	if err != nil {
+		return err
+	}
+	if v := os.Getenv("JWT_ISSUER"); v != "" {
+		tokenCore.Issuer = v
+	}
+	if v := os.Getenv("JWT_AUDIENCE"); v != "" {
+		tokenCore.Audience = v
+	}
+	tokenCore.RefreshTokenService = sqlRefreshTokenService
+	tokenCore.UserService = sqlUserService
+	tokenCore.JWTBlacklistService = jwtBlacklistService
+	tokenCore.SessionService = sqlSessionService
 
 	HTTPServerAPI := apphttp.NewServerAPI()
 
 	HTTPServerAPI.Addr = ":8080"
+	// REGISTRATION_ENABLED is the default until an admin changes the stored setting.
+	HTTPServerAPI.SetRegistrationEnabled(os.Getenv("REGISTRATION_ENABLED") == "true")
+	HTTPServerAPI.SettingService = sqlSettingService
 	HTTPServerAPI.CityService = sqlCityService
+	HTTPServerAPI.UserService = sqlUserService
+	HTTPServerAPI.PasswordService = passwordService
+	HTTPServerAPI.PasswordPolicyService = passwordPolicyService
+	HTTPServerAPI.APIKeyService = sqlAPIKeyService
+	HTTPServerAPI.PasswordResetService = sqlPasswordResetService
+	HTTPServerAPI.LoginThrottleService = inmem.NewLoginThrottleService(ctx, inmem.DefaultSweepInterval)
+	HTTPServerAPI.TOTPService = totp.NewTOTPService(entity.TokenIssuer)
+	HTTPServerAPI.MFAService = sqlMFAService
+
+	// MFA_REQUIRED_PERMISSIONS overrides the space separated permissions granted only to
+	// the users with a second factor, users:manage by default.
+	if v := os.Getenv("MFA_REQUIRED_PERMISSIONS"); v != "" {
+		permissions, err := entity.ParseScope(v)
+		if err != nil {
+			return fmt.Errorf("invalid MFA_REQUIRED_PERMISSIONS: %w", err)
+		}
+		HTTPServerAPI.MFARequiredPermissions = permissions
+	}
+	HTTPServerAPI.SessionService = sqlSessionService
+	HTTPServerAPI.Mailer = mailer
+	HTTPServerAPI.PasswordResetURL = os.Getenv("PASSWORD_RESET_URL")
+
+	// TRUSTED_PROXIES lists the comma separated CIDRs of the reverse proxies, the client IP
+	// is then taken from the X-Forwarded-For header they set.
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		var proxies []*net.IPNet
+		for _, cidr := range strings.Split(v, ",") {
+			_, proxy, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return fmt.Errorf("invalid TRUSTED_PROXIES: %q", cidr)
+			}
+			proxies = append(proxies, proxy)
+		}
+		HTTPServerAPI.SetTrustedProxies(proxies)
+	}
 
-	HTTPServerAPI.JWTService = jwtservice
+	HTTPServerAPI.JWTService = tokenService
+	HTTPServerAPI.JWTBlacklistService = jwtBlacklistService
+	HTTPServerAPI.RefreshTokenService = sqlRefreshTokenService
+
+	// OIDC_ISSUER enables the login through an OpenID Connect identity provider,
+	// with OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_REDIRECT_URL. OIDC_PROVISIONING=true creates
+	// the unknown users, OIDC_EMAIL_LINKING=true links them to the users with the same verified email.
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		HTTPServerAPI.OIDCProvider = oidc.NewProvider(issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), os.Getenv("OIDC_REDIRECT_URL"))
+		HTTPServerAPI.OIDCLoginService = inmem.NewOIDCLoginService(ctx, inmem.DefaultSweepInterval)
+		HTTPServerAPI.IdentityService = appsql.NewIdentityService(db)
+		HTTPServerAPI.OIDCProvisioning = os.Getenv("OIDC_PROVISIONING") == "true"
+		HTTPServerAPI.OIDCEmailLinking = os.Getenv("OIDC_EMAIL_LINKING") == "true"
+	}
 
 	if err := HTTPServerAPI.Open(); err != nil {
 		return err
@@ -70,6 +176,186 @@ func run(ctx context.Context, db *sql.DB) error {
 	return nil
 }
 
+// newMailer returns the mailer used to send emails to the users.
+// SMTP_ADDR selects an SMTP server, with SMTP_FROM, SMTP_USERNAME and SMTP_PASSWORD.
+// Otherwise the emails are appended to MAIL_FILE, or written to the standard output.
+func newMailer() (service.Mailer, error) {
+
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		m := mail.NewSMTPMailer(addr, os.Getenv("SMTP_FROM"))
+		m.Username = os.Getenv("SMTP_USERNAME")
+		m.Password = os.Getenv("SMTP_PASSWORD")
+		return m, nil
+	}
+
+	if path := os.Getenv("MAIL_FILE"); path != "" {
+		return mail.NewFileMailer(path)
+	}
+
+	return mail.NewLogMailer(os.Stdout), nil
+}
+
+// newPasswordPolicyService returns the policy checking the passwords chosen by the users, see
+// password.DefaultPolicy. PASSWORD_MIN_LENGTH overrides the minimum length, PASSWORD_REQUIRE_SYMBOL=true
+// also requires a symbol and PASSWORD_BANNED adds comma separated banned substrings.
+// PASSWORD_BREACHED_FILE points to a list of breached password hashes, see password.HashFile,
+// which is closed when ctx is done.
+func newPasswordPolicyService(ctx context.Context) (*password.PolicyService, error) {
+
+	policy := password.DefaultPolicy
+
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PASSWORD_MIN_LENGTH: %q", v)
+		}
+		policy.MinLength = n
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid PASSWORD_MIN_LENGTH: %v", err)
+	}
+
+	policy.RequireSymbol = os.Getenv("PASSWORD_REQUIRE_SYMBOL") == "true"
+
+	if v := os.Getenv("PASSWORD_BANNED"); v != "" {
+		policy.BannedSubstrings = append(append([]string{}, policy.BannedSubstrings...), strings.Split(v, ",")...)
+	}
+
+	s := password.NewPolicyService(policy)
+
+	if path := os.Getenv("PASSWORD_BREACHED_FILE"); path != "" {
+		hashes, err := password.OpenHashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s.Breached = password.NewBreachedPasswords(hashes)
+
+		go func() {
+			<-ctx.Done()
+			hashes.Close()
+		}()
+	}
+
+	return s, nil
+}
+
+// newTokenService returns the service issuing the tokens, in the format selected by TOKEN_FORMAT,
+// along with the format independent service it embeds:
+//   - jwt (default): JWT tokens signed with the keys returned by loadJWTKeys,
+//     and encrypted with the key returned by loadJWTEncryptionKey if any; the tokens that are
+//     only signed are rejected if JWT_REQUIRE_ENCRYPTION is true;
+//   - paseto: PASETO v4.public tokens, the keys returned by loadJWTKeys must be Ed25519 keys
+//     (JWT_SIGNING_ALG=EdDSA);
+//   - opaque: random reference tokens whose claims are stored in the database.
+func newTokenService(db *sql.DB) (service.JWTService, *token.Service, error) {
+
+	switch format := os.Getenv("TOKEN_FORMAT"); format {
+	case "", "jwt":
+		keys, err := loadJWTKeys()
+		if err != nil {
+			return nil, nil, err
+		}
+		s := jwt.NewJWTServiceWithKeyRing(keys)
+
+		encryptionKey, err := loadJWTEncryptionKey()
+		if err != nil {
+			return nil, nil, err
+		} else if encryptionKey != nil {
+			s.EncryptTokens(encryptionKey, os.Getenv("JWT_REQUIRE_ENCRYPTION") == "true")
+		}
+
+		return s, s.Service, nil
+	case "paseto":
+		keys, err := loadJWTKeys()
+		if err != nil {
+			return nil, nil, err
+		}
+		s, err := paseto.NewTokenService(keys)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, s.Service, nil
+	case "opaque":
+		s := opaque.NewTokenService(appsql.NewOpaqueTokenService(db))
+		return s, s.Service, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown TOKEN_FORMAT: %q", format)
+	}
+}
+
+// loadJWTKeys returns the keys used to sign and verify the JWT tokens.
+// JWT_KEYRING_FILE points to a key ring file, see jwt.LoadKeyRing, that allows
+// to rotate the signing key while keeping the previous ones for verification.
+// Otherwise a single key is used, see loadJWTKey.
+func loadJWTKeys() (*jwt.KeyRing, error) {
+
+	if path := os.Getenv("JWT_KEYRING_FILE"); path != "" {
+		return jwt.LoadKeyRing(path)
+	}
+
+	key, err := loadJWTKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.NewKeyRing(key), nil
+}
+
+// loadJWTKey returns the key used to sign the JWT tokens.
+// When JWT_PRIVATE_KEY_FILE is set the PEM private key it points to is used with
+// JWT_SIGNING_ALG (RS256 by default), otherwise tokens are signed with HS256 and JWT_SECRET.
+// One of them is required: for development JWT_EPHEMERAL_SECRET=true signs the tokens with
+// a random secret, the issued tokens are no longer valid once the process exits.
+func loadJWTKey() (*jwt.Key, error) {
+
+	kid := os.Getenv("JWT_KEY_ID")
+	if kid == "" {
+		kid = "default"
+	}
+
+	if path := os.Getenv("JWT_PRIVATE_KEY_FILE"); path != "" {
+		alg := os.Getenv("JWT_SIGNING_ALG")
+		if alg == "" {
+			alg = "RS256"
+		}
+		return jwt.LoadKeyFromPEM(kid, alg, path)
+	}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		return jwt.NewHMACKey(kid, []byte(secret)), nil
+	}
+
+	if os.Getenv("JWT_EPHEMERAL_SECRET") != "true" {
+		return nil, fmt.Errorf("no JWT signing key: set JWT_KEYRING_FILE, JWT_PRIVATE_KEY_FILE or JWT_SECRET")
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate the JWT secret: %v", err)
+	}
+	log.Println("JWT_EPHEMERAL_SECRET set, signing the tokens with a random secret")
+
+	return jwt.NewHMACKey(kid, secret), nil
+}
+
+// loadJWTEncryptionKey returns the key encrypting the JWT tokens, if JWT_ENCRYPTION_KEY is set
+// to a base64 encoded 32 bytes key. JWT_ENCRYPTION_KEY_ID sets its id.
+func loadJWTEncryptionKey() (*jwt.EncryptionKey, error) {
+
+	encoded := os.Getenv("JWT_ENCRYPTION_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_ENCRYPTION_KEY: %v", err)
+	}
+
+	return jwt.NewEncryptionKey(os.Getenv("JWT_ENCRYPTION_KEY_ID"), secret)
+}
+
 func testSql() {
 
 	db, err := sql.Open("mysql", "root:root@tcp(127.0.0.1:3306)/go-test?parseTime=true")
@@ -0,0 +1,399 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	appjwt "mysql/jwt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// DefaultLeeway is the clock skew tolerated by default with the identity provider.
+const DefaultLeeway = 1 * time.Minute
+
+// minKeysRefreshInterval limits how often the keys of the provider are fetched again
+// when an ID token is signed by an unknown key.
+const minKeysRefreshInterval = 1 * time.Minute
+
+// maxResponseSize is the maximum size of a response of the provider.
+const maxResponseSize = 1 << 20
+
+// signingMethods are the algorithms accepted for the ID tokens.
+var signingMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+var _ service.OIDCProvider = (*Provider)(nil)
+
+// Provider is an OpenID Connect identity provider used with the authorization code flow and PKCE.
+// The provider configuration is discovered from the issuer on first use.
+type Provider struct {
+	// Issuer is the URL of the provider, as found in the iss claim of its ID tokens.
+	Issuer string
+
+	// ClientID and ClientSecret are the credentials of this application at the provider,
+	// ClientSecret is empty for public clients.
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the callback the provider sends the user back to.
+	RedirectURL string
+
+	// Scopes are the requested scopes, openid is always included.
+	Scopes []string
+
+	// Leeway is the clock skew tolerated when checking the exp and iat claims.
+	Leeway time.Duration
+
+	HTTPClient *http.Client
+
+	// Now returns the current time, it can be replaced in tests.
+	Now func() time.Time
+
+	mu            sync.Mutex
+	metadata      *Metadata
+	keys          map[string]interface{} // kid -> public key
+	keysFetchedAt time.Time
+}
+
+// Metadata is the provider configuration published at /.well-known/openid-configuration.
+type Metadata struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	JWKSURI                       string   `json:"jwks_uri"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+}
+
+func NewProvider(issuer string, clientID string, clientSecret string, redirectURL string) *Provider {
+	return &Provider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "profile", "email"},
+		Leeway:       DefaultLeeway,
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+		Now:          time.Now,
+	}
+}
+
+// AuthCodeURL implements service.OIDCProvider
+func (p *Provider) AuthCodeURL(ctx context.Context, login *entity.OIDCLogin) (string, error) {
+
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURL)
+	params.Set("scope", p.scope())
+	params.Set("state", login.State)
+	params.Set("nonce", login.Nonce)
+	params.Set("code_challenge", CodeChallenge(login.CodeVerifier))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return metadata.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// ExchangeCode implements service.OIDCProvider
+func (p *Provider) ExchangeCode(ctx context.Context, login *entity.OIDCLogin, code string) (*entity.Identity, error) {
+
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", login.CodeVerifier)
+
+	// public clients only identify themselves, see RFC 6749 section 2.3.1.
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to create token request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	var response struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	status, err := p.do(req, &response)
+	if err != nil {
+		return nil, err
+	} else if status != http.StatusOK {
+		if response.Error != "" && response.ErrorDescription != "" {
+			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "identity provider: %s: %s", response.Error, response.ErrorDescription)
+		} else if response.Error != "" {
+			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "identity provider: %s", response.Error)
+		}
+		return nil, apperr.Errorf(apperr.EINTERNAL, "identity provider token endpoint returned %d", status)
+	} else if response.IDToken == "" {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "identity provider returned no id token")
+	}
+
+	return p.verifyIDToken(ctx, metadata, response.IDToken, login.Nonce)
+}
+
+// idTokenClaims are the claims of an ID token used by the login.
+type idTokenClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	AZP       string   `json:"azp"`
+	ExpiresAt int64    `json:"exp"`
+	IssuedAt  int64    `json:"iat"`
+	Nonce     string   `json:"nonce"`
+
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// Valid implements jwt.Claims, the claims are checked by verifyIDToken.
+func (c *idTokenClaims) Valid() error {
+	return nil
+}
+
+// audience is the aud claim, either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+
+	return nil
+}
+
+func (a audience) contains(v string) bool {
+	for _, aud := range a {
+		if aud == v {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyIDToken verifies the ID token as described by OpenID Connect Core section 3.1.3.7
+// and returns the identity it describes.
+func (p *Provider) verifyIDToken(ctx context.Context, metadata *Metadata, token string, nonce string) (*entity.Identity, error) {
+
+	parser := &jwt.Parser{ValidMethods: signingMethods, SkipClaimsValidation: true}
+
+	claims := &idTokenClaims{}
+
+	if _, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, metadata, kid)
+	}); err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok {
+			if e, ok := ve.Inner.(*apperr.Error); ok {
+				return nil, e
+			}
+		}
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "invalid id token: %v", err)
+	}
+
+	now := p.Now()
+	leeway := int64(p.Leeway / time.Second)
+
+	switch {
+	case claims.Issuer != metadata.Issuer:
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unexpected id token issuer")
+	case !claims.Audience.contains(p.ClientID):
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unexpected id token audience")
+	case len(claims.Audience) > 1 && claims.AZP != p.ClientID:
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unexpected id token authorized party")
+	case claims.ExpiresAt == 0 || now.Unix() > claims.ExpiresAt+leeway:
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "id token expired")
+	case now.Unix() < claims.IssuedAt-leeway:
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "id token issued in the future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unexpected id token nonce")
+	case claims.Subject == "":
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "id token has no subject")
+	}
+
+	return &entity.Identity{
+		Issuer:            claims.Issuer,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+// discover returns the configuration of the provider, fetched on first use.
+func (p *Provider) discover(ctx context.Context) (*Metadata, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to create discovery request: %v", err)
+	}
+
+	var metadata Metadata
+	if status, err := p.do(req, &metadata); err != nil {
+		return nil, err
+	} else if status != http.StatusOK {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "identity provider discovery returned %d", status)
+	}
+
+	// the issuer must be the one configured, see OpenID Connect Discovery section 4.3.
+	if metadata.Issuer != p.Issuer {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "identity provider issuer %q does not match %q", metadata.Issuer, p.Issuer)
+	}
+
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "identity provider configuration is incomplete")
+	}
+
+	p.metadata = &metadata
+
+	return p.metadata, nil
+}
+
+// key returns the public key of the provider with the given id.
+// The keys are fetched again when the id is unknown, as the provider may have rotated them.
+func (p *Provider) key(ctx context.Context, metadata *Metadata, kid string) (interface{}, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	if p.keys != nil && p.Now().Sub(p.keysFetchedAt) < minKeysRefreshInterval {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unknown id token key: %q", kid)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadata.JWKSURI, nil)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to create jwks request: %v", err)
+	}
+
+	var set appjwt.JSONWebKeySet
+	if status, err := p.do(req, &set); err != nil {
+		return nil, err
+	} else if status != http.StatusOK {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "identity provider jwks returned %d", status)
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// keys that can't be parsed are skipped, they may use algorithms we don't support.
+		if key, err := jwk.PublicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	p.keys, p.keysFetchedAt = keys, p.Now()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unknown id token key: %q", kid)
+}
+
+// lookupKey returns the key with the given id, an empty id matches the only key of the provider.
+func (p *Provider) lookupKey(kid string) (interface{}, bool) {
+
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+
+	key, ok := p.keys[kid]
+
+	return key, ok
+}
+
+// do sends the request to the provider and decodes the JSON response in v.
+func (p *Provider) do(req *http.Request, v interface{}) (int, error) {
+
+	res, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return 0, apperr.Errorf(apperr.EINTERNAL, "identity provider request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxResponseSize)).Decode(v); err != nil && res.StatusCode == http.StatusOK {
+		return 0, apperr.Errorf(apperr.EINTERNAL, "failed to decode identity provider response: %v", err)
+	}
+
+	return res.StatusCode, nil
+}
+
+// scope returns the requested scopes, including openid.
+func (p *Provider) scope() string {
+
+	for _, s := range p.Scopes {
+		if s == "openid" {
+			return strings.Join(p.Scopes, " ")
+		}
+	}
+
+	return strings.Join(append([]string{"openid"}, p.Scopes...), " ")
+}
+
+// CodeChallenge returns the S256 PKCE challenge of the verifier, see RFC 7636 section 4.2.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
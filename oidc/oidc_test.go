@@ -0,0 +1,262 @@
+package oidc_test
+
+import (
+	"context"
+	"encoding/json"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/oidc"
+	"mysql/oidc/oidctest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const redirectURL = "http://localhost/callback"
+
+// newTestProvider starts a mock provider and returns a Provider using it.
+func newTestProvider(t *testing.T) (*oidc.Provider, *oidctest.Server) {
+	t.Helper()
+
+	srv := oidctest.NewServer("client", "secret")
+	t.Cleanup(srv.Close)
+
+	return oidc.NewProvider(srv.Issuer(), "client", "secret", redirectURL), srv
+}
+
+// authorize starts a login at the provider and returns the authorization code it redirects back with.
+func authorize(t *testing.T, p *oidc.Provider, login *entity.OIDCLogin) string {
+	t.Helper()
+
+	authURL, err := p.AuthCodeURL(context.Background(), login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := location.Query()
+	if q.Get("state") != login.State {
+		t.Fatalf("state = %q, want %q", q.Get("state"), login.State)
+	} else if q.Get("code") == "" {
+		t.Fatalf("no code in the redirect: %s", location)
+	}
+
+	return q.Get("code")
+}
+
+// newLogin returns a new pending login.
+func newLogin(t *testing.T) *entity.OIDCLogin {
+	t.Helper()
+
+	login, err := entity.NewOIDCLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return login
+}
+
+func TestProvider_AuthCodeURL(t *testing.T) {
+	p, srv := newTestProvider(t)
+	login := newLogin(t)
+
+	authURL, err := p.AuthCodeURL(context.Background(), login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the authorization endpoint comes from the discovery document.
+	if got := u.Scheme + "://" + u.Host + u.Path; got != srv.URL+"/authorize" {
+		t.Fatalf("endpoint = %s, want %s", got, srv.URL+"/authorize")
+	}
+
+	q := u.Query()
+	for param, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             "client",
+		"redirect_uri":          redirectURL,
+		"scope":                 "openid profile email",
+		"state":                 login.State,
+		"nonce":                 login.Nonce,
+		"code_challenge":        oidc.CodeChallenge(login.CodeVerifier),
+		"code_challenge_method": "S256",
+	} {
+		if got := q.Get(param); got != want {
+			t.Errorf("%s = %q, want %q", param, got, want)
+		}
+	}
+
+	// the verifier itself must never leave the server.
+	if q.Get("code_verifier") != "" {
+		t.Fatal("the code verifier must not be sent to the authorization endpoint")
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// the example of RFC 7636 appendix B.
+	if got := oidc.CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Fatalf("CodeChallenge() = %s", got)
+	}
+}
+
+func TestProvider_Discovery_IssuerMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidc.Metadata{
+			Issuer:                "https://attacker.example.com",
+			AuthorizationEndpoint: "https://attacker.example.com/authorize",
+			TokenEndpoint:         "https://attacker.example.com/token",
+			JWKSURI:               "https://attacker.example.com/jwks",
+		})
+	}))
+	defer srv.Close()
+
+	p := oidc.NewProvider(srv.URL, "client", "secret", redirectURL)
+
+	if _, err := p.AuthCodeURL(context.Background(), newLogin(t)); apperr.ErrorCode(err) != apperr.EINTERNAL {
+		t.Fatalf("AuthCodeURL() = %v, want EINTERNAL", err)
+	}
+}
+
+func TestProvider_ExchangeCode(t *testing.T) {
+	p, srv := newTestProvider(t)
+	login := newLogin(t)
+
+	identity, err := p.ExchangeCode(context.Background(), login, authorize(t, p, login))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.Issuer != srv.Issuer() || identity.Subject != srv.User.Subject ||
+		identity.Email != srv.User.Email || !identity.EmailVerified ||
+		identity.Name != srv.User.Name || identity.PreferredUsername != srv.User.PreferredUsername {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+}
+
+func TestProvider_ExchangeCode_Rejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		// login changes the login after the authorization, if not nil.
+		login func(*entity.OIDCLogin)
+	}{
+		{
+			name:  "wrong code verifier",
+			login: func(l *entity.OIDCLogin) { l.CodeVerifier = "another verifier" },
+		},
+		{
+			name:  "wrong nonce",
+			login: func(l *entity.OIDCLogin) { l.Nonce = "another nonce" },
+		},
+		{
+			name:   "wrong issuer",
+			claims: map[string]interface{}{"iss": "https://attacker.example.com"},
+		},
+		{
+			name:   "wrong audience",
+			claims: map[string]interface{}{"aud": "another-client"},
+		},
+		{
+			name:   "multiple audiences without azp",
+			claims: map[string]interface{}{"aud": []string{"client", "another-client"}},
+		},
+		{
+			name:   "wrong authorized party",
+			claims: map[string]interface{}{"aud": []string{"client", "another-client"}, "azp": "another-client"},
+		},
+		{
+			name:   "expired",
+			claims: map[string]interface{}{"exp": time.Now().Add(-oidc.DefaultLeeway - time.Minute).Unix()},
+		},
+		{
+			name:   "no expiration",
+			claims: map[string]interface{}{"exp": 0},
+		},
+		{
+			name:   "issued in the future",
+			claims: map[string]interface{}{"iat": time.Now().Add(oidc.DefaultLeeway + time.Minute).Unix()},
+		},
+		{
+			name:   "no subject",
+			claims: map[string]interface{}{"sub": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, srv := newTestProvider(t)
+			srv.Claims = tt.claims
+
+			login := newLogin(t)
+			code := authorize(t, p, login)
+
+			if tt.login != nil {
+				tt.login(login)
+			}
+
+			if _, err := p.ExchangeCode(context.Background(), login, code); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+				t.Fatalf("ExchangeCode() = %v, want EUNAUTHORIZED", err)
+			}
+		})
+	}
+}
+
+func TestProvider_ExchangeCode_Accepted(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+	}{
+		{
+			name:   "multiple audiences with azp",
+			claims: map[string]interface{}{"aud": []string{"client", "another-client"}, "azp": "client"},
+		},
+		{
+			name:   "expired within the leeway",
+			claims: map[string]interface{}{"exp": time.Now().Add(-oidc.DefaultLeeway / 2).Unix()},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, srv := newTestProvider(t)
+			srv.Claims = tt.claims
+
+			login := newLogin(t)
+			if _, err := p.ExchangeCode(context.Background(), login, authorize(t, p, login)); err != nil {
+				t.Fatalf("ExchangeCode() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestProvider_ExchangeCode_CodeReuse(t *testing.T) {
+	p, _ := newTestProvider(t)
+	login := newLogin(t)
+	code := authorize(t, p, login)
+
+	if _, err := p.ExchangeCode(context.Background(), login, code); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.ExchangeCode(context.Background(), login, code); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("ExchangeCode() = %v, want EUNAUTHORIZED", err)
+	}
+}
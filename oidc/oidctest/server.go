@@ -0,0 +1,239 @@
+package oidctest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	appjwt "mysql/jwt"
+	"mysql/oidc"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// codeExpiration is the time an authorization code can be redeemed for.
+const codeExpiration = 1 * time.Minute
+
+// Server is a mock OpenID Connect identity provider, for tests and local development.
+// Every authorization request of the registered client is approved at once for User,
+// without any interaction.
+type Server struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+
+	// User is the user logged in at the provider.
+	User User
+
+	// Claims are set in the ID tokens over the standard ones, so that tests can check
+	// how invalid tokens are handled.
+	Claims map[string]interface{}
+
+	key *appjwt.Key
+
+	mu    sync.Mutex
+	codes map[string]*authorization
+}
+
+// User is the user described by the ID tokens of the mock provider.
+type User struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// authorization is an authorization code waiting to be redeemed.
+type authorization struct {
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	expiresAt     time.Time
+}
+
+// NewServer starts a mock provider for the client with the given credentials.
+// The server must be closed by the caller.
+func NewServer(clientID string, clientSecret string) *Server {
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		User: User{
+			Subject:           "mock-user",
+			Email:             "mock-user@example.com",
+			EmailVerified:     true,
+			Name:              "Mock User",
+			PreferredUsername: "mock-user",
+		},
+		key:   &appjwt.Key{ID: "mock", Method: jwt.SigningMethodES256, SignKey: pk, VerifyKey: &pk.PublicKey},
+		codes: make(map[string]*authorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.handleDiscovery)
+	mux.HandleFunc("/authorize", s.handleAuthorize)
+	mux.HandleFunc("/token", s.handleToken)
+	mux.HandleFunc("/jwks", s.handleJWKS)
+
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Issuer returns the issuer of the provider.
+func (s *Server) Issuer() string {
+	return s.URL
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, oidc.Metadata{
+		Issuer:                        s.URL,
+		AuthorizationEndpoint:         s.URL + "/authorize",
+		TokenEndpoint:                 s.URL + "/token",
+		JWKSURI:                       s.URL + "/jwks",
+		CodeChallengeMethodsSupported: []string{"S256"},
+	})
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	jwk, _ := s.key.JSONWebKey()
+	writeJSON(w, http.StatusOK, appjwt.JSONWebKeySet{Keys: []appjwt.JSONWebKey{jwk}})
+}
+
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+
+	q := r.URL.Query()
+
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("redirect_uri") == "" || q.Get("client_id") != s.ClientID {
+		http.Error(w, "invalid client or redirect uri", http.StatusBadRequest)
+		return
+	}
+
+	params := redirectURI.Query()
+	params.Set("state", q.Get("state"))
+
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		params.Set("error", "invalid_request")
+	} else {
+		code := randomString()
+
+		s.mu.Lock()
+		s.codes[code] = &authorization{
+			redirectURI:   q.Get("redirect_uri"),
+			nonce:         q.Get("nonce"),
+			codeChallenge: q.Get("code_challenge"),
+			expiresAt:     time.Now().Add(codeExpiration),
+		}
+		s.mu.Unlock()
+
+		params.Set("code", code)
+	}
+
+	redirectURI.RawQuery = params.Encode()
+
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	if clientID != s.ClientID || clientSecret != s.ClientSecret {
+		writeError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	s.mu.Lock()
+	auth, ok := s.codes[r.PostFormValue("code")]
+	delete(s.codes, r.PostFormValue("code"))
+	s.mu.Unlock()
+
+	if !ok || time.Now().After(auth.expiresAt) ||
+		auth.redirectURI != r.PostFormValue("redirect_uri") ||
+		oidc.CodeChallenge(r.PostFormValue("code_verifier")) != auth.codeChallenge {
+		writeError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+
+	claims := jwt.MapClaims{
+		"iss":                s.URL,
+		"sub":                s.User.Subject,
+		"aud":                s.ClientID,
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              auth.nonce,
+		"email":              s.User.Email,
+		"email_verified":     s.User.EmailVerified,
+		"name":               s.User.Name,
+		"preferred_username": s.User.PreferredUsername,
+	}
+	for k, v := range s.Claims {
+		claims[k] = v
+	}
+
+	t := jwt.NewWithClaims(s.key.Method, claims)
+	t.Header["kid"] = s.key.ID
+
+	idToken, err := t.SignedString(s.key.SignKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,68 @@
+package opaque
+
+import (
+	"context"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"mysql/token"
+	"time"
+)
+
+var _ service.JWTService = (*TokenService)(nil)
+
+// TokenService issues opaque reference tokens, see token.Service. The tokens are random
+// strings, their claims are stored server side and looked up on every request.
+type TokenService struct {
+	*token.Service
+}
+
+// NewTokenService creates a TokenService storing the claims of the tokens in store.
+func NewTokenService(store service.OpaqueTokenService) *TokenService {
+	return &TokenService{
+		Service: token.NewService(&Codec{Store: store}),
+	}
+}
+
+var _ token.Codec = (*Codec)(nil)
+
+// Codec issues random tokens and keeps their claims in the Store.
+type Codec struct {
+	Store service.OpaqueTokenService
+}
+
+// Encode implements token.Codec
+func (c *Codec) Encode(ctx context.Context, claims *entity.AppClaims) (string, error) {
+
+	t, err := entity.NewOpaqueToken()
+	if err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to generate token: %v", err)
+	}
+
+	if err := c.Store.CreateOpaqueToken(ctx, &entity.OpaqueToken{
+		TokenHash: entity.HashOpaqueToken(t),
+		Claims:    claims,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+	}); err != nil {
+		return "", err
+	}
+
+	return t, nil
+}
+
+// Decode implements token.Codec
+func (c *Codec) Decode(ctx context.Context, t string) (*entity.AppClaims, error) {
+
+	if t == "" {
+		return nil, apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token")
+	}
+
+	stored, err := c.Store.FindOpaqueToken(ctx, entity.HashOpaqueToken(t))
+	if apperr.ErrorCode(err) == apperr.ENOTFOUND {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unknown token")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return stored.Claims, nil
+}
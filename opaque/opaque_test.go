@@ -0,0 +1,134 @@
+package opaque
+
+import (
+	"context"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"testing"
+	"time"
+)
+
+// store is an OpaqueTokenService keeping the tokens in memory.
+type store map[string]*entity.OpaqueToken
+
+func (s store) CreateOpaqueToken(ctx context.Context, token *entity.OpaqueToken) error {
+	s[token.TokenHash] = token
+	return nil
+}
+
+func (s store) FindOpaqueToken(ctx context.Context, tokenHash string) (*entity.OpaqueToken, error) {
+	if token, ok := s[tokenHash]; ok && time.Now().Before(token.ExpiresAt) {
+		return token, nil
+	}
+	return nil, apperr.Errorf(apperr.ENOTFOUND, "token not found")
+}
+
+// newClaims returns the claims of an access token of a test user.
+func newClaims() *entity.AppClaims {
+	user := &entity.User{ID: 1, Username: "mario", Roles: []entity.Role{entity.RoleViewer}}
+	return entity.NewAppClaims(user, entity.AccessTokenUse, time.Hour)
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	s := store{}
+	c := &Codec{Store: s}
+
+	claims := newClaims()
+
+	token, err := c.Encode(ctx, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the hash of the token is stored.
+	stored, ok := s[entity.HashOpaqueToken(token)]
+	if !ok {
+		t.Fatal("expected the hash of the token to be stored")
+	} else if _, ok := s[token]; ok {
+		t.Fatal("the token itself must not be stored")
+	} else if !stored.ExpiresAt.Equal(time.Unix(claims.ExpiresAt, 0)) {
+		t.Fatalf("ExpiresAt = %v, want the exp claim", stored.ExpiresAt)
+	}
+
+	decoded, err := c.Decode(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	} else if decoded.Id != claims.Id || decoded.Subject != claims.Subject {
+		t.Fatalf("Decode() = %+v, want %+v", decoded, claims)
+	}
+
+	// every token is a new random string.
+	if other, err := c.Encode(ctx, claims); err != nil {
+		t.Fatal(err)
+	} else if other == token {
+		t.Fatal("expected a different token")
+	}
+}
+
+func TestCodec_Decode_Errors(t *testing.T) {
+	ctx := context.Background()
+
+	s := store{}
+	c := &Codec{Store: s}
+
+	token, err := c.Encode(ctx, newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := []byte(token)
+	tampered[0] ^= 1
+
+	tests := []struct {
+		name  string
+		token string
+		code  string
+	}{
+		{name: "empty", token: "", code: apperr.ETOKENMALFORMED},
+		{name: "unknown", token: "unknown", code: apperr.EUNAUTHORIZED},
+		{name: "tampered", token: string(tampered), code: apperr.EUNAUTHORIZED},
+		{name: "hash", token: entity.HashOpaqueToken(token), code: apperr.EUNAUTHORIZED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := c.Decode(ctx, tt.token); apperr.ErrorCode(err) != tt.code {
+				t.Fatalf("Decode() = %v, want %s", err, tt.code)
+			}
+		})
+	}
+
+	// expired tokens are no longer returned by the store.
+	s[entity.HashOpaqueToken(token)].ExpiresAt = time.Now().Add(-time.Second)
+
+	if _, err := c.Decode(ctx, token); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("Decode() = %v, want EUNAUTHORIZED", err)
+	}
+}
+
+func TestTokenService_Parse(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewTokenService(store{})
+
+	user := &entity.User{ID: 1, Username: "mario", Roles: []entity.Role{entity.RoleViewer}}
+
+	token, err := s.IssueMFAChallenge(ctx, user, []entity.Permission{entity.PermissionCitiesRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := s.ParseMFAChallenge(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	} else if claims.Subject != "1" || claims.Scope != "cities:read" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+
+	// the claims are validated like the ones of any other format.
+	if _, err := s.Parse(ctx, token); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("Parse() = %v, want EUNAUTHORIZED for a MFA token", err)
+	}
+}
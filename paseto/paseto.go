@@ -0,0 +1,260 @@
+package paseto
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"mysql/jwt"
+	"mysql/token"
+	"strings"
+	"time"
+)
+
+// header is the header of the v4.public tokens, signed with Ed25519.
+const header = "v4.public."
+
+// timeClaims are the registered claims holding a time, they are numbers in the JWT
+// claims and RFC 3339 strings in PASETO.
+var timeClaims = []string{"exp", "nbf", "iat"}
+
+var _ service.JWTService = (*TokenService)(nil)
+
+// TokenService issues PASETO v4.public tokens, see token.Service.
+type TokenService struct {
+	*token.Service
+
+	// Keys holds the Ed25519 key signing the issued tokens and the keys verifying the received ones.
+	Keys *jwt.KeyRing
+}
+
+// NewTokenService creates a TokenService using the keys of the given ring, which must all be Ed25519 keys.
+func NewTokenService(keys *jwt.KeyRing) (*TokenService, error) {
+
+	for _, key := range keys.Keys() {
+		if _, ok := key.SignKey.(ed25519.PrivateKey); !ok {
+			return nil, apperr.Errorf(apperr.EINVALID, "key %q: PASETO v4 requires an Ed25519 key", key.ID)
+		}
+	}
+
+	return &TokenService{
+		Service: token.NewService(&Codec{Keys: keys}),
+		Keys:    keys,
+	}, nil
+}
+
+var _ token.Codec = (*Codec)(nil)
+
+// Codec encodes the claims as PASETO v4.public tokens. The id of the signing key
+// is written in the footer as {"kid":"..."}.
+type Codec struct {
+	Keys *jwt.KeyRing
+}
+
+// footer is the footer of the issued tokens.
+type footer struct {
+	Kid string `json:"kid"`
+}
+
+// Encode implements token.Codec
+func (c *Codec) Encode(ctx context.Context, claims *entity.AppClaims) (string, error) {
+
+	key := c.Keys.SigningKey()
+
+	sk, ok := key.SignKey.(ed25519.PrivateKey)
+	if !ok {
+		return "", apperr.Errorf(apperr.EINTERNAL, "key %q is not an Ed25519 key", key.ID)
+	}
+
+	payload, err := encodeClaims(claims)
+	if err != nil {
+		return "", err
+	}
+
+	var f []byte
+	if key.ID != "" {
+		if f, err = json.Marshal(footer{Kid: key.ID}); err != nil {
+			return "", apperr.Errorf(apperr.EINTERNAL, "failed to encode footer: %v", err)
+		}
+	}
+
+	return sign(sk, payload, f), nil
+}
+
+// Decode implements token.Codec
+func (c *Codec) Decode(ctx context.Context, token string) (*entity.AppClaims, error) {
+
+	payload, sig, f, err := split(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var kid string
+	if len(f) > 0 {
+		var decoded footer
+		if err := json.Unmarshal(f, &decoded); err != nil {
+			return nil, apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token footer")
+		}
+		kid = decoded.Kid
+	}
+
+	key, ok := c.Keys.VerificationKey(kid)
+	if !ok {
+		return nil, apperr.Errorf(apperr.ETOKENSIGNATURE, "unknown key id: %q", kid)
+	}
+
+	pk, ok := key.VerifyKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, apperr.Errorf(apperr.ETOKENSIGNATURE, "key %q is not an Ed25519 key", kid)
+	}
+
+	if !verify(pk, payload, sig, f) {
+		return nil, apperr.Errorf(apperr.ETOKENSIGNATURE, "invalid token signature")
+	}
+
+	return decodeClaims(payload)
+}
+
+// sign returns the v4.public token of the payload and of the optional footer, signed with sk.
+func sign(sk ed25519.PrivateKey, payload []byte, f []byte) string {
+
+	sig := ed25519.Sign(sk, pae([]byte(header), payload, f, nil))
+
+	t := header + base64.RawURLEncoding.EncodeToString(append(append([]byte{}, payload...), sig...))
+	if len(f) > 0 {
+		t += "." + base64.RawURLEncoding.EncodeToString(f)
+	}
+
+	return t
+}
+
+// split returns the payload, the signature and the footer of a v4.public token, without verifying it.
+func split(token string) (payload []byte, sig []byte, f []byte, err error) {
+
+	if !strings.HasPrefix(token, header) {
+		return nil, nil, nil, apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(token, header), ".")
+	if len(parts) > 2 {
+		return nil, nil, nil, apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token")
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(body) < ed25519.SignatureSize {
+		return nil, nil, nil, apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token")
+	}
+
+	if len(parts) == 2 {
+		if f, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+			return nil, nil, nil, apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token footer")
+		}
+	}
+
+	return body[:len(body)-ed25519.SignatureSize], body[len(body)-ed25519.SignatureSize:], f, nil
+}
+
+// verify reports whether sig is the signature of the payload and of the footer by pk.
+func verify(pk ed25519.PublicKey, payload []byte, sig []byte, f []byte) bool {
+	return ed25519.Verify(pk, pae([]byte(header), payload, f, nil), sig)
+}
+
+// encodeClaims returns the claims as a PASETO payload.
+func encodeClaims(claims *entity.AppClaims) ([]byte, error) {
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to encode claims: %v", err)
+	}
+
+	var m map[string]interface{}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&m); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to encode claims: %v", err)
+	}
+
+	for _, name := range timeClaims {
+		if n, ok := m[name].(json.Number); ok {
+			sec, err := n.Int64()
+			if err != nil {
+				return nil, apperr.Errorf(apperr.EINTERNAL, "invalid %s claim: %v", name, err)
+			}
+			m[name] = time.Unix(sec, 0).UTC().Format(time.RFC3339)
+		}
+	}
+
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to encode claims: %v", err)
+	}
+
+	return payload, nil
+}
+
+// decodeClaims returns the claims of a PASETO payload.
+func decodeClaims(payload []byte) (*entity.AppClaims, error) {
+
+	var m map[string]interface{}
+
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&m); err != nil {
+		return nil, apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token payload")
+	}
+
+	for _, name := range timeClaims {
+		v, ok := m[name]
+		if !ok {
+			continue
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			return nil, apperr.Errorf(apperr.ETOKENMALFORMED, "invalid %s claim", name)
+		}
+
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, apperr.Errorf(apperr.ETOKENMALFORMED, "invalid %s claim", name)
+		}
+		m[name] = t.Unix()
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token payload")
+	}
+
+	claims := &entity.AppClaims{}
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token payload")
+	}
+
+	return claims, nil
+}
+
+// pae is the pre-authentication encoding of the pieces, see the PASETO specification.
+func pae(pieces ...[]byte) []byte {
+
+	buf := le64(uint64(len(pieces)))
+	for _, p := range pieces {
+		buf = append(buf, le64(uint64(len(p)))...)
+		buf = append(buf, p...)
+	}
+
+	return buf
+}
+
+// le64 encodes n as a little endian 64 bit integer with the most significant bit cleared.
+func le64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, n&^(1<<63))
+	return b
+}
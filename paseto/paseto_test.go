@@ -0,0 +1,290 @@
+package paseto
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/jwt"
+	"strings"
+	"testing"
+	"time"
+
+	gojwt "github.com/golang-jwt/jwt"
+)
+
+// The test vector 4-S-1 of the PASETO specification, docs/vectors/v4.json.
+const (
+	vectorSecretKey = "b4cbfb43df4ce210727d953e4a713307fa19bb7d9f85041438d9e11b942a3774" +
+		"1eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2"
+	vectorPublicKey = "1eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2"
+	vectorPayload   = `{"data":"this is a signed message","exp":"2022-01-01T00:00:00+00:00"}`
+	vectorToken     = "v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9" +
+		"bg_XBBzds8lTZShVlwwKSgeKpLT3yukTw6JUz3W4h_ExsQV-P0V54zemZDcAxFaSeef1QlXEFtkqxT1ciiQEDA"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSign_Vector(t *testing.T) {
+	sk := ed25519.PrivateKey(decodeHex(t, vectorSecretKey))
+
+	if got := sign(sk, []byte(vectorPayload), nil); got != vectorToken {
+		t.Fatalf("sign() = %s, want %s", got, vectorToken)
+	}
+}
+
+func TestVerify_Vector(t *testing.T) {
+	pk := ed25519.PublicKey(decodeHex(t, vectorPublicKey))
+
+	payload, sig, f, err := split(vectorToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(payload) != vectorPayload {
+		t.Fatalf("payload = %s, want %s", payload, vectorPayload)
+	} else if len(f) != 0 {
+		t.Fatalf("footer = %s, want none", f)
+	} else if !verify(pk, payload, sig, f) {
+		t.Fatal("expected the signature of the vector to be valid")
+	}
+
+	// the footer is authenticated as well.
+	if verify(pk, payload, sig, []byte(`{"kid":"other"}`)) {
+		t.Fatal("expected the signature to be invalid with a footer")
+	}
+}
+
+func TestPAE(t *testing.T) {
+	// the examples of the PAE section of the specification.
+	for _, tt := range []struct {
+		pieces [][]byte
+		want   string
+	}{
+		{pieces: nil, want: "\x00\x00\x00\x00\x00\x00\x00\x00"},
+		{pieces: [][]byte{{}}, want: "\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"},
+		{pieces: [][]byte{[]byte("test")}, want: "\x01\x00\x00\x00\x00\x00\x00\x00\x04\x00\x00\x00\x00\x00\x00\x00test"},
+	} {
+		if got := pae(tt.pieces...); !bytes.Equal(got, []byte(tt.want)) {
+			t.Errorf("pae(%q) = %q, want %q", tt.pieces, got, tt.want)
+		}
+	}
+}
+
+// newEd25519Key returns a new Ed25519 key.
+func newEd25519Key(t *testing.T, id string) *jwt.Key {
+	t.Helper()
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &jwt.Key{ID: id, Method: gojwt.SigningMethodEdDSA, SignKey: sk, VerifyKey: pk}
+}
+
+// newClaims returns the claims of an access token of a test user.
+func newClaims() *entity.AppClaims {
+	user := &entity.User{ID: 1, Username: "mario", Roles: []entity.Role{entity.RoleViewer}}
+
+	claims := entity.NewAppClaims(user, entity.AccessTokenUse, time.Hour)
+	claims.Scope = "cities:read"
+	return claims
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	for _, id := range []string{"key", ""} {
+		c := &Codec{Keys: jwt.NewKeyRing(newEd25519Key(t, id))}
+
+		claims := newClaims()
+
+		token, err := c.Encode(ctx, claims)
+		if err != nil {
+			t.Fatal(err)
+		} else if !strings.HasPrefix(token, header) {
+			t.Fatalf("token = %s, want the %s header", token, header)
+		} else if hasFooter := strings.Count(token, ".") == 3; hasFooter != (id != "") {
+			t.Fatalf("token = %s, want a footer only with a key id", token)
+		}
+
+		decoded, err := c.Decode(ctx, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded.Id != claims.Id || decoded.Subject != claims.Subject || decoded.Scope != claims.Scope ||
+			decoded.ExpiresAt != claims.ExpiresAt || decoded.IssuedAt != claims.IssuedAt || decoded.NotBefore != claims.NotBefore ||
+			decoded.User.Username != claims.User.Username {
+			t.Fatalf("Decode() = %+v, want %+v", decoded, claims)
+		}
+	}
+}
+
+func TestCodec_TimeClaims(t *testing.T) {
+	claims := newClaims()
+	claims.ExpiresAt = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+	payload, err := encodeClaims(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// time claims are RFC 3339 strings, as required by the specification.
+	if !bytes.Contains(payload, []byte(`"exp":"2022-01-01T00:00:00Z"`)) {
+		t.Fatalf("payload = %s, want exp as a RFC 3339 string", payload)
+	}
+
+	for _, payload := range []string{
+		`{"exp":1640995200}`,
+		`{"exp":"yesterday"}`,
+		`not json`,
+	} {
+		if _, err := decodeClaims([]byte(payload)); apperr.ErrorCode(err) != apperr.ETOKENMALFORMED {
+			t.Errorf("decodeClaims(%s) = %v, want ETOKENMALFORMED", payload, err)
+		}
+	}
+}
+
+func TestCodec_Decode_Errors(t *testing.T) {
+	ctx := context.Background()
+
+	key := newEd25519Key(t, "key")
+	c := &Codec{Keys: jwt.NewKeyRing(key)}
+
+	valid, err := c.Encode(ctx, newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens signed by another key, with an unknown and with the same id.
+	unknown, err := (&Codec{Keys: jwt.NewKeyRing(newEd25519Key(t, "other"))}).Encode(ctx, newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := (&Codec{Keys: jwt.NewKeyRing(newEd25519Key(t, "key"))}).Encode(ctx, newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, f := strings.Split(strings.TrimPrefix(valid, header), ".")[0], strings.Split(valid, ".")[3]
+
+	raw, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[0] ^= 1
+	tampered := header + base64.RawURLEncoding.EncodeToString(raw) + "." + f
+
+	// the valid token with its footer replaced, naming another key.
+	otherFooter := header + body + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"kid":"other"}`))
+
+	tests := []struct {
+		name  string
+		token string
+		code  string
+	}{
+		{name: "empty", token: "", code: apperr.ETOKENMALFORMED},
+		{name: "jwt", token: "eyJhbGciOiJIUzI1NiJ9.e30.sig", code: apperr.ETOKENMALFORMED},
+		{name: "local", token: strings.Replace(valid, "v4.public.", "v4.local.", 1), code: apperr.ETOKENMALFORMED},
+		{name: "too many parts", token: valid + ".extra", code: apperr.ETOKENMALFORMED},
+		{name: "short body", token: header + "AAAA", code: apperr.ETOKENMALFORMED},
+		{name: "malformed footer", token: header + body + ".e30!", code: apperr.ETOKENMALFORMED},
+		{name: "footer not json", token: header + body + "." + base64.RawURLEncoding.EncodeToString([]byte("kid")), code: apperr.ETOKENMALFORMED},
+		{name: "tampered payload", token: tampered, code: apperr.ETOKENSIGNATURE},
+		{name: "tampered footer", token: otherFooter, code: apperr.ETOKENSIGNATURE},
+		{name: "unknown kid", token: unknown, code: apperr.ETOKENSIGNATURE},
+		{name: "wrong key", token: forged, code: apperr.ETOKENSIGNATURE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := c.Decode(ctx, tt.token); apperr.ErrorCode(err) != tt.code {
+				t.Fatalf("Decode() = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestCodec_Rotation(t *testing.T) {
+	ctx := context.Background()
+
+	keys := jwt.NewKeyRing(newEd25519Key(t, "first"))
+	c := &Codec{Keys: keys}
+
+	token, err := c.Encode(ctx, newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.Rotate(newEd25519Key(t, "second"), time.Hour)
+
+	// tokens signed by the previous key are still accepted until it retires.
+	if _, err := c.Decode(ctx, token); err != nil {
+		t.Fatalf("Decode() = %v, want nil", err)
+	}
+
+	keys.Now = func() time.Time { return time.Now().Add(time.Hour) }
+
+	if _, err := c.Decode(ctx, token); apperr.ErrorCode(err) != apperr.ETOKENSIGNATURE {
+		t.Fatalf("Decode() = %v, want ETOKENSIGNATURE", err)
+	}
+}
+
+func TestNewTokenService(t *testing.T) {
+	if _, err := NewTokenService(jwt.NewKeyRing(newEd25519Key(t, "key"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// v4.public tokens can only be signed with Ed25519.
+	if _, err := NewTokenService(jwt.NewKeyRing(jwt.NewHMACKey("key", []byte("secret")))); apperr.ErrorCode(err) != apperr.EINVALID {
+		t.Fatalf("NewTokenService() = %v, want EINVALID", err)
+	}
+
+	keys := jwt.NewKeyRing(newEd25519Key(t, "key"))
+	keys.AddVerificationKey(jwt.NewHMACKey("old", []byte("secret")), time.Now().Add(time.Hour))
+
+	if _, err := NewTokenService(keys); apperr.ErrorCode(err) != apperr.EINVALID {
+		t.Fatalf("NewTokenService() = %v, want EINVALID for a HMAC verification key", err)
+	}
+}
+
+func TestTokenService_Parse(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewTokenService(jwt.NewKeyRing(newEd25519Key(t, "key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &entity.User{ID: 1, Username: "mario", Roles: []entity.Role{entity.RoleViewer}}
+
+	token, err := s.IssueMFAChallenge(ctx, user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims, err := s.ParseMFAChallenge(ctx, token); err != nil {
+		t.Fatal(err)
+	} else if claims.Subject != "1" {
+		t.Fatalf("Subject = %q, want 1", claims.Subject)
+	}
+
+	s.Now = func() time.Time { return time.Now().Add(entity.MFAChallengeExpiration + s.Leeway + time.Second) }
+
+	if _, err := s.ParseMFAChallenge(ctx, token); apperr.ErrorCode(err) != apperr.ETOKENEXPIRED {
+		t.Fatalf("ParseMFAChallenge() = %v, want ETOKENEXPIRED", err)
+	}
+}
@@ -0,0 +1,186 @@
+package password
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"mysql/app/apperr"
+	"os"
+	"strings"
+)
+
+// HashPrefixLength is the number of hex characters of the SHA-1 hash a RangeSource is queried with.
+const HashPrefixLength = 5
+
+// RangeSource returns the suffixes of the breached password hashes starting with a prefix,
+// the uppercase hex SHA-1 hashes without their first HashPrefixLength characters.
+type RangeSource interface {
+	Range(ctx context.Context, prefix string) ([]string, error)
+}
+
+// BreachedPasswords checks the passwords against a list of breached passwords with the
+// k-anonymity model of the Pwned Passwords API: the source is only queried with the prefix
+// of the SHA-1 hash of the password, the suffixes are compared locally.
+type BreachedPasswords struct {
+	Source RangeSource
+}
+
+func NewBreachedPasswords(source RangeSource) *BreachedPasswords {
+	return &BreachedPasswords{
+		Source: source,
+	}
+}
+
+// Contains returns true if the password appears in the list.
+func (b *BreachedPasswords) Contains(ctx context.Context, password string) (bool, error) {
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:HashPrefixLength], hash[HashPrefixLength:]
+
+	suffixes, err := b.Source.Range(ctx, prefix)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range suffixes {
+		if s == suffix {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+var _ RangeSource = (*HashFile)(nil)
+
+// HashFile is a local list of breached password hashes, one uppercase hex SHA-1 hash per line
+// optionally followed by :count, sorted by hash, like the ordered by hash Pwned Passwords
+// download. The ranges are found with a binary search, the file is never loaded in memory.
+type HashFile struct {
+	f    *os.File
+	size int64
+}
+
+// OpenHashFile opens the hash file at path.
+func OpenHashFile(path string) (*HashFile, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to open breached passwords file: %v", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to stat breached passwords file: %v", err)
+	}
+
+	return &HashFile{f: f, size: info.Size()}, nil
+}
+
+// Close closes the file.
+func (h *HashFile) Close() error {
+	return h.f.Close()
+}
+
+// Range implements RangeSource
+func (h *HashFile) Range(ctx context.Context, prefix string) ([]string, error) {
+
+	prefix = strings.ToUpper(prefix)
+
+	// the first line whose hash is not lower than the prefix is searched among the lines
+	// starting at or after each offset, which are sorted as the offsets.
+	lo, hi := int64(0), h.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, err := h.lineStart(mid)
+		if err != nil {
+			return nil, err
+		}
+
+		if start >= h.size {
+			hi = mid
+			continue
+		}
+
+		line, err := h.lineAt(start)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.ToUpper(line) >= prefix {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	start, err := h.lineStart(lo)
+	if err != nil {
+		return nil, err
+	}
+
+	var suffixes []string
+
+	scanner := bufio.NewScanner(io.NewSectionReader(h.f, start, h.size-start))
+	for scanner.Scan() {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		hash = strings.ToUpper(hash)
+		if !strings.HasPrefix(hash, prefix) {
+			break
+		}
+		suffixes = append(suffixes, hash[len(prefix):])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to read breached passwords file: %v", err)
+	}
+
+	return suffixes, nil
+}
+
+// lineStart returns the offset of the first line starting at or after off, the size of the file if there is none.
+func (h *HashFile) lineStart(off int64) (int64, error) {
+
+	if off == 0 {
+		return 0, nil
+	}
+
+	// the line starts after the first newline found from the previous byte.
+	buf := make([]byte, 128)
+	for pos := off - 1; pos < h.size; pos += int64(len(buf)) {
+		n, err := h.f.ReadAt(buf, pos)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, apperr.Errorf(apperr.EINTERNAL, "failed to read breached passwords file: %v", err)
+		}
+	}
+
+	return h.size, nil
+}
+
+// lineAt returns the hash of the line starting at off.
+func (h *HashFile) lineAt(off int64) (string, error) {
+
+	buf := make([]byte, 64)
+	n, err := h.f.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to read breached passwords file: %v", err)
+	}
+
+	line := buf[:n]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	hash, _, _ := strings.Cut(strings.TrimSpace(string(line)), ":")
+
+	return hash, nil
+}
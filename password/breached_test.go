@@ -0,0 +1,142 @@
+package password
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fixture are the lines of a small hash file, sorted by hash. The first and the last
+// prefixes have two hashes each, to test the ranges at both ends of the file.
+var fixture = []string{
+	"00000A1B2C3D4E5F60718293A4B5C6D7E8F:12",
+	"00000B1B2C3D4E5F60718293A4B5C6D7E8F",
+	"12345C1B2C3D4E5F60718293A4B5C6D7E8F:3",
+	"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824", // password
+	"ABCDE01B2C3D4E5F60718293A4B5C6D7E8F:1",
+	"FFFFF01B2C3D4E5F60718293A4B5C6D7E8F:7",
+	"FFFFF11B2C3D4E5F60718293A4B5C6D7E8F:2",
+}
+
+// writeHashFile writes the lines to a hash file separated by sep and opens it.
+func writeHashFile(t *testing.T, lines []string, sep string) *HashFile {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "hashes.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, sep)+sep), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := OpenHashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+
+	return h
+}
+
+func TestHashFile_Range(t *testing.T) {
+	for name, sep := range map[string]string{"LF": "\n", "CRLF": "\r\n"} {
+		t.Run(name, func(t *testing.T) {
+			h := writeHashFile(t, fixture, sep)
+
+			for _, tt := range []struct {
+				prefix string
+				want   []string
+			}{
+				{prefix: "00000", want: []string{"A1B2C3D4E5F60718293A4B5C6D7E8F", "B1B2C3D4E5F60718293A4B5C6D7E8F"}},
+				{prefix: "12345", want: []string{"C1B2C3D4E5F60718293A4B5C6D7E8F"}},
+				{prefix: "5baa6", want: []string{"1E4C9B93F3F0682250B6CF8331B7EE68FD8"}},
+				{prefix: "FFFFF", want: []string{"01B2C3D4E5F60718293A4B5C6D7E8F", "11B2C3D4E5F60718293A4B5C6D7E8F"}},
+				// missing prefixes, before, between and after the hashes.
+				{prefix: "00001"},
+				{prefix: "ABCDD"},
+				{prefix: "FFFFE"},
+			} {
+				got, err := h.Range(context.Background(), tt.prefix)
+				if err != nil {
+					t.Fatal(err)
+				} else if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Range(%q) = %q, want %q", tt.prefix, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHashFile_Range_Empty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.txt")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := OpenHashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	if got, err := h.Range(context.Background(), "00000"); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Fatalf("Range = %q, want none", got)
+	}
+}
+
+func TestHashFile_Range_Large(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	// hashes sharing few prefixes, so that the ranges span several lines.
+	want := make(map[string][]string)
+	var lines []string
+	for i := 0; i < 2000; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprint(i)))
+		hash := fmt.Sprintf("%05X", r.Intn(64)) + strings.ToUpper(hex.EncodeToString(sum[:]))[HashPrefixLength:]
+		lines = append(lines, fmt.Sprintf("%s:%d", hash, i))
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		want[line[:HashPrefixLength]] = append(want[line[:HashPrefixLength]], line[HashPrefixLength:strings.IndexByte(line, ':')])
+	}
+
+	h := writeHashFile(t, lines, "\n")
+
+	for prefix, suffixes := range want {
+		if got, err := h.Range(context.Background(), prefix); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, suffixes) {
+			t.Fatalf("Range(%q) = %d suffixes, want %d", prefix, len(got), len(suffixes))
+		}
+	}
+}
+
+func TestOpenHashFile_Missing(t *testing.T) {
+	if _, err := OpenHashFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestBreachedPasswords_Contains(t *testing.T) {
+	b := NewBreachedPasswords(writeHashFile(t, fixture, "\n"))
+
+	for password, want := range map[string]bool{
+		"password":           true,
+		"Password":           false,
+		"una-password-nuova": false,
+	} {
+		if got, err := b.Contains(context.Background(), password); err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Errorf("Contains(%q) = %v, want %v", password, got, want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package password
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"mysql/app/apperr"
+	"mysql/app/service"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ service.PasswordService = (*PasswordService)(nil)
+
+// Params are the argon2id parameters used to hash new passwords.
+type Params struct {
+	// Memory is the amount of memory used by the algorithm, in KiB.
+	Memory uint32
+	// Iterations is the number of passes over the memory.
+	Iterations uint32
+	// Parallelism is the number of threads used by the algorithm.
+	Parallelism uint8
+	// SaltLength is the length of the random salt, in bytes.
+	SaltLength uint32
+	// KeyLength is the length of the generated hash, in bytes.
+	KeyLength uint32
+}
+
+// DefaultParams follows the OWASP recommendations for argon2id.
+var DefaultParams = Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// PasswordService hashes passwords with argon2id using the PHC string format:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//
+// bcrypt hashes are still accepted by Compare, but they are always reported
+// as needing a rehash.
+type PasswordService struct {
+	Params Params
+}
+
+func NewPasswordService() *PasswordService {
+	return &PasswordService{
+		Params: DefaultParams,
+	}
+}
+
+// Hash implements service.PasswordService
+func (s *PasswordService) Hash(ctx context.Context, password string) (string, error) {
+
+	salt := make([]byte, s.Params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to generate salt: %v", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, s.Params.Iterations, s.Params.Memory, s.Params.Parallelism, s.Params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		s.Params.Memory,
+		s.Params.Iterations,
+		s.Params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Compare implements service.PasswordService
+func (s *PasswordService) Compare(ctx context.Context, password string, hash string) (match bool, rehash bool, err error) {
+
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return s.compareArgon2id(password, hash)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, apperr.Errorf(apperr.EINTERNAL, "failed to compare bcrypt hash: %v", err)
+		}
+		return true, true, nil
+	default:
+		return false, false, apperr.Errorf(apperr.EINTERNAL, "unknown password hash format")
+	}
+}
+
+func (s *PasswordService) compareArgon2id(password string, hash string) (match bool, rehash bool, err error) {
+
+	// "", "argon2id", "v=19", "m=65536,t=3,p=2", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, false, apperr.Errorf(apperr.EINTERNAL, "malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, false, apperr.Errorf(apperr.EINTERNAL, "malformed argon2id version: %v", err)
+	} else if version != argon2.Version {
+		return false, false, apperr.Errorf(apperr.EINTERNAL, "unsupported argon2id version: %d", version)
+	}
+
+	var p Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return false, false, apperr.Errorf(apperr.EINTERNAL, "malformed argon2id parameters: %v", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, apperr.Errorf(apperr.EINTERNAL, "malformed argon2id salt: %v", err)
+	}
+	p.SaltLength = uint32(len(salt))
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, apperr.Errorf(apperr.EINTERNAL, "malformed argon2id key: %v", err)
+	}
+	p.KeyLength = uint32(len(key))
+
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false, nil
+	}
+
+	return true, p != s.Params, nil
+}
@@ -0,0 +1,111 @@
+package password
+
+import (
+	"context"
+	"mysql/app/apperr"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testParams keep the tests fast, they are not meant to be secure.
+var testParams = Params{
+	Memory:      1024,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func TestPasswordService_HashCompare(t *testing.T) {
+	ctx := context.Background()
+	s := &PasswordService{Params: testParams}
+
+	hash, err := s.Hash(ctx, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("unexpected hash format: %s", hash)
+	}
+
+	if other, err := s.Hash(ctx, "s3cret"); err != nil {
+		t.Fatal(err)
+	} else if other == hash {
+		t.Fatal("expected a random salt")
+	}
+
+	if match, rehash, err := s.Compare(ctx, "s3cret", hash); err != nil {
+		t.Fatal(err)
+	} else if !match || rehash {
+		t.Fatalf("match=%v rehash=%v, want match without rehash", match, rehash)
+	}
+
+	if match, _, err := s.Compare(ctx, "wrong", hash); err != nil {
+		t.Fatal(err)
+	} else if match {
+		t.Fatal("expected the wrong password not to match")
+	}
+}
+
+func TestPasswordService_Compare_Rehash(t *testing.T) {
+	ctx := context.Background()
+
+	old := &PasswordService{Params: testParams}
+	hash, err := old.Hash(ctx, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := testParams
+	params.Iterations = 2
+	s := &PasswordService{Params: params}
+
+	if match, rehash, err := s.Compare(ctx, "s3cret", hash); err != nil {
+		t.Fatal(err)
+	} else if !match || !rehash {
+		t.Fatalf("match=%v rehash=%v, want match with rehash", match, rehash)
+	}
+}
+
+func TestPasswordService_Compare_Bcrypt(t *testing.T) {
+	ctx := context.Background()
+	s := &PasswordService{Params: testParams}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if match, rehash, err := s.Compare(ctx, "s3cret", string(hash)); err != nil {
+		t.Fatal(err)
+	} else if !match || !rehash {
+		t.Fatalf("match=%v rehash=%v, want match with rehash", match, rehash)
+	}
+
+	if match, _, err := s.Compare(ctx, "wrong", string(hash)); err != nil {
+		t.Fatal(err)
+	} else if match {
+		t.Fatal("expected the wrong password not to match")
+	}
+}
+
+func TestPasswordService_Compare_Malformed(t *testing.T) {
+	ctx := context.Background()
+	s := &PasswordService{Params: testParams}
+
+	for _, hash := range []string{
+		"",
+		"plain",
+		"$argon2id$v=19$m=1024,t=1,p=1$salt",
+		"$argon2id$v=18$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=x,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!!$a2V5",
+	} {
+		if _, _, err := s.Compare(ctx, "s3cret", hash); apperr.ErrorCode(err) != apperr.EINTERNAL {
+			t.Errorf("Compare(%q) = %v, want EINTERNAL", hash, err)
+		}
+	}
+}
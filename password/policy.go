@@ -0,0 +1,162 @@
+package password
+
+import (
+	"context"
+	"fmt"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var _ service.PasswordPolicyService = (*PolicyService)(nil)
+
+// minBannedLength is the length under which the username, the email and the name of the
+// user are not banned from the password, short ones would ban too many passwords.
+const minBannedLength = 3
+
+// Policy are the rules a password must satisfy. Lengths are counted in characters.
+type Policy struct {
+	MinLength int
+	MaxLength int
+
+	RequireLowercase bool
+	RequireUppercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+
+	// BannedSubstrings can't appear in the password, case insensitively.
+	// The username, the email and the name of the user are always banned.
+	BannedSubstrings []string
+}
+
+// DefaultPolicy requires 10 characters mixing lowercase and uppercase letters and digits.
+var DefaultPolicy = Policy{
+	MinLength:        10,
+	MaxLength:        128,
+	RequireLowercase: true,
+	RequireUppercase: true,
+	RequireDigit:     true,
+	BannedSubstrings: []string{"password", "123456", "qwerty"},
+}
+
+// Validate returns EINVALID if no password can satisfy the lengths of the policy.
+func (p Policy) Validate() error {
+
+	if p.MinLength < 1 {
+		return apperr.Errorf(apperr.EINVALID, "the minimum password length must be at least 1")
+	}
+
+	if p.MaxLength > 0 && p.MinLength > p.MaxLength {
+		return apperr.Errorf(apperr.EINVALID, "the minimum password length (%d) exceeds the maximum one (%d)", p.MinLength, p.MaxLength)
+	}
+
+	return nil
+}
+
+// PolicyService validates the passwords against the Policy and, if Breached is set,
+// rejects the passwords that appear in a breach.
+type PolicyService struct {
+	Policy Policy
+
+	Breached *BreachedPasswords
+}
+
+func NewPolicyService(policy Policy) *PolicyService {
+	return &PolicyService{
+		Policy: policy,
+	}
+}
+
+// Validate implements service.PasswordPolicyService
+func (s *PolicyService) Validate(ctx context.Context, password string, user *entity.User) ([]entity.PasswordViolation, error) {
+
+	var violations []entity.PasswordViolation
+	violate := func(code string, format string, args ...interface{}) {
+		violations = append(violations, entity.PasswordViolation{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	p := s.Policy
+
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		violate(entity.PasswordTooShort, "la password deve contenere almeno %d caratteri", p.MinLength)
+	} else if p.MaxLength > 0 && n > p.MaxLength {
+		violate(entity.PasswordTooLong, "la password può contenere al massimo %d caratteri", p.MaxLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireLowercase && !lower {
+		violate(entity.PasswordMissingLowercase, "la password deve contenere una lettera minuscola")
+	}
+	if p.RequireUppercase && !upper {
+		violate(entity.PasswordMissingUppercase, "la password deve contenere una lettera maiuscola")
+	}
+	if p.RequireDigit && !digit {
+		violate(entity.PasswordMissingDigit, "la password deve contenere un numero")
+	}
+	if p.RequireSymbol && !symbol {
+		violate(entity.PasswordMissingSymbol, "la password deve contenere un simbolo")
+	}
+
+	lowered := strings.ToLower(password)
+	for _, banned := range s.banned(user) {
+		if strings.Contains(lowered, banned) {
+			violate(entity.PasswordBannedSubstring, "la password non può contenere %q", banned)
+		}
+	}
+
+	if s.Breached != nil {
+		if breached, err := s.Breached.Contains(ctx, password); err != nil {
+			return nil, err
+		} else if breached {
+			violate(entity.PasswordBreached, "la password compare in un elenco di password violate")
+		}
+	}
+
+	return violations, nil
+}
+
+// banned returns the lowercase substrings banned from the password of the user.
+func (s *PolicyService) banned(user *entity.User) []string {
+
+	var banned []string
+	seen := make(map[string]bool)
+	add := func(v string, minLength int) {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" || utf8.RuneCountInString(v) < minLength || seen[v] {
+			return
+		}
+		seen[v] = true
+		banned = append(banned, v)
+	}
+
+	for _, v := range s.Policy.BannedSubstrings {
+		add(v, 1)
+	}
+
+	if user != nil {
+		local, _, _ := strings.Cut(user.Email, "@")
+		add(user.Username, minBannedLength)
+		add(local, minBannedLength)
+		for _, v := range strings.Fields(user.Name) {
+			add(v, minBannedLength)
+		}
+	}
+
+	return banned
+}
@@ -0,0 +1,108 @@
+package password
+
+import (
+	"context"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// codes returns the codes of the violations.
+func codes(violations []entity.PasswordViolation) []string {
+	var c []string
+	for _, v := range violations {
+		c = append(c, v.Code)
+	}
+	return c
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		policy Policy
+		valid  bool
+	}{
+		{name: "default", policy: DefaultPolicy, valid: true},
+		{name: "min equals max", policy: Policy{MinLength: 12, MaxLength: 12}, valid: true},
+		{name: "no max", policy: Policy{MinLength: 200}, valid: true},
+		{name: "zero min", policy: Policy{MinLength: 0, MaxLength: 128}},
+		{name: "negative min", policy: Policy{MinLength: -1}},
+		{name: "min over max", policy: Policy{MinLength: DefaultPolicy.MaxLength + 1, MaxLength: DefaultPolicy.MaxLength}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate()
+			if tt.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if !tt.valid && apperr.ErrorCode(err) != apperr.EINVALID {
+				t.Fatalf("expected %s, got %v", apperr.EINVALID, err)
+			}
+		})
+	}
+}
+
+func TestPolicyService_Validate(t *testing.T) {
+	s := NewPolicyService(DefaultPolicy)
+	s.Policy.RequireSymbol = true
+
+	user := &entity.User{Username: "mario", Name: "Mario Al Rossi", Email: "super.mario@example.com"}
+
+	for _, tt := range []struct {
+		name     string
+		password string
+		user     *entity.User
+		want     []string
+	}{
+		{name: "valid", password: "Buongiorno-2022", user: user},
+		{name: "too short", password: "Ab-1", want: []string{entity.PasswordTooShort}},
+		{name: "too long", password: "Ab-1" + strings.Repeat("x", DefaultPolicy.MaxLength), want: []string{entity.PasswordTooLong}},
+		// the length is counted in characters, not in bytes.
+		{name: "multibyte", password: "Àèìòù-12", want: []string{entity.PasswordTooShort}},
+		{name: "multibyte long enough", password: "Àèìòùàèìòù-1"},
+		{name: "no lowercase", password: "BUONGIORNO-2022", want: []string{entity.PasswordMissingLowercase}},
+		{name: "no uppercase", password: "buongiorno-2022", want: []string{entity.PasswordMissingUppercase}},
+		{name: "no digit", password: "Buongiorno-oggi", want: []string{entity.PasswordMissingDigit}},
+		{name: "no symbol", password: "Buongiorno2022", want: []string{entity.PasswordMissingSymbol}},
+		{name: "banned", password: "MyPassword-2022", want: []string{entity.PasswordBannedSubstring}},
+		{name: "username", password: "Ciao-Mario-2022", user: user, want: []string{entity.PasswordBannedSubstring}},
+		{name: "email", password: "Super.Mario-2022", user: user, want: []string{entity.PasswordBannedSubstring, entity.PasswordBannedSubstring}},
+		{name: "name", password: "Rossi-di-Roma-1", user: user, want: []string{entity.PasswordBannedSubstring}},
+		// the short parts of the name are not banned.
+		{name: "short name", password: "Al-Buongiorno-1", user: user},
+		{name: "no user", password: "Ciao-Mario-2022"},
+		{name: "several", password: "password", want: []string{
+			entity.PasswordTooShort,
+			entity.PasswordMissingUppercase,
+			entity.PasswordMissingDigit,
+			entity.PasswordMissingSymbol,
+			entity.PasswordBannedSubstring,
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			violations, err := s.Validate(context.Background(), tt.password, tt.user)
+			if err != nil {
+				t.Fatal(err)
+			} else if got := codes(violations); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("violations = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyService_Validate_Breached(t *testing.T) {
+	s := NewPolicyService(Policy{MinLength: 1})
+	s.Breached = NewBreachedPasswords(writeHashFile(t, fixture, "\n"))
+
+	if violations, err := s.Validate(context.Background(), "password", nil); err != nil {
+		t.Fatal(err)
+	} else if got := codes(violations); !reflect.DeepEqual(got, []string{entity.PasswordBreached}) {
+		t.Fatalf("violations = %q, want %q", got, entity.PasswordBreached)
+	}
+
+	if violations, err := s.Validate(context.Background(), "una-password-nuova", nil); err != nil {
+		t.Fatal(err)
+	} else if len(violations) != 0 {
+		t.Fatalf("violations = %q, want none", codes(violations))
+	}
+}
@@ -0,0 +1,276 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"strings"
+	"time"
+)
+
+// apiKeyLastUsedResolution is the minimum interval between two updates of the
+// last use of a key, so that busy clients don't write on every request.
+const apiKeyLastUsedResolution = 1 * time.Minute
+
+var _ service.APIKeyService = (*APIKeyService)(nil)
+
+type APIKeyService struct {
+	db *sql.DB
+}
+
+func NewAPIKeyService(db *sql.DB) *APIKeyService {
+	return &APIKeyService{db}
+}
+
+func (s *APIKeyService) CreateAPIKey(ctx context.Context, key *entity.APIKey) (string, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	secret, err := createAPIKey(ctx, tx, key)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "errore: %v", err)
+	}
+
+	return secret, nil
+}
+
+func (s *APIKeyService) RevokeAPIKey(ctx context.Context, id int64) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeAPIKey(ctx, tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *APIKeyService) FindAPIKeyByID(ctx context.Context, id int64) (*entity.APIKey, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return findAPIKeyByID(ctx, tx, id)
+}
+
+func (s *APIKeyService) FindAPIKeys(ctx context.Context, filter service.APIKeyFilter) (entity.APIKeys, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return findAPIKeys(ctx, tx, filter)
+}
+
+func (s *APIKeyService) AuthenticateAPIKey(ctx context.Context, key string) (*entity.APIKey, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	k, err := authenticateAPIKey(ctx, tx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "errore: %v", err)
+	}
+
+	return k, nil
+}
+
+func createAPIKey(ctx context.Context, tx *sql.Tx, key *entity.APIKey) (string, error) {
+
+	if key.Name == "" {
+		return "", apperr.Errorf(apperr.EINVALID, "nome della chiave mancante")
+	}
+
+	for _, scope := range key.Scopes {
+		if !scope.Valid() {
+			return "", apperr.Errorf(apperr.EINVALID, "scope %q non valido", scope)
+		}
+	}
+
+	secret, prefix, err := entity.NewAPIKeySecret()
+	if err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to generate api key: %v", err)
+	}
+
+	key.Prefix = prefix
+	key.KeyHash = entity.HashAPIKey(secret)
+	key.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	key.LastUsedAt, key.RevokedAt = nil, nil
+
+	if res, err := tx.ExecContext(ctx, "INSERT INTO api_keys(name, prefix, key_hash, scopes, created_at) VALUES (?,?,?,?,?)",
+		key.Name, key.Prefix, key.KeyHash, formatScopes(key.Scopes), key.CreatedAt,
+	); err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to insert api key: %v", err)
+	} else if key.ID, err = res.LastInsertId(); err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to retrieve api key id: %v", err)
+	}
+
+	return secret, nil
+}
+
+func revokeAPIKey(ctx context.Context, tx *sql.Tx, id int64) error {
+
+	if _, err := findAPIKeyByID(ctx, tx, id); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), id); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to revoke api key: %v", err)
+	}
+
+	return nil
+}
+
+func authenticateAPIKey(ctx context.Context, tx *sql.Tx, key string) (*entity.APIKey, error) {
+
+	hash := entity.HashAPIKey(key)
+
+	keys, err := findAPIKeys(ctx, tx, service.APIKeyFilter{KeyHash: &hash})
+	if err != nil {
+		return nil, err
+	} else if len(keys) == 0 || keys[0].Revoked() {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "api key non valida")
+	}
+
+	k := keys[0]
+	now := time.Now().UTC()
+
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= apiKeyLastUsedResolution {
+		if _, err := tx.ExecContext(ctx, "UPDATE api_keys SET last_used_at = ? WHERE id = ?", now, k.ID); err != nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to update api key last use: %v", err)
+		}
+		k.LastUsedAt = &now
+	}
+
+	return k, nil
+}
+
+func findAPIKeyByID(ctx context.Context, tx *sql.Tx, id int64) (*entity.APIKey, error) {
+
+	keys, err := findAPIKeys(ctx, tx, service.APIKeyFilter{ID: &id})
+	if err != nil {
+		return nil, err
+	} else if len(keys) == 0 {
+		return nil, apperr.Errorf(apperr.ENOTFOUND, "api key not found")
+	}
+
+	return keys[0], nil
+}
+
+func findAPIKeys(ctx context.Context, tx *sql.Tx, filter service.APIKeyFilter) (_ entity.APIKeys, err error) {
+
+	where, args := []string{"1 = 1"}, []interface{}{}
+
+	if v := filter.ID; v != nil {
+		where = append(where, "id = ?")
+		args = append(args, *v)
+	}
+	if v := filter.KeyHash; v != nil {
+		where = append(where, "key_hash = ?")
+		args = append(args, *v)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT
+		    id,
+		    name,
+		    prefix,
+		    key_hash,
+		    scopes,
+		    created_at,
+		    last_used_at,
+		    revoked_at
+		FROM api_keys
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY id ASC
+		`+formatLimitOffset(filter.Limit, filter.Offset),
+		args...,
+	)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to query api keys: %v", err)
+	}
+	defer rows.Close()
+
+	keys := make(entity.APIKeys, 0)
+
+	for rows.Next() {
+
+		var key entity.APIKey
+		var scopes string
+		var lastUsedAt, revokedAt sql.NullTime
+
+		if err := rows.Scan(
+			&key.ID,
+			&key.Name,
+			&key.Prefix,
+			&key.KeyHash,
+			&scopes,
+			&key.CreatedAt,
+			&lastUsedAt,
+			&revokedAt,
+		); err != nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to scan api key: %v", err)
+		}
+
+		key.Scopes = parseScopes(scopes)
+		if lastUsedAt.Valid {
+			key.LastUsedAt = &lastUsedAt.Time
+		}
+		if revokedAt.Valid {
+			key.RevokedAt = &revokedAt.Time
+		}
+
+		keys = append(keys, &key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to iterate over api keys: %v", err)
+	}
+
+	return keys, nil
+}
+
+// formatScopes returns the scopes as stored in the api_keys table, a comma separated list.
+func formatScopes(scopes []entity.Permission) string {
+	a := make([]string, len(scopes))
+	for i, p := range scopes {
+		a[i] = string(p)
+	}
+	return strings.Join(a, ",")
+}
+
+// parseScopes parses the scopes stored in the api_keys table.
+func parseScopes(s string) []entity.Permission {
+	scopes := make([]entity.Permission, 0)
+	for _, p := range strings.Split(s, ",") {
+		if p != "" {
+			scopes = append(scopes, entity.Permission(p))
+		}
+	}
+	return scopes
+}
@@ -0,0 +1,88 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"time"
+)
+
+var _ service.IdentityService = (*IdentityService)(nil)
+
+type IdentityService struct {
+	db *sql.DB
+}
+
+func NewIdentityService(db *sql.DB) *IdentityService {
+	return &IdentityService{db}
+}
+
+func (s *IdentityService) FindIdentity(ctx context.Context, issuer string, subject string) (*entity.Identity, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return findIdentity(ctx, tx, issuer, subject)
+}
+
+func (s *IdentityService) CreateIdentity(ctx context.Context, identity *entity.Identity) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createIdentity(ctx, tx, identity); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func createIdentity(ctx context.Context, tx *sql.Tx, identity *entity.Identity) error {
+
+	if identity.Issuer == "" || identity.Subject == "" {
+		return apperr.Errorf(apperr.EINVALID, "identità non valida")
+	}
+
+	identity.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_identities(issuer, subject, user_id, created_at) VALUES (?,?,?,?)",
+		identity.Issuer, identity.Subject, identity.UserID, identity.CreatedAt,
+	); isDuplicateEntry(err) {
+		return apperr.Errorf(apperr.EEXISTS, "identità già collegata")
+	} else if err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to insert identity: %v", err)
+	}
+
+	return nil
+}
+
+func findIdentity(ctx context.Context, tx *sql.Tx, issuer string, subject string) (*entity.Identity, error) {
+
+	identity := entity.Identity{Issuer: issuer, Subject: subject}
+
+	if err := tx.QueryRowContext(ctx, `
+		SELECT
+		    user_id,
+		    created_at
+		FROM user_identities
+		WHERE issuer = ? AND subject = ?
+		`, issuer, subject,
+	).Scan(
+		&identity.UserID,
+		&identity.CreatedAt,
+	); err == sql.ErrNoRows {
+		return nil, apperr.Errorf(apperr.ENOTFOUND, "identità non collegata")
+	} else if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to query identity: %v", err)
+	}
+
+	return &identity, nil
+}
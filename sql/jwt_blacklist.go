@@ -0,0 +1,84 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"mysql/app/apperr"
+	"mysql/app/service"
+	"time"
+)
+
+var _ service.JWTBlacklistService = (*JWTBlacklistService)(nil)
+
+type JWTBlacklistService struct {
+	db *sql.DB
+}
+
+func NewJWTBlacklistService(db *sql.DB) *JWTBlacklistService {
+	return &JWTBlacklistService{db}
+}
+
+func (s *JWTBlacklistService) Invalidate(ctx context.Context, id string, expiration time.Duration) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+
+	// entries of expired tokens are useless, they are removed every time a new one is added.
+	if err := deleteExpiredBlacklistEntries(ctx, tx, now); err != nil {
+		return err
+	}
+
+	if err := invalidateToken(ctx, tx, id, now.Add(expiration)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *JWTBlacklistService) IsBlacklisted(ctx context.Context, id string) (bool, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	return isTokenBlacklisted(ctx, tx, id, time.Now().UTC())
+}
+
+func invalidateToken(ctx context.Context, tx *sql.Tx, id string, expiresAt time.Time) error {
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO jwt_blacklist(id, expires_at) VALUES (?,?)
+		ON DUPLICATE KEY UPDATE expires_at = GREATEST(expires_at, VALUES(expires_at))
+		`, id, expiresAt,
+	); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to blacklist token: %v", err)
+	}
+
+	return nil
+}
+
+func isTokenBlacklisted(ctx context.Context, tx *sql.Tx, id string, now time.Time) (bool, error) {
+
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM jwt_blacklist WHERE id = ? AND expires_at > ?", id, now).Scan(&n); err != nil {
+		return false, apperr.Errorf(apperr.EINTERNAL, "failed to query token blacklist: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+func deleteExpiredBlacklistEntries(ctx context.Context, tx *sql.Tx, now time.Time) error {
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM jwt_blacklist WHERE expires_at <= ?", now); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to delete expired blacklist entries: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"time"
+)
+
+var _ service.MFAService = (*MFAService)(nil)
+
+type MFAService struct {
+	db *sql.DB
+}
+
+func NewMFAService(db *sql.DB) *MFAService {
+	return &MFAService{db}
+}
+
+func (s *MFAService) CreateTOTP(ctx context.Context, totp *entity.TOTP) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createTOTP(ctx, tx, totp); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *MFAService) FindTOTPByUserID(ctx context.Context, userID int64) (*entity.TOTP, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return findTOTPByUserID(ctx, tx, userID, false)
+}
+
+func (s *MFAService) ConfirmTOTP(ctx context.Context, userID int64) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := confirmTOTP(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *MFAService) UseTOTPCounter(ctx context.Context, userID int64, counter int64) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := useTOTPCounter(ctx, tx, userID, counter); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *MFAService) DeleteTOTP(ctx context.Context, userID int64) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteTOTP(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *MFAService) ReplaceRecoveryCodes(ctx context.Context, userID int64) ([]string, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "errore: %v", err)
+	}
+
+	return codes, nil
+}
+
+func (s *MFAService) ConsumeRecoveryCode(ctx context.Context, userID int64, code string) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := consumeRecoveryCode(ctx, tx, userID, code); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func createTOTP(ctx context.Context, tx *sql.Tx, totp *entity.TOTP) error {
+
+	if totp.Secret == "" {
+		return apperr.Errorf(apperr.EINVALID, "secret mancante")
+	}
+
+	if existing, err := findTOTPByUserID(ctx, tx, totp.UserID, true); err != nil && apperr.ErrorCode(err) != apperr.ENOTFOUND {
+		return err
+	} else if existing != nil && existing.Confirmed() {
+		return apperr.Errorf(apperr.EEXISTS, "autenticazione a due fattori già attiva")
+	}
+
+	totp.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	totp.ConfirmedAt = nil
+	totp.LastCounter = 0
+
+	if _, err := tx.ExecContext(ctx, "REPLACE INTO user_totp(user_id, secret, created_at) VALUES (?,?,?)",
+		totp.UserID, totp.Secret, totp.CreatedAt,
+	); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to insert totp secret: %v", err)
+	}
+
+	return nil
+}
+
+func confirmTOTP(ctx context.Context, tx *sql.Tx, userID int64) error {
+
+	if _, err := findTOTPByUserID(ctx, tx, userID, true); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE user_totp SET confirmed_at = ? WHERE user_id = ? AND confirmed_at IS NULL", time.Now().UTC(), userID); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to confirm totp secret: %v", err)
+	}
+
+	return nil
+}
+
+func useTOTPCounter(ctx context.Context, tx *sql.Tx, userID int64, counter int64) error {
+
+	// the row is locked so that the same code can't be accepted twice concurrently.
+	totp, err := findTOTPByUserID(ctx, tx, userID, true)
+	if err != nil {
+		return err
+	}
+
+	if counter <= totp.LastCounter {
+		return apperr.Errorf(apperr.EUNAUTHORIZED, "codice già utilizzato")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE user_totp SET last_counter = ? WHERE user_id = ?", counter, userID); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to update totp counter: %v", err)
+	}
+
+	return nil
+}
+
+func deleteTOTP(ctx context.Context, tx *sql.Tx, userID int64) error {
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to delete totp secret: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to delete recovery codes: %v", err)
+	}
+
+	return nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64) ([]string, error) {
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to delete recovery codes: %v", err)
+	}
+
+	codes := make([]string, entity.RecoveryCodeCount)
+
+	for i := range codes {
+		code, err := entity.NewRecoveryCode()
+		if err != nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to generate recovery code: %v", err)
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes(user_id, code_hash) VALUES (?,?)",
+			userID, entity.HashRecoveryCode(code),
+		); err != nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to insert recovery code: %v", err)
+		}
+
+		codes[i] = code
+	}
+
+	return codes, nil
+}
+
+func consumeRecoveryCode(ctx context.Context, tx *sql.Tx, userID int64, code string) error {
+
+	res, err := tx.ExecContext(ctx, "UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now().UTC(), userID, entity.HashRecoveryCode(code),
+	)
+	if err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to consume recovery code: %v", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to consume recovery code: %v", err)
+	} else if n == 0 {
+		return apperr.Errorf(apperr.EUNAUTHORIZED, "codice di recupero non valido")
+	}
+
+	return nil
+}
+
+// findTOTPByUserID returns the TOTP secret of the user, locking the row if forUpdate is set.
+func findTOTPByUserID(ctx context.Context, tx *sql.Tx, userID int64, forUpdate bool) (*entity.TOTP, error) {
+
+	query := `
+		SELECT
+		    user_id,
+		    secret,
+		    created_at,
+		    confirmed_at,
+		    last_counter
+		FROM user_totp
+		WHERE user_id = ?
+		`
+	if forUpdate {
+		query += "FOR UPDATE"
+	}
+
+	var totp entity.TOTP
+	var confirmedAt sql.NullTime
+
+	if err := tx.QueryRowContext(ctx, query, userID).Scan(
+		&totp.UserID,
+		&totp.Secret,
+		&totp.CreatedAt,
+		&confirmedAt,
+		&totp.LastCounter,
+	); err == sql.ErrNoRows {
+		return nil, apperr.Errorf(apperr.ENOTFOUND, "autenticazione a due fattori non configurata")
+	} else if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to query totp secret: %v", err)
+	}
+
+	if confirmedAt.Valid {
+		totp.ConfirmedAt = &confirmedAt.Time
+	}
+
+	return &totp, nil
+}
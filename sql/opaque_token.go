@@ -0,0 +1,97 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"time"
+)
+
+var _ service.OpaqueTokenService = (*OpaqueTokenService)(nil)
+
+type OpaqueTokenService struct {
+	db *sql.DB
+}
+
+func NewOpaqueTokenService(db *sql.DB) *OpaqueTokenService {
+	return &OpaqueTokenService{db}
+}
+
+func (s *OpaqueTokenService) CreateOpaqueToken(ctx context.Context, token *entity.OpaqueToken) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createOpaqueToken(ctx, tx, token); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *OpaqueTokenService) FindOpaqueToken(ctx context.Context, tokenHash string) (*entity.OpaqueToken, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return findOpaqueToken(ctx, tx, tokenHash)
+}
+
+func createOpaqueToken(ctx context.Context, tx *sql.Tx, token *entity.OpaqueToken) error {
+
+	claims, err := json.Marshal(token.Claims)
+	if err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to encode opaque token claims: %v", err)
+	}
+
+	// the expired tokens are removed here, they would be rejected anyway.
+	if _, err := tx.ExecContext(ctx, "DELETE FROM opaque_tokens WHERE expires_at <= ?", time.Now().UTC()); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to delete expired opaque tokens: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO opaque_tokens(token_hash, claims, expires_at) VALUES (?,?,?)", token.TokenHash, string(claims), token.ExpiresAt); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to insert opaque token: %v", err)
+	}
+
+	return nil
+}
+
+func findOpaqueToken(ctx context.Context, tx *sql.Tx, tokenHash string) (*entity.OpaqueToken, error) {
+
+	var token entity.OpaqueToken
+	var claims string
+
+	if err := tx.QueryRowContext(ctx, `
+		SELECT
+		    token_hash,
+		    claims,
+		    expires_at
+		FROM opaque_tokens
+		WHERE token_hash = ? AND expires_at > ?
+		`, tokenHash, time.Now().UTC(),
+	).Scan(
+		&token.TokenHash,
+		&claims,
+		&token.ExpiresAt,
+	); err == sql.ErrNoRows {
+		return nil, apperr.Errorf(apperr.ENOTFOUND, "opaque token not found")
+	} else if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to query opaque token: %v", err)
+	}
+
+	token.Claims = &entity.AppClaims{}
+	if err := json.Unmarshal([]byte(claims), token.Claims); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to decode opaque token claims: %v", err)
+	}
+
+	return &token, nil
+}
@@ -0,0 +1,149 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"time"
+)
+
+var _ service.PasswordResetService = (*PasswordResetService)(nil)
+
+type PasswordResetService struct {
+	db *sql.DB
+}
+
+func NewPasswordResetService(db *sql.DB) *PasswordResetService {
+	return &PasswordResetService{db}
+}
+
+func (s *PasswordResetService) CreatePasswordReset(ctx context.Context, userID int64, expiration time.Duration) (string, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	token, err := createPasswordReset(ctx, tx, userID, expiration)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "errore: %v", err)
+	}
+
+	return token, nil
+}
+
+func (s *PasswordResetService) FindPasswordReset(ctx context.Context, token string) (*entity.PasswordReset, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return findPasswordReset(ctx, tx, token, false)
+}
+
+func (s *PasswordResetService) ConsumePasswordReset(ctx context.Context, token string) (*entity.PasswordReset, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	reset, err := consumePasswordReset(ctx, tx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "errore: %v", err)
+	}
+
+	return reset, nil
+}
+
+func createPasswordReset(ctx context.Context, tx *sql.Tx, userID int64, expiration time.Duration) (string, error) {
+
+	token, err := entity.NewPasswordResetToken()
+	if err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to generate password reset token: %v", err)
+	}
+
+	now := time.Now().UTC()
+
+	// expired and used tokens are useless, they are removed every time a new one is created.
+	if _, err := tx.ExecContext(ctx, "DELETE FROM password_resets WHERE expires_at <= ? OR used_at IS NOT NULL", now); err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to delete expired password resets: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO password_resets(token_hash, user_id, expires_at) VALUES (?,?,?)",
+		entity.HashPasswordResetToken(token), userID, now.Add(expiration),
+	); err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to insert password reset: %v", err)
+	}
+
+	return token, nil
+}
+
+// findPasswordReset returns the pending password reset with the token, locking the row if forUpdate is set.
+func findPasswordReset(ctx context.Context, tx *sql.Tx, token string, forUpdate bool) (*entity.PasswordReset, error) {
+
+	query := `
+		SELECT
+		    token_hash,
+		    user_id,
+		    expires_at,
+		    used_at
+		FROM password_resets
+		WHERE token_hash = ?
+		`
+	if forUpdate {
+		query += "FOR UPDATE"
+	}
+
+	var reset entity.PasswordReset
+	var usedAt sql.NullTime
+
+	if err := tx.QueryRowContext(ctx, query, entity.HashPasswordResetToken(token)).Scan(
+		&reset.TokenHash,
+		&reset.UserID,
+		&reset.ExpiresAt,
+		&usedAt,
+	); err == sql.ErrNoRows {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "token di reset non valido")
+	} else if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to query password reset: %v", err)
+	}
+
+	if usedAt.Valid || !reset.ExpiresAt.After(time.Now().UTC()) {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "token di reset non valido")
+	}
+
+	return &reset, nil
+}
+
+func consumePasswordReset(ctx context.Context, tx *sql.Tx, token string) (*entity.PasswordReset, error) {
+
+	// the row is locked so that the token can't be consumed twice concurrently.
+	reset, err := findPasswordReset(ctx, tx, token, true)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL", now, reset.UserID); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to consume password reset: %v", err)
+	}
+	reset.UsedAt = &now
+
+	return reset, nil
+}
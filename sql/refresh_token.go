@@ -0,0 +1,133 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"time"
+)
+
+var _ service.RefreshTokenService = (*RefreshTokenService)(nil)
+
+type RefreshTokenService struct {
+	db *sql.DB
+}
+
+func NewRefreshTokenService(db *sql.DB) *RefreshTokenService {
+	return &RefreshTokenService{db}
+}
+
+func (s *RefreshTokenService) CreateRefreshToken(ctx context.Context, token *entity.RefreshToken) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createRefreshToken(ctx, tx, token); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *RefreshTokenService) RotateRefreshToken(ctx context.Context, id string) (*entity.RefreshToken, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	token, err := rotateRefreshToken(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "errore: %v", err)
+	}
+
+	return token, nil
+}
+
+func (s *RefreshTokenService) RevokeRefreshTokens(ctx context.Context, userID int64) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeRefreshTokens(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func createRefreshToken(ctx context.Context, tx *sql.Tx, token *entity.RefreshToken) error {
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO refresh_tokens(id, user_id, expires_at) VALUES (?,?,?)", token.ID, token.UserID, token.ExpiresAt); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to insert refresh token: %v", err)
+	}
+
+	return nil
+}
+
+func rotateRefreshToken(ctx context.Context, tx *sql.Tx, id string) (*entity.RefreshToken, error) {
+
+	var token entity.RefreshToken
+	var rotatedAt sql.NullTime
+
+	// the row is locked so that two concurrent refreshes with the same token cannot both succeed.
+	if err := tx.QueryRowContext(ctx, `
+		SELECT
+		    id,
+		    user_id,
+		    expires_at,
+		    rotated_at
+		FROM refresh_tokens
+		WHERE id = ?
+		FOR UPDATE
+		`, id,
+	).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.ExpiresAt,
+		&rotatedAt,
+	); err == sql.ErrNoRows {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unknown refresh token")
+	} else if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to query refresh token: %v", err)
+	}
+
+	if rotatedAt.Valid {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "refresh token already used")
+	}
+
+	now := time.Now().UTC()
+
+	if !token.ExpiresAt.After(now) {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "refresh token expired")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET rotated_at = ? WHERE id = ?", now, id); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to rotate refresh token: %v", err)
+	}
+	token.RotatedAt = &now
+
+	return &token, nil
+}
+
+func revokeRefreshTokens(ctx context.Context, tx *sql.Tx, userID int64) error {
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET rotated_at = ? WHERE user_id = ? AND rotated_at IS NULL", time.Now().UTC(), userID); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to revoke refresh tokens: %v", err)
+	}
+
+	return nil
+}
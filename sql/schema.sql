@@ -0,0 +1,121 @@
+-- Tables used by the services of the sql package.
+
+CREATE TABLE IF NOT EXISTS cities (
+    id         BIGINT       NOT NULL AUTO_INCREMENT,
+    name       VARCHAR(255) NOT NULL,
+    population INT          NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS users (
+    id             BIGINT       NOT NULL AUTO_INCREMENT,
+    username       VARCHAR(255) NOT NULL,
+    name           VARCHAR(255) NOT NULL,
+    email          VARCHAR(255) NOT NULL DEFAULT '',
+    email_verified BOOLEAN      NOT NULL DEFAULT FALSE,
+    password_hash  VARCHAR(255) NOT NULL,
+    roles          VARCHAR(255) NOT NULL DEFAULT '',
+    PRIMARY KEY (id),
+    UNIQUE KEY users_username (username),
+    KEY users_email (email)
+);
+
+-- Passwords are argon2id hashes, see package password.
+INSERT IGNORE INTO users (id, username, name, password_hash, roles) VALUES
+    (1, 'Pippoboss', 'Pippo', '$argon2id$v=19$m=65536,t=3,p=2$IZAtIk79mU10jeZDWWcI9g$iVNzdMylkIos7TeJMnifcdjj09uH6sACFXnJ1ZNzOOg', 'admin'),
+    (2, 'Mangaka96', 'Luca Molinari', '$argon2id$v=19$m=65536,t=3,p=2$oHgXIZ68OLSvR+D6i4NLSA$+l4MHJASJtEmw2Huufwt8wKqTn+0hhGpR3zRnGlOkP8', 'editor'),
+    (3, 'Cydonia', 'Francesco Cilurzo', '$argon2id$v=19$m=65536,t=3,p=2$5LfX7pkdhS3YkxvJemyJYw$C0wOtLlxeoUvNGImdFmnq8ecQmlXFg9iiCxF3OH8xrM', 'viewer'),
+    (4, 'Sabaku no maiku', 'Michele Poggi', '$argon2id$v=19$m=65536,t=3,p=2$GahR0csxvtPw2ka5LudIqw$2YmUPHEDQYyhOPpJv0SlK70Flni2y4sB1+yeNXtfmtk', 'viewer');
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id         VARCHAR(36) NOT NULL,
+    user_id    BIGINT      NOT NULL,
+    expires_at DATETIME    NOT NULL,
+    rotated_at DATETIME    NULL,
+    PRIMARY KEY (id),
+    KEY refresh_tokens_user_id (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS jwt_blacklist (
+    id         VARCHAR(36) NOT NULL,
+    expires_at DATETIME    NOT NULL,
+    PRIMARY KEY (id),
+    KEY jwt_blacklist_expires_at (expires_at)
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id           BIGINT       NOT NULL AUTO_INCREMENT,
+    name         VARCHAR(255) NOT NULL,
+    prefix       VARCHAR(16)  NOT NULL,
+    key_hash     CHAR(64)     NOT NULL,
+    scopes       VARCHAR(255) NOT NULL DEFAULT '',
+    created_at   DATETIME     NOT NULL,
+    last_used_at DATETIME     NULL,
+    revoked_at   DATETIME     NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY api_keys_key_hash (key_hash)
+);
+
+CREATE TABLE IF NOT EXISTS password_resets (
+    token_hash CHAR(64) NOT NULL,
+    user_id    BIGINT   NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at    DATETIME NULL,
+    PRIMARY KEY (token_hash),
+    KEY password_resets_user_id (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id      BIGINT      NOT NULL,
+    secret       VARCHAR(64) NOT NULL,
+    created_at   DATETIME    NOT NULL,
+    confirmed_at DATETIME    NULL,
+    last_counter BIGINT      NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id   BIGINT   NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at   DATETIME NULL,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id           VARCHAR(36)  NOT NULL,
+    user_id      BIGINT       NOT NULL,
+    token_id     VARCHAR(36)  NOT NULL,
+    user_agent   VARCHAR(255) NOT NULL DEFAULT '',
+    ip           VARCHAR(45)  NOT NULL DEFAULT '',
+    issued_at    DATETIME     NOT NULL,
+    refreshed_at DATETIME     NOT NULL,
+    expires_at   DATETIME     NOT NULL,
+    revoked_at   DATETIME     NULL,
+    PRIMARY KEY (id),
+    KEY sessions_user_id (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    issuer     VARCHAR(255) NOT NULL,
+    subject    VARCHAR(255) NOT NULL,
+    user_id    BIGINT       NOT NULL,
+    created_at DATETIME     NOT NULL,
+    PRIMARY KEY (issuer, subject),
+    KEY user_identities_user_id (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS opaque_tokens (
+    token_hash CHAR(64) NOT NULL,
+    claims     TEXT     NOT NULL,
+    expires_at DATETIME NOT NULL,
+    PRIMARY KEY (token_hash),
+    KEY opaque_tokens_expires_at (expires_at)
+);
+
+-- Settings changed at runtime, e.g. by the admins, see SettingService.
+CREATE TABLE IF NOT EXISTS settings (
+    name       VARCHAR(64)  NOT NULL,
+    value      VARCHAR(255) NOT NULL,
+    updated_at DATETIME     NOT NULL,
+    PRIMARY KEY (name)
+);
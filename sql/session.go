@@ -0,0 +1,227 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"strings"
+	"time"
+)
+
+// maxUserAgentLength is the size of the user_agent column, longer user agents are truncated.
+const maxUserAgentLength = 255
+
+var _ service.SessionService = (*SessionService)(nil)
+
+type SessionService struct {
+	db *sql.DB
+}
+
+func NewSessionService(db *sql.DB) *SessionService {
+	return &SessionService{db}
+}
+
+func (s *SessionService) CreateSession(ctx context.Context, session *entity.Session) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createSession(ctx, tx, session); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SessionService) RefreshSession(ctx context.Context, id string, tokenID string, expiresAt time.Time) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := refreshSession(ctx, tx, id, tokenID, expiresAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SessionService) FindSessionByID(ctx context.Context, id string) (*entity.Session, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return findSessionByID(ctx, tx, id)
+}
+
+func (s *SessionService) FindSessions(ctx context.Context, filter service.SessionFilter) (entity.Sessions, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return findSessions(ctx, tx, filter)
+}
+
+func (s *SessionService) RevokeSession(ctx context.Context, id string) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeSession(ctx, tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func createSession(ctx context.Context, tx *sql.Tx, session *entity.Session) error {
+
+	if len(session.UserAgent) > maxUserAgentLength {
+		session.UserAgent = session.UserAgent[:maxUserAgentLength]
+	}
+
+	// expired sessions are useless, they are removed every time a new one is created.
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at <= ?", time.Now().UTC()); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to delete expired sessions: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO sessions(id, user_id, token_id, user_agent, ip, issued_at, refreshed_at, expires_at) VALUES (?,?,?,?,?,?,?,?)",
+		session.ID, session.UserID, session.TokenID, session.UserAgent, session.IP, session.IssuedAt, session.RefreshedAt, session.ExpiresAt,
+	); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to insert session: %v", err)
+	}
+
+	return nil
+}
+
+func refreshSession(ctx context.Context, tx *sql.Tx, id string, tokenID string, expiresAt time.Time) error {
+
+	res, err := tx.ExecContext(ctx, "UPDATE sessions SET token_id = ?, refreshed_at = ?, expires_at = ? WHERE id = ? AND revoked_at IS NULL",
+		tokenID, time.Now().UTC(), expiresAt, id,
+	)
+	if err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to refresh session: %v", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to refresh session: %v", err)
+	} else if n == 0 {
+		return apperr.Errorf(apperr.EUNAUTHORIZED, "sessione non valida")
+	}
+
+	return nil
+}
+
+func revokeSession(ctx context.Context, tx *sql.Tx, id string) error {
+
+	if _, err := findSessionByID(ctx, tx, id); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), id); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to revoke session: %v", err)
+	}
+
+	return nil
+}
+
+func findSessionByID(ctx context.Context, tx *sql.Tx, id string) (*entity.Session, error) {
+
+	sessions, err := findSessions(ctx, tx, service.SessionFilter{ID: &id})
+	if err != nil {
+		return nil, err
+	} else if len(sessions) == 0 {
+		return nil, apperr.Errorf(apperr.ENOTFOUND, "sessione non trovata")
+	}
+
+	return sessions[0], nil
+}
+
+func findSessions(ctx context.Context, tx *sql.Tx, filter service.SessionFilter) (_ entity.Sessions, err error) {
+
+	where, args := []string{"1 = 1"}, []interface{}{}
+
+	if v := filter.ID; v != nil {
+		where = append(where, "id = ?")
+		args = append(args, *v)
+	}
+	if v := filter.UserID; v != nil {
+		where = append(where, "user_id = ?")
+		args = append(args, *v)
+	}
+	if filter.Active {
+		where = append(where, "revoked_at IS NULL", "expires_at > ?")
+		args = append(args, time.Now().UTC())
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT
+		    id,
+		    user_id,
+		    token_id,
+		    user_agent,
+		    ip,
+		    issued_at,
+		    refreshed_at,
+		    expires_at,
+		    revoked_at
+		FROM sessions
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY refreshed_at DESC
+		`+formatLimitOffset(filter.Limit, filter.Offset),
+		args...,
+	)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to query sessions: %v", err)
+	}
+	defer rows.Close()
+
+	sessions := make(entity.Sessions, 0)
+
+	for rows.Next() {
+
+		var session entity.Session
+		var revokedAt sql.NullTime
+
+		if err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.TokenID,
+			&session.UserAgent,
+			&session.IP,
+			&session.IssuedAt,
+			&session.RefreshedAt,
+			&session.ExpiresAt,
+			&revokedAt,
+		); err != nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to scan session: %v", err)
+		}
+
+		if revokedAt.Valid {
+			session.RevokedAt = &revokedAt.Time
+		}
+
+		sessions = append(sessions, &session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to iterate over sessions: %v", err)
+	}
+
+	return sessions, nil
+}
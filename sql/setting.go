@@ -0,0 +1,71 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"mysql/app/apperr"
+	"mysql/app/service"
+	"time"
+)
+
+var _ service.SettingService = (*SettingService)(nil)
+
+type SettingService struct {
+	db *sql.DB
+}
+
+func NewSettingService(db *sql.DB) *SettingService {
+	return &SettingService{db}
+}
+
+func (s *SettingService) FindSetting(ctx context.Context, name string) (string, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	return findSetting(ctx, tx, name)
+}
+
+func (s *SettingService) SetSetting(ctx context.Context, name string, value string) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setSetting(ctx, tx, name, value); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func findSetting(ctx context.Context, tx *sql.Tx, name string) (string, error) {
+
+	var value string
+
+	if err := tx.QueryRowContext(ctx, "SELECT value FROM settings WHERE name = ?", name).Scan(&value); err == sql.ErrNoRows {
+		return "", apperr.Errorf(apperr.ENOTFOUND, "impostazione %s non trovata", name)
+	} else if err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to query setting: %v", err)
+	}
+
+	return value, nil
+}
+
+func setSetting(ctx context.Context, tx *sql.Tx, name string, value string) error {
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO settings(name, value, updated_at) VALUES (?,?,?)
+		ON DUPLICATE KEY UPDATE value = VALUES(value), updated_at = VALUES(updated_at)
+		`, name, value, time.Now().UTC(),
+	); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to store setting: %v", err)
+	}
+
+	return nil
+}
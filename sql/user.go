@@ -0,0 +1,337 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var _ service.UserService = (*UserService)(nil)
+
+type UserService struct {
+	db *sql.DB
+}
+
+func NewUserService(db *sql.DB) *UserService {
+	return &UserService{db}
+}
+
+func (s *UserService) CreateUser(ctx context.Context, user *entity.User) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createUser(ctx, tx, user); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *UserService) DeleteUser(ctx context.Context, id int64) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteUser(ctx, tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *UserService) UpdateUser(ctx context.Context, id int64, upd service.UserUpdate) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateUser(ctx, tx, id, upd); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *UserService) FindUserByID(ctx context.Context, id int64) (*entity.User, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return findUserByID(ctx, tx, id)
+}
+
+func (s *UserService) FindUserByUsername(ctx context.Context, username string) (*entity.User, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return findUserByUsername(ctx, tx, username)
+}
+
+func (s *UserService) FindUsers(ctx context.Context, filter service.UserFilter) (entity.Users, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return findUsers(ctx, tx, filter)
+}
+
+func createUser(ctx context.Context, tx *sql.Tx, user *entity.User) error {
+
+	if err := user.Validate(); err != nil {
+		return err
+	}
+
+	if u, err := findUsers(ctx, tx, service.UserFilter{Username: &user.Username}); err != nil {
+		return err
+	} else if len(u) > 0 {
+		return apperr.Errorf(apperr.EEXISTS, "username già in uso")
+	}
+
+	if res, err := tx.ExecContext(ctx, "INSERT INTO users(username, name, email, email_verified, password_hash, roles) VALUES (?,?,?,?,?,?)", user.Username, user.Name, user.Email, user.EmailVerified, user.PasswordHash, formatRoles(user.Roles)); isDuplicateEntry(err) {
+		// another user with the same username has been created concurrently.
+		return apperr.Errorf(apperr.EEXISTS, "username già in uso")
+	} else if err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to insert user: %v", err)
+	} else if user.ID, err = res.LastInsertId(); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to retrieve user id: %v", err)
+	}
+
+	return nil
+}
+
+func deleteUser(ctx context.Context, tx *sql.Tx, id int64) error {
+
+	if _, err := findUserByID(ctx, tx, id); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id); err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to delete user: %v", err)
+	}
+
+	return nil
+}
+
+func updateUser(ctx context.Context, tx *sql.Tx, id int64, upd service.UserUpdate) error {
+
+	if _, err := findUserByID(ctx, tx, id); err != nil {
+		return err
+	}
+
+	set, args := []string{}, []interface{}{}
+
+	if v := upd.Username; v != nil {
+		if *v == "" || len(*v) > 255 {
+			return apperr.Errorf(apperr.EINVALID, "Username invalido")
+		} else if u, err := findUsers(ctx, tx, service.UserFilter{Username: v}); err != nil {
+			return err
+		} else if len(u) > 0 && u[0].ID != id {
+			return apperr.Errorf(apperr.ECONFLICT, "username già in uso")
+		}
+		set = append(set, "username = ?")
+		args = append(args, *v)
+	}
+	if v := upd.Name; v != nil {
+		set = append(set, "name = ?")
+		args = append(args, *v)
+	}
+	if v := upd.Email; v != nil {
+		if err := entity.ValidateEmail(*v); err != nil {
+			return err
+		}
+		set = append(set, "email = ?")
+		args = append(args, *v)
+
+		// a new email is not verified, unless told otherwise.
+		if upd.EmailVerified == nil {
+			set = append(set, "email_verified = FALSE")
+		}
+	}
+	if v := upd.EmailVerified; v != nil {
+		set = append(set, "email_verified = ?")
+		args = append(args, *v)
+	}
+	if v := upd.PasswordHash; v != nil {
+		set = append(set, "password_hash = ?")
+		args = append(args, *v)
+	}
+
+	if v := upd.Roles; v != nil {
+		set = append(set, "roles = ?")
+		args = append(args, formatRoles(v))
+	}
+
+	if len(set) == 0 {
+		return nil
+	}
+
+	args = append(args, id)
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET "+strings.Join(set, ", ")+" WHERE id = ?", args...); isDuplicateEntry(err) {
+		return apperr.Errorf(apperr.ECONFLICT, "username già in uso")
+	} else if err != nil {
+		return apperr.Errorf(apperr.EINTERNAL, "failed to update user: %v", err)
+	}
+
+	return nil
+}
+
+func findUserByID(ctx context.Context, tx *sql.Tx, id int64) (*entity.User, error) {
+
+	u, err := findUsers(ctx, tx, service.UserFilter{ID: &id})
+	if err != nil {
+		return nil, err
+	} else if len(u) == 0 {
+		return nil, apperr.Errorf(apperr.ENOTFOUND, "user not found")
+	}
+
+	return u[0], nil
+}
+
+func findUserByUsername(ctx context.Context, tx *sql.Tx, username string) (*entity.User, error) {
+
+	u, err := findUsers(ctx, tx, service.UserFilter{Username: &username})
+	if err != nil {
+		return nil, err
+	} else if len(u) == 0 {
+		return nil, apperr.Errorf(apperr.ENOTFOUND, "user not found")
+	}
+
+	return u[0], nil
+}
+
+func findUsers(ctx context.Context, tx *sql.Tx, filter service.UserFilter) (_ entity.Users, err error) {
+
+	where, args := []string{"1 = 1"}, []interface{}{}
+
+	if v := filter.ID; v != nil {
+		where = append(where, "id = ?")
+		args = append(args, *v)
+	}
+	if v := filter.Username; v != nil {
+		where = append(where, "username = ?")
+		args = append(args, *v)
+	}
+	if v := filter.Email; v != nil {
+		where = append(where, "email = ?")
+		args = append(args, *v)
+	}
+	if filter.EmailVerified {
+		where = append(where, "email_verified = TRUE")
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT
+		    id,
+		    username,
+		    name,
+		    email,
+		    email_verified,
+		    password_hash,
+		    roles
+		FROM users
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY id ASC
+		`+formatLimitOffset(filter.Limit, filter.Offset),
+		args...,
+	)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to query users: %v", err)
+	}
+	defer rows.Close()
+
+	users := make(entity.Users, 0)
+
+	for rows.Next() {
+
+		var user entity.User
+		var roles string
+
+		if err := rows.Scan(
+			&user.ID,
+			&user.Username,
+			&user.Name,
+			&user.Email,
+			&user.EmailVerified,
+			&user.PasswordHash,
+			&roles,
+		); err != nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to scan user: %v", err)
+		}
+
+		user.Roles = parseRoles(roles)
+
+		users = append(users, &user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to iterate over users: %v", err)
+	}
+
+	return users, nil
+}
+
+// isDuplicateEntry returns true if err is a MySQL unique constraint violation.
+func isDuplicateEntry(err error) bool {
+	var e *mysql.MySQLError
+	return errors.As(err, &e) && e.Number == 1062
+}
+
+// formatRoles returns the roles as stored in the users table, a comma separated list.
+func formatRoles(roles []entity.Role) string {
+	a := make([]string, len(roles))
+	for i, r := range roles {
+		a[i] = string(r)
+	}
+	return strings.Join(a, ",")
+}
+
+// parseRoles parses the roles stored in the users table.
+func parseRoles(s string) []entity.Role {
+	roles := make([]entity.Role, 0)
+	for _, r := range strings.Split(s, ",") {
+		if r != "" {
+			roles = append(roles, entity.Role(r))
+		}
+	}
+	return roles
+}
+
+// formatLimitOffset returns a SQL string for a given limit & offset.
+// Clauses are only added if limit and/or offset are greater than zero.
+func formatLimitOffset(limit, offset int) string {
+	if limit > 0 && offset > 0 {
+		return fmt.Sprintf(`LIMIT %d OFFSET %d`, limit, offset)
+	} else if limit > 0 {
+		return fmt.Sprintf(`LIMIT %d`, limit)
+	} else if offset > 0 {
+		// MySQL does not support OFFSET without LIMIT.
+		return fmt.Sprintf(`LIMIT 18446744073709551615 OFFSET %d`, offset)
+	}
+	return ""
+}
@@ -0,0 +1,394 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	accessTokenExpiration  = entity.AccessTokenExpiration
+	refreshTokenExpiration = entity.RefreshTokenExpiration
+)
+
+// DefaultLeeway is the clock skew tolerated by default between the issuer and the verifier.
+const DefaultLeeway = 30 * time.Second
+
+// Codec is the format of the tokens: it encodes the claims of the issued tokens and
+// decodes the received ones. Decode must reject the tokens that have not been produced
+// by Encode, usually with ETOKENMALFORMED or ETOKENSIGNATURE. The registered claims
+// are validated by the Service.
+type Codec interface {
+	Encode(ctx context.Context, claims *entity.AppClaims) (string, error)
+	Decode(ctx context.Context, token string) (*entity.AppClaims, error)
+}
+
+var _ service.JWTService = (*Service)(nil)
+
+// Service implements service.JWTService independently of the format of the tokens,
+// which is left to the Codec. It is embedded by the services of each format.
+type Service struct {
+	// Codec encodes the issued tokens and decodes the received ones.
+	Codec Codec
+
+	// Issuer and Audience are written in the issued tokens and are required in the received ones.
+	Issuer   string
+	Audience string
+
+	// Leeway is the clock skew tolerated when checking the exp, nbf and iat claims.
+	Leeway time.Duration
+
+	// Now returns the current time, it can be replaced in tests.
+	Now func() time.Time
+
+	JWTBlacklistService service.JWTBlacklistService
+	RefreshTokenService service.RefreshTokenService
+	UserService         service.UserService
+
+	// SessionService records the sessions started by Exchange, if set.
+	SessionService service.SessionService
+}
+
+// NewService creates a Service issuing tokens in the format of the codec.
+func NewService(codec Codec) *Service {
+	return &Service{
+		Codec:    codec,
+		Issuer:   entity.TokenIssuer,
+		Audience: entity.TokenAudience,
+		Leeway:   DefaultLeeway,
+		Now:      time.Now,
+	}
+}
+
+// Exchange implements service.JWTService
+func (s *Service) Exchange(ctx context.Context, auth *entity.User, scope []entity.Permission) (*entity.Token, error) {
+	select {
+	case <-ctx.Done():
+		return nil, apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		return s.exchange(ctx, auth, "", scope)
+	}
+}
+
+// exchange issues a token pair for the user in the session with the given id.
+// A new session is started if the id is empty.
+func (s *Service) exchange(ctx context.Context, auth *entity.User, sessionID string, scope []entity.Permission) (*entity.Token, error) {
+
+	// refresh tokens can't be issued without a record of them.
+	if s.RefreshTokenService == nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "refresh token service not configured")
+	}
+
+	granted, err := reduceScope(entity.Permissions(auth.Roles), scope)
+	if err != nil {
+		return nil, err
+	}
+
+	newSession := sessionID == ""
+	if newSession {
+		sessionID = uuid.NewString()
+	}
+
+	accessTokenclaims := s.newClaims(auth, entity.AccessTokenUse, accessTokenExpiration)
+	accessTokenclaims.SessionID = sessionID
+	accessTokenclaims.Scope = granted
+
+	accessTokenString, err := s.Codec.Encode(ctx, accessTokenclaims)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to encode access token: %v", err)
+	}
+
+	refreshTokenClaims := s.newClaims(auth, entity.RefreshTokenUse, refreshTokenExpiration)
+	refreshTokenClaims.SessionID = sessionID
+	refreshTokenClaims.Scope = granted
+
+	refreshTokenString, err := s.Codec.Encode(ctx, refreshTokenClaims)
+	if err != nil {
+		return nil, apperr.Errorf(apperr.EINTERNAL, "failed to encode refresh token: %v", err)
+	}
+
+	refreshTokenExpiresAt := time.Unix(refreshTokenClaims.ExpiresAt, 0).UTC()
+
+	if err := s.RefreshTokenService.CreateRefreshToken(ctx, &entity.RefreshToken{
+		ID:        refreshTokenClaims.Id,
+		UserID:    auth.ID,
+		ExpiresAt: refreshTokenExpiresAt,
+	}); err != nil {
+		return nil, err
+	}
+
+	if s.SessionService != nil {
+		if newSession {
+			session := &entity.Session{
+				ID:          sessionID,
+				UserID:      auth.ID,
+				TokenID:     accessTokenclaims.Id,
+				IssuedAt:    time.Unix(accessTokenclaims.IssuedAt, 0).UTC(),
+				RefreshedAt: time.Unix(accessTokenclaims.IssuedAt, 0).UTC(),
+				ExpiresAt:   refreshTokenExpiresAt,
+			}
+			if client := entity.ClientFromContext(ctx); client != nil {
+				session.UserAgent, session.IP = client.UserAgent, client.IP
+			}
+
+			if err := s.SessionService.CreateSession(ctx, session); err != nil {
+				return nil, err
+			}
+		} else if err := s.SessionService.RefreshSession(ctx, sessionID, accessTokenclaims.Id, refreshTokenExpiresAt); err != nil {
+			return nil, err
+		}
+	}
+
+	return &entity.Token{
+		AccessToken:  accessTokenString,
+		RefreshToken: refreshTokenString,
+		TokenType:    entity.TokenTypeBearer,
+		Expiry:       int64(accessTokenExpiration.Seconds()),
+		Scope:        granted,
+	}, nil
+}
+
+// ExchangeClient implements service.JWTService
+func (s *Service) ExchangeClient(ctx context.Context, client *entity.APIKey, scope []entity.Permission) (*entity.Token, error) {
+	select {
+	case <-ctx.Done():
+		return nil, apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		granted, err := reduceScope(client.Scopes, scope)
+		if err != nil {
+			return nil, err
+		}
+
+		claims := s.stamp(entity.NewClientClaims(client, accessTokenExpiration), accessTokenExpiration)
+		claims.Scope = granted
+
+		accessTokenString, err := s.Codec.Encode(ctx, claims)
+		if err != nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to encode access token: %v", err)
+		}
+
+		return &entity.Token{
+			AccessToken: accessTokenString,
+			TokenType:   entity.TokenTypeBearer,
+			Expiry:      int64(accessTokenExpiration.Seconds()),
+			Scope:       granted,
+		}, nil
+	}
+}
+
+// Impersonate implements service.JWTService
+func (s *Service) Impersonate(ctx context.Context, admin *entity.User, user *entity.User) (*entity.Token, error) {
+	select {
+	case <-ctx.Done():
+		return nil, apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		claims := s.newClaims(user, entity.AccessTokenUse, entity.ImpersonationExpiration)
+		claims.Scope = entity.FormatScope(entity.Permissions(user.Roles))
+		claims.Actor = &entity.Actor{
+			Subject:  fmt.Sprint(admin.ID),
+			Username: admin.Username,
+		}
+
+		accessTokenString, err := s.Codec.Encode(ctx, claims)
+		if err != nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "failed to encode access token: %v", err)
+		}
+
+		return &entity.Token{
+			AccessToken: accessTokenString,
+			TokenType:   entity.TokenTypeBearer,
+			Expiry:      int64(entity.ImpersonationExpiration.Seconds()),
+			Scope:       claims.Scope,
+		}, nil
+	}
+}
+
+// Refresh implements service.JWTService
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (*entity.Token, error) {
+	select {
+	case <-ctx.Done():
+		return nil, apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		if s.RefreshTokenService == nil || s.UserService == nil {
+			return nil, apperr.Errorf(apperr.EINTERNAL, "refresh token service not configured")
+		}
+
+		claims, err := s.parse(ctx, refreshToken, entity.RefreshTokenUse)
+		if err != nil {
+			return nil, err
+		}
+
+		rt, err := s.RefreshTokenService.RotateRefreshToken(ctx, claims.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		// the user is loaded again so that the new pair reflects its current state.
+		user, err := s.UserService.FindUserByID(ctx, rt.UserID)
+		if apperr.ErrorCode(err) == apperr.ENOTFOUND {
+			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "user no longer exists")
+		} else if err != nil {
+			return nil, err
+		}
+
+		// tokens issued before scopes were introduced have none, they get all the permissions of the user.
+		scope, err := entity.ParseScope(claims.Scope)
+		if err != nil {
+			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "invalid refresh token scope")
+		}
+
+		// the new pair belongs to the same session of the rotated token, with the same scope
+		// unless the user has lost some of its permissions in the meantime.
+		return s.exchange(ctx, user, claims.SessionID, scope)
+	}
+}
+
+// Parse implements service.JWTService
+func (s *Service) Parse(ctx context.Context, token string) (*entity.AppClaims, error) {
+	select {
+	case <-ctx.Done():
+		return nil, apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		return s.parse(ctx, token, entity.AccessTokenUse)
+	}
+}
+
+// IssueMFAChallenge implements service.JWTService
+func (s *Service) IssueMFAChallenge(ctx context.Context, auth *entity.User, scope []entity.Permission) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		granted, err := reduceScope(entity.Permissions(auth.Roles), scope)
+		if err != nil {
+			return "", err
+		}
+
+		claims := s.newClaims(auth, entity.MFATokenUse, entity.MFAChallengeExpiration)
+		claims.Scope = granted
+
+		token, err := s.Codec.Encode(ctx, claims)
+		if err != nil {
+			return "", apperr.Errorf(apperr.EINTERNAL, "failed to encode mfa token: %v", err)
+		}
+		return token, nil
+	}
+}
+
+// ParseMFAChallenge implements service.JWTService
+func (s *Service) ParseMFAChallenge(ctx context.Context, token string) (*entity.AppClaims, error) {
+	select {
+	case <-ctx.Done():
+		return nil, apperr.Errorf(apperr.EINTERNAL, "context cancelled")
+	default:
+		return s.parse(ctx, token, entity.MFATokenUse)
+	}
+}
+
+// RevocationTTL implements service.JWTService
+func (s *Service) RevocationTTL(expiresAt time.Time) time.Duration {
+	return expiresAt.Add(s.Leeway).Sub(s.Now())
+}
+
+// reduceScope returns the scope of a token limited to the requested permissions among the granted ones.
+// Returns EFORBIDDEN if none of them is granted, an empty scope would grant nothing.
+func reduceScope(granted []entity.Permission, requested []entity.Permission) (string, error) {
+
+	reduced := entity.ReduceScope(granted, requested)
+	if len(requested) > 0 && len(reduced) == 0 {
+		return "", apperr.Errorf(apperr.EFORBIDDEN, "nessuno dei permessi richiesti è concesso: %s", entity.FormatScope(requested))
+	}
+
+	return entity.FormatScope(reduced), nil
+}
+
+// newClaims returns the claims of a new token of the user, issued now by this service.
+func (s *Service) newClaims(user *entity.User, tokenUse string, expiration time.Duration) *entity.AppClaims {
+	return s.stamp(entity.NewAppClaims(user, tokenUse, expiration), expiration)
+}
+
+// stamp sets the time based claims and the issuer of the claims of a token issued now by this service.
+func (s *Service) stamp(claims *entity.AppClaims, expiration time.Duration) *entity.AppClaims {
+
+	now := s.Now().UTC()
+	claims.IssuedAt = now.Unix()
+	claims.NotBefore = now.Unix()
+	claims.ExpiresAt = now.Add(expiration).Unix()
+	claims.Issuer = s.Issuer
+	claims.Audience = s.Audience
+
+	return claims
+}
+
+// parse decodes the token and checks that it has been issued for the given use
+// and that it has not been blacklisted.
+func (s *Service) parse(ctx context.Context, token string, tokenUse string) (*entity.AppClaims, error) {
+
+	claims, err := s.Codec.Decode(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.validateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	if claims.TokenUse != tokenUse {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unexpected token use, expected %q", tokenUse)
+	}
+
+	if s.JWTBlacklistService != nil {
+		if blacklisted, err := s.JWTBlacklistService.IsBlacklisted(ctx, claims.Id); err != nil {
+			return nil, err
+		} else if blacklisted {
+			return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "token has been revoked")
+		}
+
+		// revoking a session blacklists its id, which revokes all of its tokens at once.
+		if claims.SessionID != "" {
+			if blacklisted, err := s.JWTBlacklistService.IsBlacklisted(ctx, claims.SessionID); err != nil {
+				return nil, err
+			} else if blacklisted {
+				return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "session has been revoked")
+			}
+		}
+	}
+
+	return claims, nil
+}
+
+// validateClaims checks the registered claims of a decoded token.
+func (s *Service) validateClaims(claims *entity.AppClaims) error {
+
+	now := s.Now()
+	leeway := int64(s.Leeway / time.Second)
+
+	if claims.ExpiresAt == 0 {
+		return apperr.Errorf(apperr.ETOKENMALFORMED, "token has no expiration")
+	} else if now.Unix() > claims.ExpiresAt+leeway {
+		return apperr.Errorf(apperr.ETOKENEXPIRED, "token expired")
+	}
+
+	if now.Unix() < claims.NotBefore-leeway {
+		return apperr.Errorf(apperr.ETOKENNOTYETVALID, "token not valid yet")
+	}
+
+	if now.Unix() < claims.IssuedAt-leeway {
+		return apperr.Errorf(apperr.ETOKENNOTYETVALID, "token issued in the future")
+	}
+
+	if claims.Issuer != s.Issuer {
+		return apperr.Errorf(apperr.EUNAUTHORIZED, "unexpected token issuer")
+	}
+
+	if claims.Audience != s.Audience {
+		return apperr.Errorf(apperr.EUNAUTHORIZED, "unexpected token audience")
+	}
+
+	return nil
+}
@@ -0,0 +1,310 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"mysql/app/apperr"
+	"mysql/app/entity"
+	"mysql/app/service"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jsonCodec encodes the claims as plain JSON, the tests of the Service don't depend on a format.
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(ctx context.Context, claims *entity.AppClaims) (string, error) {
+	data, err := json.Marshal(claims)
+	return string(data), err
+}
+
+func (jsonCodec) Decode(ctx context.Context, token string) (*entity.AppClaims, error) {
+	claims := &entity.AppClaims{}
+	if err := json.NewDecoder(strings.NewReader(token)).Decode(claims); err != nil {
+		return nil, apperr.Errorf(apperr.ETOKENMALFORMED, "malformed token")
+	}
+	return claims, nil
+}
+
+func TestService_Exchange_NoRefreshTokenService(t *testing.T) {
+	s := NewService(jsonCodec{})
+
+	user := &entity.User{ID: 1, Username: "mario", Roles: []entity.Role{entity.RoleViewer}}
+
+	if _, err := s.Exchange(context.Background(), user, nil); apperr.ErrorCode(err) != apperr.EINTERNAL {
+		t.Fatalf("Exchange() = %v, want EINTERNAL", err)
+	}
+
+	if _, err := s.Refresh(context.Background(), "{}"); apperr.ErrorCode(err) != apperr.EINTERNAL {
+		t.Fatalf("Refresh() = %v, want EINTERNAL", err)
+	}
+}
+
+func TestService_ValidateClaims(t *testing.T) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	s := NewService(jsonCodec{})
+	s.Issuer = "issuer"
+	s.Audience = "audience"
+	s.Leeway = 30 * time.Second
+	s.Now = func() time.Time { return now }
+
+	at := func(d time.Duration) int64 { return now.Add(d).Unix() }
+
+	tests := []struct {
+		name string
+		exp  int64
+		nbf  int64
+		iat  int64
+		iss  string
+		aud  string
+		code string
+	}{
+		{name: "valid", exp: at(time.Minute), nbf: at(-time.Minute), iat: at(-time.Minute)},
+		{name: "no expiration", exp: 0, code: apperr.ETOKENMALFORMED},
+		{name: "expired", exp: at(-time.Minute), code: apperr.ETOKENEXPIRED},
+		{name: "expired within leeway", exp: at(-30 * time.Second)},
+		{name: "expired past leeway", exp: at(-31 * time.Second), code: apperr.ETOKENEXPIRED},
+		{name: "not yet valid", exp: at(time.Hour), nbf: at(time.Minute), code: apperr.ETOKENNOTYETVALID},
+		{name: "not yet valid within leeway", exp: at(time.Hour), nbf: at(30 * time.Second)},
+		{name: "not yet valid past leeway", exp: at(time.Hour), nbf: at(31 * time.Second), code: apperr.ETOKENNOTYETVALID},
+		{name: "issued in the future", exp: at(time.Hour), iat: at(time.Minute), code: apperr.ETOKENNOTYETVALID},
+		{name: "issued in the future within leeway", exp: at(time.Hour), iat: at(30 * time.Second)},
+		{name: "unexpected issuer", exp: at(time.Hour), iss: "other", code: apperr.EUNAUTHORIZED},
+		{name: "unexpected audience", exp: at(time.Hour), aud: "other", code: apperr.EUNAUTHORIZED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &entity.AppClaims{}
+			claims.ExpiresAt = tt.exp
+			claims.NotBefore = tt.nbf
+			claims.IssuedAt = tt.iat
+			claims.Issuer = "issuer"
+			if tt.iss != "" {
+				claims.Issuer = tt.iss
+			}
+			claims.Audience = "audience"
+			if tt.aud != "" {
+				claims.Audience = tt.aud
+			}
+
+			err := s.validateClaims(claims)
+			if tt.code == "" && err != nil {
+				t.Fatalf("validateClaims() = %v, want nil", err)
+			} else if tt.code != "" && apperr.ErrorCode(err) != tt.code {
+				t.Fatalf("validateClaims() = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
+
+// refreshTokens is a RefreshTokenService storing the refresh tokens in memory,
+// a refresh token can be rotated only once as with the sql one.
+type refreshTokens map[string]*entity.RefreshToken
+
+func (r refreshTokens) CreateRefreshToken(ctx context.Context, token *entity.RefreshToken) error {
+	r[token.ID] = token
+	return nil
+}
+
+func (r refreshTokens) RotateRefreshToken(ctx context.Context, id string) (*entity.RefreshToken, error) {
+	token, ok := r[id]
+	if !ok {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "unknown refresh token")
+	} else if token.RotatedAt != nil {
+		return nil, apperr.Errorf(apperr.EUNAUTHORIZED, "refresh token already used")
+	}
+
+	now := time.Now()
+	token.RotatedAt = &now
+	return token, nil
+}
+
+func (r refreshTokens) RevokeRefreshTokens(ctx context.Context, userID int64) error {
+	now := time.Now()
+	for _, token := range r {
+		if token.UserID == userID && token.RotatedAt == nil {
+			token.RotatedAt = &now
+		}
+	}
+	return nil
+}
+
+// users is a UserService finding the users in memory, the other methods are not used by the Service.
+type users map[int64]*entity.User
+
+func (u users) FindUserByID(ctx context.Context, id int64) (*entity.User, error) {
+	if user, ok := u[id]; ok {
+		return user, nil
+	}
+	return nil, apperr.Errorf(apperr.ENOTFOUND, "user not found")
+}
+
+func (u users) FindUserByUsername(ctx context.Context, username string) (*entity.User, error) {
+	return nil, apperr.Errorf(apperr.ENOTIMPLEMENTED, "not implemented")
+}
+
+func (u users) FindUsers(ctx context.Context, filter service.UserFilter) (entity.Users, error) {
+	return nil, apperr.Errorf(apperr.ENOTIMPLEMENTED, "not implemented")
+}
+
+func (u users) CreateUser(ctx context.Context, user *entity.User) error {
+	return apperr.Errorf(apperr.ENOTIMPLEMENTED, "not implemented")
+}
+
+func (u users) UpdateUser(ctx context.Context, id int64, upd service.UserUpdate) error {
+	return apperr.Errorf(apperr.ENOTIMPLEMENTED, "not implemented")
+}
+
+func (u users) DeleteUser(ctx context.Context, id int64) error {
+	return apperr.Errorf(apperr.ENOTIMPLEMENTED, "not implemented")
+}
+
+// newRefreshService returns a Service storing the refresh tokens of the user in memory.
+func newRefreshService(user *entity.User) (*Service, refreshTokens) {
+	tokens := make(refreshTokens)
+
+	s := NewService(jsonCodec{})
+	s.RefreshTokenService = tokens
+	s.UserService = users{user.ID: user}
+
+	return s, tokens
+}
+
+func TestService_Refresh(t *testing.T) {
+	ctx := context.Background()
+
+	user := &entity.User{ID: 1, Username: "mario", Roles: []entity.Role{entity.RoleEditor}}
+	s, tokens := newRefreshService(user)
+
+	pair, err := s.Exchange(ctx, user, []entity.Permission{entity.PermissionCitiesRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := s.Codec.Decode(ctx, pair.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := s.Refresh(ctx, pair.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	} else if refreshed.RefreshToken == pair.RefreshToken || refreshed.AccessToken == pair.AccessToken {
+		t.Fatal("expected a new token pair")
+	}
+
+	// the old refresh token is rotated and a record of the new one is created.
+	if tokens[old.Id].RotatedAt == nil {
+		t.Fatal("expected the old refresh token to be rotated")
+	} else if len(tokens) != 2 {
+		t.Fatalf("expected 2 refresh tokens, got %d", len(tokens))
+	}
+
+	// the new pair keeps the scope and the session of the old one.
+	if refreshed.Scope != string(entity.PermissionCitiesRead) {
+		t.Fatalf("scope = %q, want %q", refreshed.Scope, entity.PermissionCitiesRead)
+	}
+	claims, err := s.Parse(ctx, refreshed.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	} else if claims.Scope != string(entity.PermissionCitiesRead) || claims.SessionID != old.SessionID {
+		t.Fatalf("unexpected claims: scope %q, sid %q, want %q", claims.Scope, claims.SessionID, old.SessionID)
+	}
+
+	// a rotated refresh token can't be used again, the new one can.
+	if _, err := s.Refresh(ctx, pair.RefreshToken); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("Refresh() = %v, want EUNAUTHORIZED", err)
+	}
+	if _, err := s.Refresh(ctx, refreshed.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestService_Refresh_TokenUse(t *testing.T) {
+	ctx := context.Background()
+
+	user := &entity.User{ID: 1, Username: "mario", Roles: []entity.Role{entity.RoleViewer}}
+	s, _ := newRefreshService(user)
+
+	pair, err := s.Exchange(ctx, user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Parse(ctx, pair.RefreshToken); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("Parse(refresh token) = %v, want EUNAUTHORIZED", err)
+	}
+
+	if _, err := s.Refresh(ctx, pair.AccessToken); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("Refresh(access token) = %v, want EUNAUTHORIZED", err)
+	}
+
+	// a refresh token without a record, e.g. issued by another deployment with the same keys.
+	claims := s.newClaims(user, entity.RefreshTokenUse, time.Hour)
+	unknown, err := s.Codec.Encode(ctx, claims)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Refresh(ctx, unknown); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("Refresh(unknown token) = %v, want EUNAUTHORIZED", err)
+	}
+}
+
+func TestService_Refresh_UserChanged(t *testing.T) {
+	ctx := context.Background()
+
+	user := &entity.User{ID: 1, Username: "mario", Roles: []entity.Role{entity.RoleEditor}}
+	s, _ := newRefreshService(user)
+
+	pair, err := s.Exchange(ctx, user, []entity.Permission{entity.PermissionCitiesRead, entity.PermissionCitiesWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the scope shrinks with the permissions of the user.
+	s.UserService = users{user.ID: {ID: 1, Username: "mario", Roles: []entity.Role{entity.RoleViewer}}}
+
+	refreshed, err := s.Refresh(ctx, pair.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	} else if refreshed.Scope != string(entity.PermissionCitiesRead) {
+		t.Fatalf("scope = %q, want %q", refreshed.Scope, entity.PermissionCitiesRead)
+	}
+
+	// the deleted users can't refresh their tokens.
+	s.UserService = users{}
+
+	if _, err := s.Refresh(ctx, refreshed.RefreshToken); apperr.ErrorCode(err) != apperr.EUNAUTHORIZED {
+		t.Fatalf("Refresh() = %v, want EUNAUTHORIZED", err)
+	}
+}
+
+func TestService_RevocationTTL(t *testing.T) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	s := NewService(jsonCodec{})
+	s.Leeway = 30 * time.Second
+	s.Now = func() time.Time { return now }
+
+	// a token is blacklisted for as long as validateClaims would accept it.
+	for _, tt := range []struct {
+		exp  time.Time
+		want time.Duration
+	}{
+		{exp: now.Add(time.Hour), want: time.Hour + 30*time.Second},
+		{exp: now.Add(-10 * time.Second), want: 20 * time.Second},
+		{exp: now.Add(-time.Minute), want: -30 * time.Second},
+	} {
+		if got := s.RevocationTTL(tt.exp); got != tt.want {
+			t.Errorf("RevocationTTL(%v) = %v, want %v", tt.exp, got, tt.want)
+		}
+
+		claims := &entity.AppClaims{}
+		claims.ExpiresAt = tt.exp.Unix()
+		claims.Issuer, claims.Audience = s.Issuer, s.Audience
+		if accepted := s.validateClaims(claims) == nil; accepted != (tt.want > 0) {
+			t.Errorf("exp %v: accepted = %v, but RevocationTTL = %v", tt.exp, accepted, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package totp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"mysql/app/apperr"
+	"mysql/app/service"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var _ service.TOTPService = (*TOTPService)(nil)
+
+// Defaults used by authenticator apps: most of them ignore any other value
+// in the provisioning URI, so they should not be changed.
+const (
+	DefaultDigits = 6
+	DefaultPeriod = 30 * time.Second
+	DefaultSkew   = 1
+)
+
+// secretLength is the length of the generated secrets in bytes, the length
+// of the output of HMAC-SHA1 as recommended by RFC 4226.
+const secretLength = 20
+
+// encoding is the base32 encoding of the secrets, without padding as expected
+// by authenticator apps.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPService generates and validates time-based one-time passwords as
+// described by RFC 6238, using HMAC-SHA1.
+type TOTPService struct {
+	// Issuer is the name of the service shown by authenticator apps.
+	Issuer string
+
+	// Digits is the number of digits of a code.
+	Digits int
+
+	// Period is the time step, a new code is generated every Period.
+	Period time.Duration
+
+	// Skew is the number of time steps before and after the current one whose
+	// codes are still accepted, to tolerate clock drift and slow users.
+	Skew int64
+
+	// Now returns the current time, it can be replaced in tests.
+	Now func() time.Time
+}
+
+func NewTOTPService(issuer string) *TOTPService {
+	return &TOTPService{
+		Issuer: issuer,
+		Digits: DefaultDigits,
+		Period: DefaultPeriod,
+		Skew:   DefaultSkew,
+		Now:    time.Now,
+	}
+}
+
+// GenerateSecret implements service.TOTPService
+func (s *TOTPService) GenerateSecret(ctx context.Context) (string, error) {
+
+	b := make([]byte, secretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", apperr.Errorf(apperr.EINTERNAL, "failed to generate totp secret: %v", err)
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+// ProvisioningURI implements service.TOTPService
+func (s *TOTPService) ProvisioningURI(ctx context.Context, account string, secret string) string {
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", s.Issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(s.Digits))
+	params.Set("period", fmt.Sprint(int64(s.Period/time.Second)))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + s.Issuer + ":" + account,
+		RawQuery: params.Encode(),
+	}
+
+	return u.String()
+}
+
+// Validate implements service.TOTPService
+func (s *TOTPService) Validate(ctx context.Context, secret string, code string) (int64, bool, error) {
+
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false, apperr.Errorf(apperr.EINTERNAL, "invalid totp secret: %v", err)
+	}
+
+	if len(code) != s.Digits {
+		return 0, false, nil
+	}
+
+	current := s.Now().Unix() / int64(s.Period/time.Second)
+
+	for counter := current - s.Skew; counter <= current+s.Skew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(s.code(key, counter)), []byte(code)) == 1 {
+			return counter, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// Code returns the code for the given secret at time t.
+func (s *TOTPService) Code(secret string, t time.Time) (string, error) {
+
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", apperr.Errorf(apperr.EINVALID, "invalid totp secret: %v", err)
+	}
+
+	return s.code(key, t.Unix()/int64(s.Period/time.Second)), nil
+}
+
+// code computes the HOTP value of the counter as described by RFC 4226.
+func (s *TOTPService) code(key []byte, counter int64) string {
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < s.Digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", s.Digits, value%mod)
+}
@@ -0,0 +1,118 @@
+package totp
+
+import (
+	"context"
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the test vectors of RFC 6238 appendix B.
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPService_Code(t *testing.T) {
+	s := NewTOTPService("test")
+	s.Digits = 8
+
+	for unix, want := range map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	} {
+		if got, err := s.Code(rfcSecret, time.Unix(unix, 0)); err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Errorf("Code(%d) = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestTOTPService_Validate(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1111111111, 0)
+
+	s := NewTOTPService("test")
+	s.Now = func() time.Time { return now }
+
+	code := func(d time.Duration) string {
+		c, err := s.Code(rfcSecret, now.Add(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{name: "current", code: code(0), ok: true},
+		{name: "previous step", code: code(-s.Period), ok: true},
+		{name: "next step", code: code(s.Period), ok: true},
+		{name: "beyond the skew", code: code(-2 * s.Period), ok: false},
+		{name: "wrong length", code: code(0)[1:], ok: false},
+		{name: "wrong code", code: "000000", ok: code(0) == "000000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok, err := s.Validate(ctx, rfcSecret, tt.code); err != nil {
+				t.Fatal(err)
+			} else if ok != tt.ok {
+				t.Fatalf("Validate() = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+
+	// the counter is the time step of the code, so that the caller can reject a used code.
+	if counter, _, _ := s.Validate(ctx, rfcSecret, code(-s.Period)); counter != now.Unix()/30-1 {
+		t.Fatalf("counter = %d, want %d", counter, now.Unix()/30-1)
+	}
+
+	if _, ok, err := s.Validate(ctx, strings.ToLower(rfcSecret), code(0)); err != nil || !ok {
+		t.Fatalf("Validate() = %v, %v, want the lower case secret to be accepted", ok, err)
+	}
+
+	if _, _, err := s.Validate(ctx, "not base32!", code(0)); err == nil {
+		t.Fatal("expected an error for an invalid secret")
+	}
+}
+
+func TestTOTPService_GenerateSecret(t *testing.T) {
+	s := NewTOTPService("test")
+
+	secret, err := s.GenerateSecret(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key, err := encoding.DecodeString(secret); err != nil {
+		t.Fatal(err)
+	} else if len(key) != secretLength {
+		t.Fatalf("len(key) = %d, want %d", len(key), secretLength)
+	}
+}
+
+func TestTOTPService_ProvisioningURI(t *testing.T) {
+	s := NewTOTPService("Città")
+
+	u, err := url.Parse(s.ProvisioningURI(context.Background(), "mario", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Città:mario" {
+		t.Fatalf("unexpected uri: %s", u)
+	}
+
+	q := u.Query()
+	if q.Get("secret") != rfcSecret || q.Get("issuer") != "Città" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Fatalf("unexpected parameters: %v", q)
+	}
+}